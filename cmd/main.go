@@ -1,12 +1,17 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	// Pastikan ini sesuai nama module di go.mod Anda
@@ -28,12 +33,12 @@ func main() {
 	if token == "" {
 		log.Fatal("[FATAL] TELEGRAM_BOT_TOKEN is missing in .env")
 	}
-	if sbURL == "" || sbKey == "" {
-		log.Fatal("[FATAL] SUPABASE_URL or SUPABASE_KEY is missing in .env")
-	}
 
 	// 2. Init Dependencies
-	db, err := app.NewDatabase(sbURL, sbKey)
+	tgTimeout, _ := strconv.Atoi(os.Getenv("TELEGRAM_TIMEOUT")) // detik, default 30
+	tg := app.NewTelegramClient(token, os.Getenv("TELEGRAM_API_URL"), time.Duration(tgTimeout)*time.Second, nil)
+
+	db, err := openStore(sbURL, sbKey)
 	if err != nil {
 		log.Fatal("[FATAL] Database connection failed:", err)
 	}
@@ -41,51 +46,281 @@ func main() {
 	i18n := app.NewI18nManager()
 	i18n.LoadTranslations("locales")
 
-	replicate := app.NewReplicate(os.Getenv("REPLICATE_API_TOKEN"))
+	backends := newBackends()
 
 	// 3. Init Bot App (The "Brain")
 	// PERBAIKAN DISINI: Kita masukkan sbURL dan sbKey ke constructor
-	bot := app.NewBotApp(token, sbURL, sbKey, db, replicate, i18n)
+	bot := app.NewBotApp(tg, sbURL, sbKey, db, backends, i18n)
+	// ADMIN_IDS: daftar Telegram user ID dipisah koma (akses /refund dll)
+	for _, id := range strings.Split(os.Getenv("ADMIN_IDS"), ",") {
+		if adminID, err := strconv.ParseInt(strings.TrimSpace(id), 10, 64); err == nil {
+			bot.Admins[adminID] = true
+		}
+	}
+	// Username bot untuk link /invite (BOT_USERNAME, atau ditanyakan ke getMe)
+	bot.Username = strings.TrimPrefix(os.Getenv("BOT_USERNAME"), "@")
+	if bot.Username == "" {
+		if username, err := tg.GetMe(); err == nil {
+			bot.Username = username
+		} else {
+			fmt.Println("[ERROR] getMe failed, /invite disabled:", err)
+		}
+	}
+	bot.Debug = os.Getenv("DEBUG_PAYLOADS") == "true"
+	if workers, err := strconv.Atoi(os.Getenv("MAX_WORKERS")); err == nil && workers > 0 {
+		bot.Dispatcher = app.NewDispatcher(workers, bot.HandleUpdate)
+	}
+
+	if err := bot.DB.PruneProcessedUpdates(48 * time.Hour); err != nil {
+		fmt.Println("[ERROR] Failed to prune processed updates:", err)
+	}
 
-	// 4. Start Polling
-	startPolling(bot)
+	// 4. Start Receiving Updates (BOT_MODE=polling|webhook)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Webhook Replicate dilayani di server HTTP yang sama dengan webhook Telegram
+	mux := http.NewServeMux()
+	replicateHook := mountReplicateWebhook(mux, bot)
+
+	// Cocokkan generasi webhook yang tertinggal dari proses sebelumnya, lalu awasi
+	// job yang webhook-nya tidak datang sampai deadline
+	go func() {
+		bot.ReconcileGenerations(ctx)
+		bot.SweepWebhookJobs(ctx)
+	}()
+
+	if os.Getenv("BOT_MODE") == "webhook" {
+		startWebhook(ctx, bot, mux)
+	} else {
+		if replicateHook {
+			server := serveHTTP(mux)
+			defer shutdownServer(server)
+		}
+		lastUpdateID := startPolling(ctx, bot)
+		defer confirmOffset(bot, lastUpdateID)
+	}
+
+	// 5. Graceful Shutdown: tunggu generasi yang berjalan, refund sisanya
+	shutdownTimeout := 90 * time.Second
+	if secs, err := strconv.Atoi(os.Getenv("SHUTDOWN_TIMEOUT")); err == nil && secs > 0 {
+		shutdownTimeout = time.Duration(secs) * time.Second
+	}
+	fmt.Printf("[INFO] Shutting down, waiting up to %v for in-flight generations...\n", shutdownTimeout)
+	// Batas keras: kiriman yang masih mengantre di rate limiter dibatalkan
+	// agar refund & notifikasi terakhir tidak menahan proses selamanya
+	time.AfterFunc(shutdownTimeout+30*time.Second, tg.Close)
+	bot.Shutdown(shutdownTimeout)
+	tg.Close()
+	fmt.Println("[INFO] Bye.")
 }
 
-func startPolling(bot *app.BotApp) {
-	client := &http.Client{}
-	url := fmt.Sprintf("https://api.telegram.org/bot%s/getUpdates", bot.BotToken)
-	lastUpdateID := 0
+// newBackends menyiapkan backend generasi. Replicate selalu aktif; backend lain
+// aktif jika dikonfigurasi (OPENAI_API_KEY/OPENAI_BASE_URL, COMFYUI_URL, A1111_URL).
+// REPLICATE_WEBHOOK_URL mengaktifkan webhook Replicate (wajib bersama REPLICATE_WEBHOOK_SECRET).
+func newBackends() map[string]app.ImageBackend {
+	replicate := app.NewReplicate(os.Getenv("REPLICATE_API_TOKEN"))
+	replicate.WebhookURL = os.Getenv("REPLICATE_WEBHOOK_URL")
+	replicate.WebhookSecret = os.Getenv("REPLICATE_WEBHOOK_SECRET")
+	if replicate.WebhookURL != "" && replicate.WebhookSecret == "" {
+		log.Fatal("[FATAL] REPLICATE_WEBHOOK_SECRET is required when REPLICATE_WEBHOOK_URL is set")
+	}
+	backends := map[string]app.ImageBackend{
+		app.BackendReplicate: replicate,
+	}
+	if key, base := os.Getenv("OPENAI_API_KEY"), os.Getenv("OPENAI_BASE_URL"); key != "" || base != "" {
+		backends[app.BackendOpenAI] = app.NewOpenAIBackend(base, key)
+	}
+	if comfyURL := os.Getenv("COMFYUI_URL"); comfyURL != "" {
+		backends[app.BackendComfyUI] = app.NewComfyUIBackend(comfyURL, os.Getenv("COMFYUI_WORKFLOW_DIR"))
+	}
+	if a1111URL := os.Getenv("A1111_URL"); a1111URL != "" {
+		backends[app.BackendA1111] = app.NewA1111Backend(a1111URL, os.Getenv("A1111_AUTH"))
+	}
+	var names []string
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Println("[INFO] Generation backends:", strings.Join(names, ", "))
+	return backends
+}
 
-	fmt.Println("[INFO] Bot is running. Waiting for messages...")
+// openStore memilih backend penyimpanan lewat DB_BACKEND (supabase|postgres|sqlite|memory)
+func openStore(sbURL, sbKey string) (app.Store, error) {
+	backend := os.Getenv("DB_BACKEND")
+	if backend == "" {
+		backend = "supabase"
+	}
+	fmt.Println("[INFO] Storage backend:", backend)
 
-	for {
-		reqData := map[string]interface{}{"offset": lastUpdateID + 1, "timeout": 60}
-		jsonData, _ := json.Marshal(reqData)
-		resp, err := client.Post(url, "application/json", bytes.NewBuffer(jsonData))
+	switch backend {
+	case "supabase":
+		if sbURL == "" || sbKey == "" {
+			log.Fatal("[FATAL] SUPABASE_URL or SUPABASE_KEY is missing in .env")
+		}
+		return app.NewDatabase(sbURL, sbKey)
+	case "postgres":
+		dsn := os.Getenv("DATABASE_URL")
+		if dsn == "" {
+			log.Fatal("[FATAL] DATABASE_URL is missing in .env")
+		}
+		return app.NewPostgresStore(dsn)
+	case "sqlite":
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			path = "bot.db"
+		}
+		return app.NewSQLiteStore(path)
+	case "memory":
+		return app.NewMemoryStore(), nil
+	}
+	return nil, fmt.Errorf("unknown DB_BACKEND %q", backend)
+}
 
-		if err != nil {
-			fmt.Println("[ERROR] Polling:", err)
-			time.Sleep(5 * time.Second)
-			continue
+// mountReplicateWebhook memasang handler webhook Replicate di path REPLICATE_WEBHOOK_URL.
+// Mengembalikan false jika webhook Replicate tidak aktif.
+func mountReplicateWebhook(mux *http.ServeMux, bot *app.BotApp) bool {
+	rep, ok := bot.Backends[app.BackendReplicate].(*app.ReplicateConfig)
+	if !ok || rep.WebhookURL == "" {
+		return false
+	}
+	parsed, err := url.Parse(rep.WebhookURL)
+	if err != nil {
+		log.Fatal("[FATAL] Invalid REPLICATE_WEBHOOK_URL:", err)
+	}
+	if parsed.Path == "" || parsed.Path == "/" {
+		log.Fatal("[FATAL] REPLICATE_WEBHOOK_URL needs a path, e.g. https://example.com/replicate")
+	}
+	mux.Handle(parsed.Path, bot.ReplicateWebhookHandler())
+	fmt.Println("[INFO] Replicate webhook enabled on", parsed.Path)
+	return true
+}
+
+// listenAddr membaca alamat server HTTP dari WEBHOOK_LISTEN atau PORT (default :8080)
+func listenAddr() string {
+	addr := os.Getenv("WEBHOOK_LISTEN")
+	if addr == "" {
+		addr = ":8080"
+		if port := os.Getenv("PORT"); port != "" {
+			addr = ":" + port
+		}
+	}
+	return addr
+}
+
+// serveHTTP menjalankan server HTTP untuk mux di background
+func serveHTTP(mux *http.ServeMux) *http.Server {
+	server := &http.Server{Addr: listenAddr(), Handler: mux}
+	go func() {
+		fmt.Printf("[INFO] HTTP server listening on %s\n", server.Addr)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal("[FATAL] HTTP server:", err)
+		}
+	}()
+	return server
+}
+
+func shutdownServer(server *http.Server) {
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	server.Shutdown(shutdownCtx)
+}
+
+func startWebhook(ctx context.Context, bot *app.BotApp, mux *http.ServeMux) {
+	webhookURL := os.Getenv("WEBHOOK_URL")
+	secret := os.Getenv("WEBHOOK_SECRET")
+	if webhookURL == "" {
+		log.Fatal("[FATAL] WEBHOOK_URL is missing in .env")
+	}
+	// Tanpa secret siapa pun bisa mengirim update palsu (mis. successful_payment)
+	if secret == "" {
+		log.Fatal("[FATAL] WEBHOOK_SECRET is required in webhook mode")
+	}
+	parsed, err := url.Parse(webhookURL)
+	if err != nil {
+		log.Fatal("[FATAL] Invalid WEBHOOK_URL:", err)
+	}
+	path := parsed.Path
+	if path == "" {
+		path = "/"
+	}
+
+	mux.Handle(path, bot.WebhookHandler(secret))
+	fmt.Println("[INFO] Telegram webhook path:", path)
+	server := serveHTTP(mux)
+
+	if err := bot.TG.SetWebhook(webhookURL, secret); err != nil {
+		log.Fatal("[FATAL] setWebhook failed:", err)
+	}
+	fmt.Println("[INFO] Bot is running (webhook). Waiting for messages...")
+
+	<-ctx.Done()
+	fmt.Println("[INFO] Shutting down webhook server...")
+
+	// WEBHOOK_KEEP_ON_SHUTDOWN=true agar Telegram tetap mengirim update (scale to zero)
+	if os.Getenv("WEBHOOK_KEEP_ON_SHUTDOWN") != "true" {
+		if err := bot.TG.DeleteWebhook(); err != nil {
+			fmt.Println("[ERROR] deleteWebhook:", err)
 		}
+	}
+
+	shutdownServer(server)
+}
+
+// startPolling berjalan sampai ctx dibatalkan dan mengembalikan update_id terakhir yang diterima
+func startPolling(ctx context.Context, bot *app.BotApp) int {
+	// getUpdates ditolak Telegram selama webhook masih aktif
+	if err := bot.TG.DeleteWebhook(); err != nil {
+		fmt.Println("[ERROR] deleteWebhook:", err)
+	}
 
-		var tgResp app.TelegramResponse
-		json.NewDecoder(resp.Body).Decode(&tgResp)
-		resp.Body.Close()
+	// Lanjutkan dari offset yang tersimpan agar restart tidak memproses ulang update
+	lastUpdateID, err := bot.DB.GetUpdateOffset()
+	if err != nil {
+		fmt.Println("[ERROR] Failed to load update offset:", err)
+	}
+
+	fmt.Println("[INFO] Bot is running. Waiting for messages...")
 
-		if !tgResp.Ok {
+	for ctx.Err() == nil {
+		updates, err := bot.TG.GetUpdates(ctx, lastUpdateID+1, 60)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			fmt.Println("[ERROR] Polling:", err)
+			time.Sleep(5 * time.Second)
 			continue
 		}
 
-		for _, update := range tgResp.Result {
+		for _, update := range updates {
 			lastUpdateID = update.UpdateID
 
-			// Route to Handler Methods
-			if update.CallbackQuery.ID != "" {
-				go bot.HandleCallback(update) // Run in Goroutine for speed
-			} else if update.Message.Text != "" || len(update.Message.Photo) > 0 {
-				go bot.HandleMessage(update) // Run in Goroutine for speed
+			// Route to Handler Methods (paralel antar user, berurutan per user)
+			bot.Dispatcher.Dispatch(update)
+		}
+		// Offset menandai update yang sudah diterima, bukan yang selesai diproses: getUpdates
+		// berikutnya mengonfirmasinya ke Telegram, jadi update yang masih antre di dispatcher
+		// saat crash tidak dikirim ulang (lihat ClaimUpdate)
+		if len(updates) > 0 {
+			if err := bot.DB.SaveUpdateOffset(lastUpdateID); err != nil {
+				fmt.Println("[ERROR] Failed to save update offset:", err)
 			}
 		}
 	}
-}
\ No newline at end of file
+	return lastUpdateID
+}
+
+// confirmOffset mengonfirmasi offset ke Telegram agar update yang sudah diproses
+// tidak dikirim ulang setelah restart
+func confirmOffset(bot *app.BotApp, lastUpdateID int) {
+	if lastUpdateID == 0 {
+		return
+	}
+	if _, err := bot.TG.GetUpdates(context.Background(), lastUpdateID+1, 0); err != nil {
+		fmt.Println("[ERROR] Failed to confirm update offset:", err)
+		return
+	}
+	fmt.Printf("[INFO] Confirmed update offset %d\n", lastUpdateID+1)
+}
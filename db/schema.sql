@@ -0,0 +1,599 @@
+-- Skema Supabase/Postgres untuk TelegramTextToImgBot.
+-- Jalankan di SQL Editor Supabase. Aman dijalankan ulang.
+
+create table if not exists users (
+    id              bigint primary key,
+    language_code   text not null default 'en',
+    credits         integer not null default 0,  -- jatah gratis sesuai plan
+    paid_credits    integer not null default 0,  -- kredit yang dibeli, tidak ikut reset
+    diamonds        integer not null default 0,  -- mata uang premium (model dengan diamond_cost)
+    plan            text not null default '',    -- '' = plan default (config/plans.json)
+    plan_expires_at timestamptz,                 -- NULL = plan tidak kedaluwarsa
+    last_reset_date text,                        -- kunci periode reset terakhir
+    current_state   text not null default '',
+    selected_model  text not null default '',
+    draft_config    jsonb not null default '{}'::jsonb
+);
+
+alter table users add column if not exists paid_credits integer not null default 0;
+alter table users add column if not exists plan text not null default '';
+alter table users add column if not exists diamonds integer not null default 0;
+alter table users add column if not exists plan_expires_at timestamptz;
+
+-- Offset getUpdates yang terakhir diproses (key = 'update_offset')
+create table if not exists bot_state (
+    key   text primary key,
+    value text not null
+);
+
+-- Idempotensi: setiap update_id / callback_query_id hanya boleh diproses sekali
+create table if not exists processed_updates (
+    update_id         bigint primary key,
+    callback_query_id text unique,
+    created_at        timestamptz not null default now()
+);
+
+-- Riwayat setiap perubahan kredit (debit, refund, daily_reset, grant)
+create table if not exists credit_ledger (
+    id            bigserial primary key,
+    user_id       bigint not null references users(id),
+    currency      text not null default 'credits', -- credits | diamonds
+    amount        integer not null,          -- positif = masuk, negatif = keluar
+    balance_after integer not null,          -- saldo mata uang yang sama setelah transaksi
+    kind          text not null,             -- debit | refund | daily_reset | grant
+    reason        text not null default '',
+    model_id      text not null default '',
+    generation_id text not null default '',
+    created_at    timestamptz not null default now()
+);
+alter table credit_ledger add column if not exists currency text not null default 'credits';
+create index if not exists credit_ledger_user_idx on credit_ledger (user_id, id desc);
+
+-- User yang saldonya tidak cocok dengan jumlah ledger (untuk audit)
+drop view if exists credit_balance_check;
+create view credit_balance_check as
+select u.id as user_id,
+       u.credits + u.paid_credits as balance,
+       coalesce(sum(l.amount) filter (where l.currency = 'credits'), 0) as ledger_sum,
+       u.diamonds,
+       coalesce(sum(l.amount) filter (where l.currency = 'diamonds'), 0) as diamond_ledger_sum
+  from users u
+  left join credit_ledger l on l.user_id = u.id
+ group by u.id, u.credits, u.paid_credits, u.diamonds
+having u.credits + u.paid_credits <> coalesce(sum(l.amount) filter (where l.currency = 'credits'), 0)
+    or u.diamonds <> coalesce(sum(l.amount) filter (where l.currency = 'diamonds'), 0);
+
+-- Sekali jalan: saldo user yang sudah ada sebelum ledger dicatat sebagai opening_balance,
+-- supaya credit_balance_check hanya menampilkan selisih yang sungguhan.
+-- Penanda di bot_state mencegah selisih baru ikut "ditutupi" saat skema dijalankan ulang.
+do $$
+begin
+    if exists (select 1 from bot_state where key = 'ledger_opening_balance') then
+        return;
+    end if;
+
+    insert into credit_ledger (user_id, currency, amount, balance_after, kind, reason, created_at)
+    select u.id, 'credits', u.credits + u.paid_credits - coalesce(sum(l.amount), 0),
+           u.credits + u.paid_credits - coalesce(sum(l.amount), 0),
+           'opening_balance', 'migration', coalesce(min(l.created_at), now())
+      from users u
+      left join credit_ledger l on l.user_id = u.id and l.currency = 'credits'
+     group by u.id, u.credits, u.paid_credits
+    having u.credits + u.paid_credits <> coalesce(sum(l.amount), 0);
+
+    insert into credit_ledger (user_id, currency, amount, balance_after, kind, reason, created_at)
+    select u.id, 'diamonds', u.diamonds - coalesce(sum(l.amount), 0),
+           u.diamonds - coalesce(sum(l.amount), 0),
+           'opening_balance', 'migration', coalesce(min(l.created_at), now())
+      from users u
+      left join credit_ledger l on l.user_id = u.id and l.currency = 'diamonds'
+     group by u.id, u.diamonds
+    having u.diamonds <> coalesce(sum(l.amount), 0);
+
+    insert into bot_state (key, value) values ('ledger_opening_balance', now()::text);
+end;
+$$;
+
+drop function if exists deduct_credits(bigint, integer);
+drop function if exists add_credits(bigint, integer);
+drop function if exists deduct_credits(bigint, integer, text, text, text);
+drop function if exists add_credits(bigint, integer, text, text, text, text);
+drop function if exists reset_daily_credits(bigint, integer, text, text);
+
+-- Potong kredit secara atomik + catat ledger. Jatah gratis dipakai dulu, lalu paid_credits.
+-- Mengembalikan {"balance", "paid_used"}, atau NULL jika saldo kurang.
+create or replace function deduct_credits(
+    p_user_id bigint, p_amount integer,
+    p_reason text default '', p_model_id text default '', p_generation_id text default '')
+returns json
+language plpgsql
+as $$
+declare
+    v_free integer;
+    v_paid integer;
+    v_free_used integer;
+begin
+    select credits, paid_credits into v_free, v_paid
+      from users
+     where id = p_user_id
+       for update;
+
+    if not found or v_free + v_paid < p_amount then
+        return null;
+    end if;
+
+    v_free_used := least(v_free, p_amount);
+    update users
+       set credits = v_free - v_free_used,
+           paid_credits = v_paid - (p_amount - v_free_used)
+     where id = p_user_id;
+
+    insert into credit_ledger (user_id, amount, balance_after, kind, reason, model_id, generation_id)
+    values (p_user_id, -p_amount, v_free + v_paid - p_amount, 'debit', p_reason, p_model_id, p_generation_id);
+
+    return json_build_object('balance', v_free + v_paid - p_amount, 'paid_used', p_amount - v_free_used);
+end;
+$$;
+
+-- Tambah kredit secara atomik (refund/grant) + catat ledger. p_paid bagian yang masuk ke paid_credits.
+-- Mengembalikan saldo total baru, atau NULL jika user tidak ada.
+create or replace function add_credits(
+    p_user_id bigint, p_amount integer, p_kind text default 'grant',
+    p_reason text default '', p_model_id text default '', p_generation_id text default '',
+    p_paid integer default 0)
+returns integer
+language plpgsql
+as $$
+declare
+    v_balance integer;
+begin
+    update users
+       set credits = credits + (p_amount - p_paid),
+           paid_credits = paid_credits + p_paid
+     where id = p_user_id
+    returning credits + paid_credits into v_balance;
+
+    if v_balance is null then
+        return null;
+    end if;
+
+    insert into credit_ledger (user_id, amount, balance_after, kind, reason, model_id, generation_id)
+    values (p_user_id, p_amount, v_balance, p_kind, p_reason, p_model_id, p_generation_id);
+    return v_balance;
+end;
+$$;
+
+-- Potong diamonds secara atomik + catat ledger. Mengembalikan saldo diamonds baru, atau NULL jika kurang.
+create or replace function deduct_diamonds(
+    p_user_id bigint, p_amount integer,
+    p_reason text default '', p_model_id text default '', p_generation_id text default '')
+returns integer
+language plpgsql
+as $$
+declare
+    v_balance integer;
+begin
+    update users
+       set diamonds = diamonds - p_amount
+     where id = p_user_id
+       and diamonds >= p_amount
+    returning diamonds into v_balance;
+
+    if v_balance is null then
+        return null;
+    end if;
+
+    insert into credit_ledger (user_id, currency, amount, balance_after, kind, reason, model_id, generation_id)
+    values (p_user_id, 'diamonds', -p_amount, v_balance, 'debit', p_reason, p_model_id, p_generation_id);
+    return v_balance;
+end;
+$$;
+
+-- Tambah diamonds secara atomik (refund/grant) + catat ledger. NULL jika user tidak ada.
+create or replace function add_diamonds(
+    p_user_id bigint, p_amount integer, p_kind text default 'grant',
+    p_reason text default '', p_model_id text default '', p_generation_id text default '')
+returns integer
+language plpgsql
+as $$
+declare
+    v_balance integer;
+begin
+    update users
+       set diamonds = diamonds + p_amount
+     where id = p_user_id
+    returning diamonds into v_balance;
+
+    if v_balance is null then
+        return null;
+    end if;
+
+    insert into credit_ledger (user_id, currency, amount, balance_after, kind, reason, model_id, generation_id)
+    values (p_user_id, 'diamonds', p_amount, v_balance, p_kind, p_reason, p_model_id, p_generation_id);
+    return v_balance;
+end;
+$$;
+
+-- Isi ulang jatah gratis jika last_reset_date masih p_last_period (top-up atau replace).
+-- paid_credits tidak disentuh. Mengembalikan jatah gratis baru, atau NULL jika sudah di-reset.
+create or replace function reset_allowance(
+    p_user_id bigint, p_allowance integer, p_top_up boolean, p_period text, p_last_period text)
+returns integer
+language plpgsql
+as $$
+declare
+    v_old integer;
+    v_paid integer;
+    v_new integer;
+begin
+    select credits, paid_credits into v_old, v_paid
+      from users
+     where id = p_user_id
+       and coalesce(last_reset_date, '') = p_last_period
+       for update;
+
+    if not found then
+        return null;
+    end if;
+
+    v_new := case when p_top_up then greatest(v_old, p_allowance) else p_allowance end;
+    update users
+       set credits = v_new, last_reset_date = p_period
+     where id = p_user_id;
+
+    if v_new <> v_old then
+        insert into credit_ledger (user_id, amount, balance_after, kind, reason)
+        values (p_user_id, v_new - v_old, v_new + v_paid, 'daily_reset', 'allowance');
+    end if;
+    return v_new;
+end;
+$$;
+
+-- Pembelian paket kredit via Telegram Stars
+create table if not exists payments (
+    charge_id  text primary key,               -- telegram_payment_charge_id
+    user_id    bigint not null references users(id),
+    pack_id    text not null,
+    stars      integer not null,
+    credits    integer not null,
+    diamonds   integer not null default 0,
+    plan_id    text not null default '',       -- diisi untuk langganan plan (/plans)
+    plan_expires_at timestamptz,               -- masa aktif plan setelah pembayaran ini
+    status     text not null default 'paid',   -- paid | refunded
+    created_at timestamptz not null default now()
+);
+
+alter table payments add column if not exists diamonds integer not null default 0;
+alter table payments add column if not exists plan_id text not null default '';
+alter table payments add column if not exists plan_expires_at timestamptz;
+
+drop function if exists credit_purchase(text, bigint, text, integer, integer);
+drop function if exists credit_purchase(text, bigint, text, integer, integer, integer);
+drop function if exists refund_purchase(text);
+
+-- Catat pembayaran + tambah paid_credits/diamonds (atau aktifkan plan) dalam satu transaksi.
+-- Mengembalikan saldo kredit total baru, atau NULL jika charge_id sudah pernah dicatat.
+create or replace function credit_purchase(
+    p_charge_id text, p_user_id bigint, p_pack_id text, p_stars integer, p_credits integer,
+    p_diamonds integer default 0, p_plan_id text default '', p_plan_expires_at timestamptz default null)
+returns integer
+language plpgsql
+as $$
+declare
+    v_balance integer;
+    v_diamonds integer;
+begin
+    insert into payments (charge_id, user_id, pack_id, stars, credits, diamonds, plan_id, plan_expires_at)
+    values (p_charge_id, p_user_id, p_pack_id, p_stars, p_credits, p_diamonds, p_plan_id, p_plan_expires_at)
+    on conflict (charge_id) do nothing;
+
+    if not found then
+        return null;
+    end if;
+
+    update users
+       set paid_credits = paid_credits + p_credits,
+           diamonds = diamonds + p_diamonds
+     where id = p_user_id
+    returning credits + paid_credits, diamonds into v_balance, v_diamonds;
+
+    if p_credits > 0 then
+        insert into credit_ledger (user_id, currency, amount, balance_after, kind, reason)
+        values (p_user_id, 'credits', p_credits, v_balance, 'purchase', 'stars:' || p_charge_id);
+    end if;
+    if p_diamonds > 0 then
+        insert into credit_ledger (user_id, currency, amount, balance_after, kind, reason)
+        values (p_user_id, 'diamonds', p_diamonds, v_diamonds, 'purchase', 'stars:' || p_charge_id);
+    end if;
+    if p_plan_id <> '' then
+        update users set plan = p_plan_id, plan_expires_at = p_plan_expires_at where id = p_user_id;
+    end if;
+    return v_balance;
+end;
+$$;
+
+-- Tandai pembayaran refunded dan tarik isi paket (maksimal saldo yang tersisa).
+-- Mengembalikan {"credits", "diamonds"} yang ditarik, atau NULL jika tidak ada / sudah refunded.
+create or replace function refund_purchase(p_charge_id text)
+returns json
+language plpgsql
+as $$
+declare
+    v_user_id bigint;
+    v_credits integer;
+    v_diamonds integer;
+    v_free integer;
+    v_paid integer;
+    v_balance_diamonds integer;
+    v_revoked integer;
+    v_revoked_diamonds integer;
+    v_plan_id text;
+    v_plan_expires timestamptz;
+    v_prev_expires timestamptz;
+begin
+    select user_id, credits, diamonds, plan_id, plan_expires_at
+      into v_user_id, v_credits, v_diamonds, v_plan_id, v_plan_expires
+      from payments
+     where charge_id = p_charge_id
+       and status = 'paid'
+       for update;
+
+    if not found then
+        return null;
+    end if;
+
+    select credits, paid_credits, diamonds into v_free, v_paid, v_balance_diamonds
+      from users
+     where id = v_user_id
+       for update;
+
+    v_revoked := least(v_credits, v_paid);
+    v_revoked_diamonds := least(v_diamonds, v_balance_diamonds);
+    update users
+       set paid_credits = paid_credits - v_revoked,
+           diamonds = diamonds - v_revoked_diamonds
+     where id = v_user_id;
+    update payments set status = 'refunded' where charge_id = p_charge_id;
+    if v_plan_id <> '' and v_plan_expires is not null then
+        -- Hanya masa aktif yang berasal dari pembayaran ini yang dicabut: kembali ke
+        -- pembayaran plan sebelumnya yang masih berlaku, atau ke plan default
+        select max(plan_expires_at) into v_prev_expires
+          from payments
+         where user_id = v_user_id
+           and plan_id = v_plan_id
+           and status = 'paid'
+           and charge_id <> p_charge_id
+           and plan_expires_at > now()
+           and plan_expires_at < v_plan_expires;
+
+        update users
+           set plan = case when v_prev_expires is null then '' else plan end,
+               plan_expires_at = v_prev_expires
+         where id = v_user_id
+           and plan = v_plan_id
+           and plan_expires_at = v_plan_expires;
+    end if;
+
+    if v_revoked > 0 then
+        insert into credit_ledger (user_id, currency, amount, balance_after, kind, reason)
+        values (v_user_id, 'credits', -v_revoked, v_free + v_paid - v_revoked, 'purchase_refund', 'stars:' || p_charge_id);
+    end if;
+    if v_revoked_diamonds > 0 then
+        insert into credit_ledger (user_id, currency, amount, balance_after, kind, reason)
+        values (v_user_id, 'diamonds', -v_revoked_diamonds, v_balance_diamonds - v_revoked_diamonds, 'purchase_refund', 'stars:' || p_charge_id);
+    end if;
+    return json_build_object('credits', v_revoked, 'diamonds', v_revoked_diamonds);
+end;
+$$;
+
+-- Kode promo (/redeem) yang dibuat admin lewat /promo create
+create table if not exists promo_codes (
+    code           text primary key,            -- selalu huruf besar
+    amount         integer not null,
+    currency       text not null default 'credits', -- credits | diamonds
+    max_uses       integer not null default 0,  -- 0 = tanpa batas
+    per_user_limit integer not null default 1,  -- 0 = tanpa batas
+    uses           integer not null default 0,
+    expires_at     timestamptz,                 -- NULL = tidak kedaluwarsa
+    allowed_plans  text not null default '',    -- ID plan dipisah koma, '' = semua plan
+    disabled       boolean not null default false,
+    created_by     bigint not null default 0,
+    created_at     timestamptz not null default now()
+);
+
+create table if not exists promo_redemptions (
+    id         bigserial primary key,
+    code       text not null references promo_codes(code),
+    user_id    bigint not null references users(id),
+    created_at timestamptz not null default now()
+);
+create index if not exists promo_redemptions_code_user_idx on promo_redemptions (code, user_id);
+
+-- Validasi + tukar kode promo dalam satu transaksi. Kredit masuk ke paid_credits
+-- (tidak hilang saat reset). Mengembalikan {"promo": {...}} atau {"error": "promo_..."}.
+create or replace function redeem_promo(p_code text, p_user_id bigint, p_plan text)
+returns json
+language plpgsql
+as $$
+declare
+    v_promo promo_codes;
+    v_used integer;
+    v_balance integer;
+begin
+    select * into v_promo
+      from promo_codes
+     where code = p_code
+       for update;
+
+    if not found or v_promo.disabled then
+        return json_build_object('error', 'promo_not_found');
+    end if;
+    if v_promo.expires_at is not null and v_promo.expires_at <= now() then
+        return json_build_object('error', 'promo_expired');
+    end if;
+    if v_promo.max_uses > 0 and v_promo.uses >= v_promo.max_uses then
+        return json_build_object('error', 'promo_exhausted');
+    end if;
+    if v_promo.allowed_plans <> ''
+       and not (p_plan = any(string_to_array(replace(v_promo.allowed_plans, ' ', ''), ','))) then
+        return json_build_object('error', 'promo_not_allowed');
+    end if;
+    if v_promo.per_user_limit > 0 then
+        select count(*) into v_used
+          from promo_redemptions
+         where code = p_code and user_id = p_user_id;
+        if v_used >= v_promo.per_user_limit then
+            return json_build_object('error', 'promo_already_used');
+        end if;
+    end if;
+
+    insert into promo_redemptions (code, user_id) values (p_code, p_user_id);
+    update promo_codes set uses = uses + 1 where code = p_code returning * into v_promo;
+
+    if v_promo.currency = 'diamonds' then
+        update users set diamonds = diamonds + v_promo.amount
+         where id = p_user_id
+        returning diamonds into v_balance;
+    else
+        update users set paid_credits = paid_credits + v_promo.amount
+         where id = p_user_id
+        returning credits + paid_credits into v_balance;
+    end if;
+
+    insert into credit_ledger (user_id, currency, amount, balance_after, kind, reason)
+    values (p_user_id, v_promo.currency, v_promo.amount, v_balance, 'promo', 'promo:' || p_code);
+
+    return json_build_object('promo', row_to_json(v_promo));
+end;
+$$;
+
+-- Program referral: satu baris per user yang diundang
+create table if not exists referrals (
+    referee_id  bigint primary key references users(id),
+    referrer_id bigint not null references users(id),
+    status      text not null default 'pending',  -- pending | rewarded | capped
+    created_at  timestamptz not null default now(),
+    rewarded_at timestamptz
+);
+create index if not exists referrals_referrer_idx on referrals (referrer_id, status);
+
+-- Tambah saldo yang tidak ikut reset (paid_credits atau diamonds) + catat ledger
+create or replace function grant_balance(
+    p_user_id bigint, p_currency text, p_amount integer, p_kind text, p_reason text)
+returns void
+language plpgsql
+as $$
+declare
+    v_balance integer;
+begin
+    if p_currency = 'diamonds' then
+        update users set diamonds = diamonds + p_amount
+         where id = p_user_id
+        returning diamonds into v_balance;
+    else
+        update users set paid_credits = paid_credits + p_amount
+         where id = p_user_id
+        returning credits + paid_credits into v_balance;
+    end if;
+
+    insert into credit_ledger (user_id, currency, amount, balance_after, kind, reason)
+    values (p_user_id, coalesce(nullif(p_currency, ''), 'credits'), p_amount, v_balance, p_kind, p_reason);
+end;
+$$;
+
+-- Catat undangan. Hanya untuk user baru (belum pernah debit), bukan diri sendiri,
+-- dan pengundang harus sudah terdaftar. Mengembalikan true jika tercatat.
+create or replace function create_referral(p_referrer_id bigint, p_referee_id bigint)
+returns boolean
+language plpgsql
+as $$
+begin
+    if p_referrer_id = p_referee_id
+       or not exists (select 1 from users where id = p_referrer_id)
+       or exists (select 1 from credit_ledger where user_id = p_referee_id and kind = 'debit') then
+        return false;
+    end if;
+
+    insert into referrals (referee_id, referrer_id)
+    values (p_referee_id, p_referrer_id)
+    on conflict (referee_id) do nothing;
+    return found;
+end;
+$$;
+
+-- Selesaikan referral pending setelah generasi pertama yang berhasil. Pengundang
+-- yang sudah mencapai batas (per 24 jam / total) tidak mendapat bonus (status capped).
+-- Mengembalikan baris referral, atau NULL jika tidak ada yang pending.
+create or replace function complete_referral(
+    p_referee_id bigint, p_currency text, p_referrer_bonus integer, p_referee_bonus integer,
+    p_max_per_day integer, p_max_total integer)
+returns json
+language plpgsql
+as $$
+declare
+    v_ref referrals;
+    v_total integer;
+    v_today integer;
+begin
+    select * into v_ref
+      from referrals
+     where referee_id = p_referee_id
+       and status = 'pending'
+       for update;
+
+    if not found then
+        return null;
+    end if;
+
+    perform 1 from users where id = v_ref.referrer_id for update;
+    select count(*), count(*) filter (where rewarded_at >= now() - interval '24 hours')
+      into v_total, v_today
+      from referrals
+     where referrer_id = v_ref.referrer_id
+       and status = 'rewarded';
+
+    update referrals
+       set status = case
+                      when (p_max_total > 0 and v_total >= p_max_total)
+                        or (p_max_per_day > 0 and v_today >= p_max_per_day) then 'capped'
+                      else 'rewarded'
+                    end,
+           rewarded_at = now()
+     where referee_id = p_referee_id
+    returning * into v_ref;
+
+    if p_referee_bonus > 0 then
+        perform grant_balance(p_referee_id, p_currency, p_referee_bonus, 'referral', 'referral:' || v_ref.referrer_id);
+    end if;
+    if v_ref.status = 'rewarded' and p_referrer_bonus > 0 then
+        perform grant_balance(v_ref.referrer_id, p_currency, p_referrer_bonus, 'referral', 'referral:' || p_referee_id);
+    end if;
+    return row_to_json(v_ref);
+end;
+$$;
+
+-- Riwayat generasi (/history). id sama dengan generation_id di credit_ledger.
+create table if not exists generations (
+    id            text primary key,
+    user_id       bigint not null references users(id),
+    chat_id       bigint not null default 0,         -- tujuan hasil yang dikirim lewat webhook Replicate
+    model_id      text not null,
+    prompt        text not null,
+    settings      jsonb not null default '{}',   -- draft_config user saat generasi dimulai
+    input         jsonb not null default '{}',   -- payload final yang dikirim ke model
+    cost          integer not null,
+    currency      text not null default 'credits',
+    paid_cost     integer not null default 0,    -- bagian cost dari paid_credits, untuk refund
+    status        text not null,                 -- running | succeeded | failed | canceled
+    outputs       jsonb not null default '[]',
+    prediction_id text not null default '',
+    duration_ms   bigint not null default 0,
+    error         text not null default '',
+    created_at    timestamptz not null default now(),
+    completed_at  timestamptz
+);
+create index if not exists generations_user_idx on generations (user_id, created_at desc);
+-- Generasi yang masih berjalan, dicocokkan dengan Replicate saat startup
+create index if not exists generations_running_idx on generations (created_at) where status = 'running';
+alter table generations add column if not exists chat_id bigint not null default 0;
+alter table generations add column if not exists paid_cost integer not null default 0;
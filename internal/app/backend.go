@@ -0,0 +1,382 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Nama backend di field "backend" models.json; kosong = replicate
+const (
+	BackendReplicate = "replicate"
+	BackendOpenAI    = "openai"
+	BackendComfyUI   = "comfyui"
+	BackendA1111     = "a1111"
+)
+
+// Status prediction, mengikuti istilah Replicate
+const (
+	PredictionStarting   = "starting"
+	PredictionProcessing = "processing"
+	PredictionSucceeded  = "succeeded"
+	PredictionFailed     = "failed"
+	PredictionCanceled   = "canceled"
+)
+
+// Polling dimulai dari modelConf.pollInterval() lalu diperlambat sampai maxPollInterval.
+// Generasi dihentikan setelah maxPollFailures kegagalan polling berturut-turut.
+const (
+	maxPollInterval = 15 * time.Second
+	pollBackoff     = 1.5
+	maxPollFailures = 5
+)
+
+// pollWait menunggu jeda polling; diganti di test agar backoff bisa diperiksa tanpa menunggu
+var pollWait = time.After
+
+// ImageBackend adalah penyedia generasi gambar/video. Backend sinkron cukup
+// mengembalikan prediction yang sudah selesai dari Submit.
+type ImageBackend interface {
+	// Submit mengirim input ke model dan mengembalikan prediction (selesai atau masih berjalan)
+	Submit(ctx context.Context, modelConf ModelConfig, input map[string]interface{}) (*Prediction, error)
+	// Poll memperbarui Status, Output dan Error prediction yang masih berjalan
+	Poll(ctx context.Context, pred *Prediction) error
+	// Cancel menghentikan prediction yang masih berjalan
+	Cancel(ctx context.Context, pred *Prediction) error
+	// ParseOutput mengubah output mentah backend menjadi daftar URL (atau data URI)
+	ParseOutput(raw interface{}) []string
+}
+
+var (
+	_ ImageBackend = (*ReplicateConfig)(nil)
+	_ ImageBackend = (*OpenAIBackend)(nil)
+	_ ImageBackend = (*A1111Backend)(nil)
+	_ ImageBackend = (*ComfyUIBackend)(nil)
+)
+
+// Prediction adalah hasil satu panggilan model: ID prediction di backend,
+// payload final yang dikirim dan URL output
+type Prediction struct {
+	ID        string
+	Input     map[string]interface{}
+	Output    []string
+	Status    string
+	Error     string
+	Logs      string
+	PollURL   string // dipakai backend yang memberi URL polling/cancel sendiri (Replicate)
+	CancelURL string
+}
+
+// Done bernilai true jika prediction sudah berhenti (berhasil, gagal atau dibatalkan)
+func (p *Prediction) Done() bool {
+	return p.Status == PredictionSucceeded || p.Status == PredictionFailed || p.Status == PredictionCanceled
+}
+
+// Err mengembalikan *PredictionError jika prediction selesai tanpa berhasil
+func (p *Prediction) Err() error {
+	if !p.Done() || p.Status == PredictionSucceeded {
+		return nil
+	}
+	return &PredictionError{ID: p.ID, Status: p.Status, Message: p.Error, Logs: p.Logs}
+}
+
+// PredictionError adalah prediction yang gagal atau dibatalkan di backend,
+// lengkap dengan pesan error dan log dari backend (Replicate)
+type PredictionError struct {
+	ID      string
+	Status  string
+	Message string
+	Logs    string
+}
+
+func (e *PredictionError) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = "no error message"
+	}
+	if e.ID == "" {
+		return fmt.Sprintf("prediction %s: %s", e.Status, msg)
+	}
+	return fmt.Sprintf("prediction %s %s: %s", e.ID, e.Status, msg)
+}
+
+// LogTail mengembalikan n byte terakhir log untuk dicatat
+func (e *PredictionError) LogTail(n int) string {
+	logs := strings.TrimSpace(e.Logs)
+	if len(logs) > n {
+		logs = "..." + logs[len(logs)-n:]
+	}
+	return logs
+}
+
+// logPredictionLogs mencatat potongan akhir log backend jika err adalah *PredictionError
+func logPredictionLogs(err error) {
+	var perr *PredictionError
+	if errors.As(err, &perr) && perr.Logs != "" {
+		fmt.Printf("[ERROR] Prediction %s logs:\n%s\n", perr.ID, perr.LogTail(2000))
+	}
+}
+
+// backendFor mengembalikan backend model (field "backend", default replicate)
+func (b *BotApp) backendFor(modelConf ModelConfig) (ImageBackend, error) {
+	name := modelConf.BackendName()
+	backend, ok := b.Backends[name]
+	if !ok {
+		return nil, fmt.Errorf("backend %s not configured", name)
+	}
+	return backend, nil
+}
+
+// BackendName mengembalikan nama backend model, default replicate
+func (m ModelConfig) BackendName() string {
+	if m.Backend == "" {
+		return BackendReplicate
+	}
+	return m.Backend
+}
+
+// Generate menjalankan model di backend-nya dan menunggu hasilnya. Prediction tetap
+// dikembalikan bersama error setelah payload terbentuk, agar kegagalan tetap bisa
+// dicatat. Generasi dihentikan (dan dibatalkan di backend) setelah
+// modelConf.GenerationTimeout() atau saat ctx dibatalkan.
+func (b *BotApp) Generate(ctx context.Context, modelConf ModelConfig, prompt string, extraInputs map[string]interface{}) (*Prediction, error) {
+	backend, err := b.backendFor(modelConf)
+	if err != nil {
+		return nil, err
+	}
+	timeout := modelConf.GenerationTimeout()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	input, err := buildInput(modelConf, prompt, extraInputs)
+	if err != nil {
+		return nil, err
+	}
+
+	if b.Debug {
+		debugJSON, _ := json.Marshal(truncateForLog(input))
+		fmt.Printf("[DEBUG] Payload to %s: %s\n", modelConf.BackendName(), debugJSON)
+	}
+
+	pred, err := submitDetached(ctx, backend, modelConf, input)
+	if pred == nil {
+		pred = &Prediction{}
+	}
+	pred.Input = input
+
+	delay := modelConf.pollInterval()
+	failures := 0
+	for err == nil && !pred.Done() {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			continue
+		case <-pollWait(delay):
+		}
+		delay = nextPollDelay(delay)
+
+		if perr := backend.Poll(ctx, pred); perr != nil {
+			if ctx.Err() != nil {
+				err = ctx.Err()
+				continue
+			}
+			failures++
+			fmt.Printf("[WARN] Polling %s failed (%d/%d): %v\n", pred.ID, failures, maxPollFailures, perr)
+			if failures >= maxPollFailures {
+				err = fmt.Errorf("polling failed: %v", perr)
+			}
+			continue
+		}
+		failures = 0
+		fmt.Printf("[INFO] Polling %s: %s\n", pred.ID, pred.Status)
+	}
+	if err == nil {
+		err = pred.Err()
+	}
+
+	// Jangan biarkan prediction tetap berjalan (dan ditagih) setelah kita berhenti menunggu
+	if err != nil && pred.ID != "" && !pred.Done() {
+		cancelCtx, stop := context.WithTimeout(context.Background(), 10*time.Second)
+		if cerr := backend.Cancel(cancelCtx, pred); cerr != nil {
+			fmt.Printf("[ERROR] Cancel prediction %s: %v\n", pred.ID, cerr)
+		} else {
+			fmt.Printf("[INFO] Canceled prediction %s\n", pred.ID)
+		}
+		stop()
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("generation timed out after %s", timeout)
+	}
+	return pred, err
+}
+
+// submitDetached menjalankan backend.Submit yang hanya diputus oleh deadline ctx, bukan
+// oleh pembatalan: request yang diputus di tengah jalan bisa tetap membuat prediction
+// tanpa ID-nya sempat diterima. Jika ctx dibatalkan (tombol cancel, shutdown) sebelum
+// Submit selesai, Generate langsung berhenti dan prediction yang akhirnya terbentuk
+// dibatalkan di background.
+func submitDetached(ctx context.Context, backend ImageBackend, modelConf ModelConfig, input map[string]interface{}) (*Prediction, error) {
+	submitCtx := context.WithoutCancel(ctx)
+	stop := func() {}
+	if deadline, ok := ctx.Deadline(); ok {
+		submitCtx, stop = context.WithDeadline(submitCtx, deadline)
+	}
+
+	type result struct {
+		pred *Prediction
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer stop()
+		pred, err := backend.Submit(submitCtx, modelConf, input)
+		done <- result{pred, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.pred, r.err
+	case <-ctx.Done():
+	}
+	go func() {
+		r := <-done
+		if r.err != nil || r.pred == nil || r.pred.ID == "" || r.pred.Done() {
+			return
+		}
+		cancelCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := backend.Cancel(cancelCtx, r.pred); err != nil {
+			fmt.Printf("[ERROR] Cancel prediction %s: %v\n", r.pred.ID, err)
+		} else {
+			fmt.Printf("[INFO] Canceled prediction %s after submit\n", r.pred.ID)
+		}
+	}()
+	return nil, ctx.Err()
+}
+
+// nextPollDelay memperpanjang jeda polling secara eksponensial sampai maxPollInterval
+func nextPollDelay(delay time.Duration) time.Duration {
+	delay = time.Duration(float64(delay) * pollBackoff)
+	if delay > maxPollInterval {
+		return maxPollInterval
+	}
+	return delay
+}
+
+// buildInput menyusun payload model: default parameter, input user (dengan
+// konversi tipe sesuai definisi parameter) lalu prompt
+func buildInput(modelConf ModelConfig, userInput string, extraInputs map[string]interface{}) (map[string]interface{}, error) {
+	payloadData := make(map[string]interface{})
+
+	// 1. Masukkan Default Parameters
+	for _, param := range modelConf.Parameters {
+		if param.Default != nil {
+			payloadData[param.Name] = param.Default
+		}
+	}
+
+	// 2. Masukkan Input User
+	for k, v := range extraInputs {
+		// KASUS A: Input adalah Array (Multiple Images)
+		if list, ok := v.([]interface{}); ok {
+			var rawURLs []string
+			for _, item := range list {
+				if str, ok := item.(string); ok {
+					// Validasi sederhana: harus URL http atau data URI
+					if isFileURL(str) {
+						rawURLs = append(rawURLs, str)
+					}
+				}
+			}
+			// LANGSUNG masukkan sebagai Array of Strings.
+			// Tidak perlu dibungkus object {"value":...} lagi.
+			payloadData[k] = rawURLs
+			continue
+		}
+
+		// KASUS B: Input adalah String Tunggal
+		if strVal, isString := v.(string); isString {
+			// Validasi URL untuk gambar
+			isImageParam := (k == "image_input" || k == "input_images" || k == "reference_images" || k == "image")
+			if isImageParam && !isFileURL(strVal) {
+				return nil, fmt.Errorf("invalid image URL: %s", strVal)
+			}
+
+			// JIKA parameter ini biasanya butuh Array (seperti image_input), kita bungkus string tunggal jadi Array.
+			if k == "image_input" || k == "input_images" || k == "reference_images" {
+				payloadData[k] = []string{strVal}
+				continue
+			}
+
+			// Type Casting untuk Angka
+			var expectedType string
+			for _, p := range modelConf.Parameters {
+				if p.Name == k {
+					expectedType = p.Type
+					break
+				}
+			}
+
+			if expectedType == "integer" {
+				if intVal, err := strconv.Atoi(strVal); err == nil {
+					payloadData[k] = intVal
+				} else {
+					payloadData[k] = v
+				}
+			} else if expectedType == "number" || expectedType == "float" {
+				if floatVal, err := strconv.ParseFloat(strVal, 64); err == nil {
+					payloadData[k] = floatVal
+				} else {
+					payloadData[k] = v
+				}
+			} else {
+				// String biasa (misal aspect_ratio)
+				payloadData[k] = v
+			}
+		} else {
+			// Boolean atau tipe lain
+			payloadData[k] = v
+		}
+	}
+
+	// 3. Set Prompt
+	payloadData["prompt"] = userInput
+	return payloadData, nil
+}
+
+// Panjang maksimal string di log debug; prompt panjang dan data URI gambar dipotong
+const maxDebugValueLen = 120
+
+// truncateForLog menyalin payload dengan string panjang dipotong agar aman dicatat
+func truncateForLog(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		if len(v) > maxDebugValueLen {
+			return fmt.Sprintf("%s...(%d bytes)", v[:maxDebugValueLen], len(v))
+		}
+		return v
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			out[k] = truncateForLog(item)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = truncateForLog(item)
+		}
+		return out
+	case []string:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = truncateForLog(item)
+		}
+		return out
+	}
+	return value
+}
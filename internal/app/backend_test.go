@@ -0,0 +1,199 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBackend menjalankan skrip hasil Poll: error != nil = polling gagal,
+// selain itu status prediction diganti dengan status di skrip
+type fakeBackend struct {
+	mu       sync.Mutex
+	script   []fakePoll
+	polls    int
+	canceled []string
+}
+
+type fakePoll struct {
+	status string
+	err    error
+}
+
+func (f *fakeBackend) Submit(ctx context.Context, modelConf ModelConfig, input map[string]interface{}) (*Prediction, error) {
+	return &Prediction{ID: "pred-1", Status: PredictionStarting}, nil
+}
+
+func (f *fakeBackend) Poll(ctx context.Context, pred *Prediction) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.polls >= len(f.script) {
+		return errors.New("script exhausted")
+	}
+	step := f.script[f.polls]
+	f.polls++
+	if step.err != nil {
+		return step.err
+	}
+	pred.Status = step.status
+	if step.status == PredictionSucceeded {
+		pred.Output = []string{"https://example.com/out.png"}
+	}
+	if step.status == PredictionFailed {
+		pred.Error = "model crashed"
+	}
+	return nil
+}
+
+func (f *fakeBackend) Cancel(ctx context.Context, pred *Prediction) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.canceled = append(f.canceled, pred.ID)
+	return nil
+}
+
+func (f *fakeBackend) ParseOutput(raw interface{}) []string { return nil }
+
+// recordPollWait mengganti pollWait dengan jeda instan dan mencatat jeda yang diminta
+func recordPollWait(t *testing.T) *[]time.Duration {
+	t.Helper()
+	var delays []time.Duration
+	prev := pollWait
+	pollWait = func(d time.Duration) <-chan time.Time {
+		delays = append(delays, d)
+		ch := make(chan time.Time, 1)
+		ch <- time.Now()
+		return ch
+	}
+	t.Cleanup(func() { pollWait = prev })
+	return &delays
+}
+
+func fakeBot(backend ImageBackend) (*BotApp, ModelConfig) {
+	b := &BotApp{Backends: map[string]ImageBackend{"fake": backend}}
+	return b, ModelConfig{ID: "fake-model", Type: "image", Backend: "fake"}
+}
+
+func repeatPoll(p fakePoll, n int) []fakePoll {
+	var list []fakePoll
+	for i := 0; i < n; i++ {
+		list = append(list, p)
+	}
+	return list
+}
+
+func TestNextPollDelay(t *testing.T) {
+	want := []time.Duration{3 * time.Second, 4500 * time.Millisecond, 6750 * time.Millisecond, 10125 * time.Millisecond, maxPollInterval, maxPollInterval}
+	delay := 2 * time.Second
+	for i, w := range want {
+		delay = nextPollDelay(delay)
+		if delay != w {
+			t.Fatalf("step %d: delay = %s, want %s", i+1, delay, w)
+		}
+	}
+}
+
+func TestGenerateBacksOffBetweenPolls(t *testing.T) {
+	delays := recordPollWait(t)
+	backend := &fakeBackend{script: append(repeatPoll(fakePoll{status: PredictionProcessing}, 6), fakePoll{status: PredictionSucceeded})}
+	b, model := fakeBot(backend)
+
+	pred, err := b.Generate(context.Background(), model, "a cat", nil)
+	if err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if pred.Status != PredictionSucceeded || len(pred.Output) != 1 {
+		t.Errorf("prediction = %+v", pred)
+	}
+
+	want := []time.Duration{2 * time.Second, 3 * time.Second, 4500 * time.Millisecond, 6750 * time.Millisecond, 10125 * time.Millisecond, maxPollInterval, maxPollInterval}
+	if len(*delays) != len(want) {
+		t.Fatalf("waited %d times, want %d: %v", len(*delays), len(want), *delays)
+	}
+	for i, d := range *delays {
+		if d != want[i] {
+			t.Errorf("wait %d = %s, want %s", i+1, d, want[i])
+		}
+	}
+	if len(backend.canceled) != 0 {
+		t.Errorf("succeeded prediction was canceled")
+	}
+}
+
+func TestGenerateStopsAfterMaxPollFailures(t *testing.T) {
+	recordPollWait(t)
+	backend := &fakeBackend{script: repeatPoll(fakePoll{err: errors.New("502 bad gateway")}, maxPollFailures+3)}
+	b, model := fakeBot(backend)
+
+	_, err := b.Generate(context.Background(), model, "a cat", nil)
+	if err == nil || !strings.Contains(err.Error(), "polling failed") {
+		t.Fatalf("err = %v, want polling failed", err)
+	}
+	if backend.polls != maxPollFailures {
+		t.Errorf("polled %d times, want %d", backend.polls, maxPollFailures)
+	}
+	if len(backend.canceled) != 1 {
+		t.Errorf("prediction canceled %d times, want 1", len(backend.canceled))
+	}
+}
+
+func TestGeneratePollFailuresResetOnSuccess(t *testing.T) {
+	recordPollWait(t)
+	fail := fakePoll{err: errors.New("timeout")}
+	var script []fakePoll
+	script = append(script, repeatPoll(fail, maxPollFailures-1)...)
+	script = append(script, fakePoll{status: PredictionProcessing})
+	script = append(script, repeatPoll(fail, maxPollFailures-1)...)
+	script = append(script, fakePoll{status: PredictionSucceeded})
+	backend := &fakeBackend{script: script}
+	b, model := fakeBot(backend)
+
+	if _, err := b.Generate(context.Background(), model, "a cat", nil); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	if backend.polls != len(script) {
+		t.Errorf("polled %d times, want %d", backend.polls, len(script))
+	}
+}
+
+func TestGenerateReturnsPredictionError(t *testing.T) {
+	recordPollWait(t)
+	backend := &fakeBackend{script: []fakePoll{{status: PredictionProcessing}, {status: PredictionFailed}}}
+	b, model := fakeBot(backend)
+
+	pred, err := b.Generate(context.Background(), model, "a cat", nil)
+	var perr *PredictionError
+	if !errors.As(err, &perr) || perr.Status != PredictionFailed || perr.Message != "model crashed" {
+		t.Fatalf("err = %v, want PredictionError failed", err)
+	}
+	if pred == nil || pred.Input["prompt"] != "a cat" {
+		t.Errorf("prediction input not kept: %+v", pred)
+	}
+	if len(backend.canceled) != 0 {
+		t.Errorf("finished prediction was canceled")
+	}
+}
+
+func TestGenerateCancelsOnContextCancel(t *testing.T) {
+	backend := &fakeBackend{script: repeatPoll(fakePoll{status: PredictionProcessing}, 100)}
+	b, model := fakeBot(backend)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	prev := pollWait
+	pollWait = func(d time.Duration) <-chan time.Time {
+		cancel() // tombol cancel ditekan saat menunggu polling pertama
+		return make(chan time.Time)
+	}
+	t.Cleanup(func() { pollWait = prev })
+
+	_, err := b.Generate(ctx, model, "a cat", nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err = %v, want context.Canceled", err)
+	}
+	if len(backend.canceled) != 1 {
+		t.Errorf("prediction canceled %d times, want 1", len(backend.canceled))
+	}
+}
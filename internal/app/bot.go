@@ -2,10 +2,15 @@ package app
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type PhotoSize struct {
@@ -21,9 +26,10 @@ type TelegramUpdate struct {
 			ID       int64  `json:"id"`
 			Username string `json:"username"`
 		} `json:"from"`
-		Text  string      `json:"text"`
-		Photo []PhotoSize `json:"photo"`
-		Chat  struct {
+		Text              string             `json:"text"`
+		Photo             []PhotoSize        `json:"photo"`
+		SuccessfulPayment *SuccessfulPayment `json:"successful_payment"`
+		Chat              struct {
 			ID int64 `json:"id"`
 		} `json:"chat"`
 	} `json:"message"`
@@ -40,30 +46,256 @@ type TelegramUpdate struct {
 			} `json:"chat"`
 		} `json:"message"`
 	} `json:"callback_query"`
+	PreCheckoutQuery struct {
+		ID   string `json:"id"`
+		From struct {
+			ID int64 `json:"id"`
+		} `json:"from"`
+		Currency       string `json:"currency"`
+		TotalAmount    int    `json:"total_amount"`
+		InvoicePayload string `json:"invoice_payload"`
+	} `json:"pre_checkout_query"`
 }
 
-type TelegramResponse struct {
-	Ok     bool             `json:"ok"`
-	Result []TelegramUpdate `json:"result"`
+type SuccessfulPayment struct {
+	Currency                string `json:"currency"`
+	TotalAmount             int    `json:"total_amount"`
+	InvoicePayload          string `json:"invoice_payload"`
+	TelegramPaymentChargeID string `json:"telegram_payment_charge_id"`
+	ProviderPaymentChargeID string `json:"provider_payment_charge_id"`
+}
+
+// SenderID mengembalikan ID user pengirim update (fallback ke chat ID),
+// dipakai dispatcher untuk mengurutkan update per user.
+func (u TelegramUpdate) SenderID() int64 {
+	if u.PreCheckoutQuery.ID != "" {
+		return u.PreCheckoutQuery.From.ID
+	}
+	if u.CallbackQuery.ID != "" {
+		if u.CallbackQuery.From.ID != 0 {
+			return u.CallbackQuery.From.ID
+		}
+		return u.CallbackQuery.Message.Chat.ID
+	}
+	if u.Message.From.ID != 0 {
+		return u.Message.From.ID
+	}
+	return u.Message.Chat.ID
 }
 
-type InputMediaPhoto struct {
+// InputMedia adalah satu item sendMediaGroup (type photo atau video)
+type InputMedia struct {
 	Type      string `json:"type"`
 	Media     string `json:"media"`
 	Caption   string `json:"caption,omitempty"`
 	ParseMode string `json:"parse_mode,omitempty"`
 }
 
-// Helper untuk log error dari Telegram API
-func checkAPIError(resp *http.Response) error {
-	if resp.StatusCode != 200 {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("telegram api error %d: %s", resp.StatusCode, string(body))
+const DefaultTelegramAPIURL = "https://api.telegram.org"
+
+// TelegramAPI adalah method Bot API yang dipakai BotApp. Implementasinya
+// TelegramClient; test bisa memakai implementasi palsu.
+type TelegramAPI interface {
+	GetUpdates(ctx context.Context, offset int, timeout int) ([]TelegramUpdate, error)
+	SendMessage(chatID int64, text string, buttons []map[string]string) error
+	SendMessageID(chatID int64, text string, buttons []map[string]string) (int, error)
+	EditMessageText(chatID int64, messageID int, text string, buttons []map[string]string) error
+	SendPhoto(chatID int64, photoURL string, caption string, buttons []map[string]string) error
+	SendVideo(chatID int64, videoURL string, caption string, buttons []map[string]string) error
+	SendAnimation(chatID int64, animationURL string, caption string, buttons []map[string]string) error
+	SendDocument(chatID int64, documentURL string, caption string, buttons []map[string]string) error
+	SendPhotoFile(chatID int64, filename string, data []byte, caption string, buttons []map[string]string) error
+	SendDocumentFile(chatID int64, filename string, data []byte, caption string, buttons []map[string]string) error
+	UploadFile(chatID int64, method, field, filename string, data []byte, caption string, buttons []map[string]string) error
+	SendMediaGroup(chatID int64, media []InputMedia, caption string) error
+	SendChatAction(chatID int64, action string) error
+	AnswerCallback(callbackID string) error
+	AnswerCallbackText(callbackID, text string) error
+	SendInvoice(chatID int64, title, description, payload string, stars int) error
+	AnswerPreCheckoutQuery(queryID string, ok bool, errorMessage string) error
+	RefundStarPayment(userID int64, chargeID string) error
+	GetFilePath(fileID string) (string, error)
+	DownloadFile(filePath string) ([]byte, error)
+	GetMe() (string, error)
+	SetWebhook(webhookURL string, secret string) error
+	DeleteWebhook() error
+}
+
+var _ TelegramAPI = (*TelegramClient)(nil)
+
+// TelegramClient membungkus Bot API. BaseURL bisa diarahkan ke Local Bot API Server
+// atau server palsu untuk testing, dan Transport bisa diganti lewat HTTP client.
+type TelegramClient struct {
+	Token      string
+	BaseURL    string
+	HTTP       *http.Client
+	Limiter    *SendLimiter // antrean kirim global & per chat, nil = tanpa batas
+	MaxRetries int          // jumlah retry saat kena 429
+
+	// ctx membatalkan kiriman yang masih mengantre saat Close dipanggil
+	ctx   context.Context
+	close context.CancelFunc
+}
+
+func NewTelegramClient(token, baseURL string, timeout time.Duration, transport http.RoundTripper) *TelegramClient {
+	if baseURL == "" {
+		baseURL = DefaultTelegramAPIURL
+	}
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &TelegramClient{
+		Token:      token,
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTP:       &http.Client{Timeout: timeout, Transport: transport},
+		Limiter:    NewSendLimiter(DefaultGlobalPerSecond, DefaultChatInterval, DefaultGroupPerMinute),
+		MaxRetries: 3,
+		ctx:        ctx,
+		close:      cancel,
+	}
+}
+
+// Close membatalkan semua request yang sedang mengantre di rate limiter atau
+// menunggu retry_after, agar shutdown tidak tertahan antrean kirim
+func (c *TelegramClient) Close() {
+	if c.close != nil {
+		c.close()
+	}
+}
+
+func (c *TelegramClient) baseContext() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+func (c *TelegramClient) endpoint(method string) string {
+	return fmt.Sprintf("%s/bot%s/%s", c.BaseURL, c.Token, method)
+}
+
+// FileURL mengembalikan URL download untuk file_path dari getFile
+func (c *TelegramClient) FileURL(filePath string) string {
+	return fmt.Sprintf("%s/file/bot%s/%s", c.BaseURL, c.Token, filePath)
+}
+
+// TelegramAPIError membawa error_code, description dan retry_after dari Bot API
+type TelegramAPIError struct {
+	Code        int
+	Description string
+	RetryAfter  int
+}
+
+func (e *TelegramAPIError) Error() string {
+	return fmt.Sprintf("telegram api error %d: %s", e.Code, e.Description)
+}
+
+type telegramAPIResponse struct {
+	Ok          bool            `json:"ok"`
+	Result      json.RawMessage `json:"result"`
+	ErrorCode   int             `json:"error_code"`
+	Description string          `json:"description"`
+	Parameters  struct {
+		RetryAfter int `json:"retry_after"`
+	} `json:"parameters"`
+}
+
+// call mengirim payload JSON ke method Bot API dan men-decode field "result" ke out (opsional).
+// Method yang terkait satu chat memakai send agar ikut antrean chat tersebut.
+func (c *TelegramClient) call(method string, payload interface{}, out interface{}) error {
+	return c.callWith(c.baseContext(), c.HTTP, 0, method, payload, out)
+}
+
+// send sama seperti call, tapi juga melewati antrean rate limit untuk chatID
+func (c *TelegramClient) send(chatID int64, method string, payload interface{}, out interface{}) error {
+	return c.callWith(c.baseContext(), c.HTTP, chatID, method, payload, out)
+}
+
+// callWith mengulang request otomatis saat Telegram membalas 429 (flood control)
+func (c *TelegramClient) callWith(ctx context.Context, client *http.Client, chatID int64, method string, payload interface{}, out interface{}) error {
+	jsonData, _ := json.Marshal(payload)
+	return c.retry(ctx, client, chatID, method, "application/json", jsonData, out)
+}
+
+func (c *TelegramClient) retry(ctx context.Context, client *http.Client, chatID int64, method, contentType string, body []byte, out interface{}) error {
+	for attempt := 0; ; attempt++ {
+		// chatID 0 (answerCallbackQuery, getFile, dll) tetap memakai budget global
+		if c.Limiter != nil {
+			if err := c.Limiter.Wait(ctx, chatID); err != nil {
+				return err
+			}
+		}
+
+		err := c.post(ctx, client, method, contentType, body, out)
+		apiErr, ok := err.(*TelegramAPIError)
+		if !ok || apiErr.Code != http.StatusTooManyRequests || attempt >= c.MaxRetries {
+			return err
+		}
+
+		retryAfter := time.Duration(apiErr.RetryAfter) * time.Second
+		if retryAfter <= 0 {
+			retryAfter = time.Second
+		}
+		fmt.Printf("[WARN] Telegram flood control on %s (chat %d), retry after %v\n", method, chatID, retryAfter)
+		if c.Limiter != nil {
+			c.Limiter.Penalize(chatID, retryAfter)
+		}
+		if chatID == 0 || c.Limiter == nil {
+			if err := sleepCtx(ctx, retryAfter); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *TelegramClient) post(ctx context.Context, client *http.Client, method, contentType string, reqBody []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", c.endpoint(method), bytes.NewBuffer(reqBody))
+	if err != nil { return err }
+	req.Header.Set("Content-Type", contentType)
+	resp, err := client.Do(req)
+	if err != nil { return err }
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil { return err }
+
+	var apiResp telegramAPIResponse
+	if err := json.Unmarshal(body, &apiResp); err != nil {
+		if resp.StatusCode != 200 {
+			return &TelegramAPIError{Code: resp.StatusCode, Description: string(body)}
+		}
+		return err
 	}
-	return nil
+	if resp.StatusCode != 200 || !apiResp.Ok {
+		code := apiResp.ErrorCode
+		if code == 0 { code = resp.StatusCode }
+		return &TelegramAPIError{Code: code, Description: apiResp.Description, RetryAfter: apiResp.Parameters.RetryAfter}
+	}
+
+	if out == nil { return nil }
+	return json.Unmarshal(apiResp.Result, out)
 }
 
-func SendMessage(token string, chatID int64, text string, buttons []map[string]string) error {
+// GetUpdates melakukan long polling. Timeout HTTP disesuaikan dengan timeout polling.
+// Memanggil dengan offset tertentu juga mengonfirmasi semua update sebelumnya ke Telegram.
+func (c *TelegramClient) GetUpdates(ctx context.Context, offset int, timeout int) ([]TelegramUpdate, error) {
+	pollClient := *c.HTTP
+	pollClient.Timeout = time.Duration(timeout)*time.Second + c.HTTP.Timeout
+
+	var updates []TelegramUpdate
+	reqData := map[string]interface{}{"offset": offset, "timeout": timeout}
+	err := c.callWith(ctx, &pollClient, 0, "getUpdates", reqData, &updates)
+	return updates, err
+}
+
+func (c *TelegramClient) SendMessage(chatID int64, text string, buttons []map[string]string) error {
+	_, err := c.SendMessageID(chatID, text, buttons)
+	return err
+}
+
+// SendMessageID sama seperti SendMessage, tapi mengembalikan message_id agar pesan bisa diedit nanti
+func (c *TelegramClient) SendMessageID(chatID int64, text string, buttons []map[string]string) (int, error) {
 	msg := map[string]interface{}{
 		"chat_id":    chatID,
 		"text":       text,
@@ -72,14 +304,14 @@ func SendMessage(token string, chatID int64, text string, buttons []map[string]s
 	if len(buttons) > 0 {
 		msg["reply_markup"] = buildKeyboard(buttons)
 	}
-	jsonData, _ := json.Marshal(msg)
-	resp, err := http.Post(fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", token), "application/json", bytes.NewBuffer(jsonData))
-	if err != nil { return err }
-	defer resp.Body.Close()
-	return checkAPIError(resp)
+	var sent struct {
+		MessageID int `json:"message_id"`
+	}
+	err := c.send(chatID, "sendMessage", msg, &sent)
+	return sent.MessageID, err
 }
 
-func EditMessageText(token string, chatID int64, messageID int, text string, buttons []map[string]string) error {
+func (c *TelegramClient) EditMessageText(chatID int64, messageID int, text string, buttons []map[string]string) error {
 	msg := map[string]interface{}{
 		"chat_id":    chatID,
 		"message_id": messageID,
@@ -89,52 +321,172 @@ func EditMessageText(token string, chatID int64, messageID int, text string, but
 	if len(buttons) > 0 {
 		msg["reply_markup"] = buildKeyboard(buttons)
 	}
-	jsonData, _ := json.Marshal(msg)
-	resp, err := http.Post(fmt.Sprintf("https://api.telegram.org/bot%s/editMessageText", token), "application/json", bytes.NewBuffer(jsonData))
-	if err != nil { return err }
-	defer resp.Body.Close()
-	return checkAPIError(resp)
+	return c.send(chatID, "editMessageText", msg, nil)
+}
+
+func (c *TelegramClient) SendPhoto(chatID int64, photoURL string, caption string, buttons []map[string]string) error {
+	return c.sendFile(chatID, "sendPhoto", "photo", photoURL, caption, buttons)
+}
+
+// SendVideo mengirim video MP4 dari URL
+func (c *TelegramClient) SendVideo(chatID int64, videoURL string, caption string, buttons []map[string]string) error {
+	return c.sendFile(chatID, "sendVideo", "video", videoURL, caption, buttons)
+}
+
+// SendAnimation mengirim GIF atau video tanpa suara dari URL
+func (c *TelegramClient) SendAnimation(chatID int64, animationURL string, caption string, buttons []map[string]string) error {
+	return c.sendFile(chatID, "sendAnimation", "animation", animationURL, caption, buttons)
+}
+
+// SendDocument mengirim file apa adanya (mis. SVG) dari URL
+func (c *TelegramClient) SendDocument(chatID int64, documentURL string, caption string, buttons []map[string]string) error {
+	return c.sendFile(chatID, "sendDocument", "document", documentURL, caption, buttons)
 }
 
-func SendPhoto(token string, chatID int64, photoURL string, caption string) error {
+func (c *TelegramClient) sendFile(chatID int64, method, field, fileURL, caption string, buttons []map[string]string) error {
 	msg := map[string]interface{}{
 		"chat_id":    chatID,
-		"photo":      photoURL,
+		field:        fileURL,
 		"caption":    caption,
 		"parse_mode": "HTML",
 	}
-	jsonData, _ := json.Marshal(msg)
-	resp, err := http.Post(fmt.Sprintf("https://api.telegram.org/bot%s/sendPhoto", token), "application/json", bytes.NewBuffer(jsonData))
-	if err != nil { return err }
-	defer resp.Body.Close()
-	return checkAPIError(resp)
+	if len(buttons) > 0 {
+		msg["reply_markup"] = buildKeyboard(buttons)
+	}
+	return c.send(chatID, method, msg, nil)
 }
 
-func SendMediaGroup(token string, chatID int64, photos []string, caption string) error {
-	var mediaGroup []InputMediaPhoto
-	for i, url := range photos {
-		item := InputMediaPhoto{Type: "photo", Media: url}
-		if i == 0 {
-			item.Caption = caption
-			item.ParseMode = "HTML"
-		}
-		mediaGroup = append(mediaGroup, item)
+// SendPhotoFile mengunggah gambar dari memori (mis. preview PNG hasil render)
+func (c *TelegramClient) SendPhotoFile(chatID int64, filename string, data []byte, caption string, buttons []map[string]string) error {
+	return c.UploadFile(chatID, "sendPhoto", "photo", filename, data, caption, buttons)
+}
+
+// SendDocumentFile mengunggah file dari memori sebagai dokumen
+func (c *TelegramClient) SendDocumentFile(chatID int64, filename string, data []byte, caption string, buttons []map[string]string) error {
+	return c.UploadFile(chatID, "sendDocument", "document", filename, data, caption, buttons)
+}
+
+// UploadFile mengirim file lewat multipart/form-data dengan method sendPhoto/sendVideo/dll,
+// untuk file yang tidak punya URL publik
+func (c *TelegramClient) UploadFile(chatID int64, method, field, filename string, data []byte, caption string, buttons []map[string]string) error {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	writer.WriteField("chat_id", strconv.FormatInt(chatID, 10))
+	writer.WriteField("caption", caption)
+	writer.WriteField("parse_mode", "HTML")
+	if len(buttons) > 0 {
+		markup, _ := json.Marshal(buildKeyboard(buttons))
+		writer.WriteField("reply_markup", string(markup))
 	}
-	msg := map[string]interface{}{"chat_id": chatID, "media": mediaGroup}
-	jsonData, _ := json.Marshal(msg)
-	resp, err := http.Post(fmt.Sprintf("https://api.telegram.org/bot%s/sendMediaGroup", token), "application/json", bytes.NewBuffer(jsonData))
+	part, err := writer.CreateFormFile(field, filename)
 	if err != nil { return err }
+	part.Write(data)
+	writer.Close()
+
+	return c.retry(c.baseContext(), c.HTTP, chatID, method, writer.FormDataContentType(), body.Bytes(), nil)
+}
+
+// SendMediaGroup mengirim album foto/video; caption dipasang di item pertama
+func (c *TelegramClient) SendMediaGroup(chatID int64, media []InputMedia, caption string) error {
+	if len(media) > 0 {
+		media[0].Caption = caption
+		media[0].ParseMode = "HTML"
+	}
+	msg := map[string]interface{}{"chat_id": chatID, "media": media}
+	return c.send(chatID, "sendMediaGroup", msg, nil)
+}
+
+func (c *TelegramClient) SendChatAction(chatID int64, action string) error {
+	return c.send(chatID, "sendChatAction", map[string]interface{}{"chat_id": chatID, "action": action}, nil)
+}
+
+func (c *TelegramClient) AnswerCallback(callbackID string) error {
+	return c.call("answerCallbackQuery", map[string]interface{}{"callback_query_id": callbackID}, nil)
+}
+
+// AnswerCallbackText menjawab callback dengan toast singkat di atas chat
+func (c *TelegramClient) AnswerCallbackText(callbackID, text string) error {
+	return c.call("answerCallbackQuery", map[string]interface{}{"callback_query_id": callbackID, "text": text}, nil)
+}
+
+// SendInvoice mengirim invoice Telegram Stars (currency XTR, tanpa provider token)
+func (c *TelegramClient) SendInvoice(chatID int64, title, description, payload string, stars int) error {
+	msg := map[string]interface{}{
+		"chat_id":        chatID,
+		"title":          title,
+		"description":    description,
+		"payload":        payload,
+		"provider_token": "",
+		"currency":       "XTR",
+		"prices":         []map[string]interface{}{{"label": title, "amount": stars}},
+	}
+	return c.send(chatID, "sendInvoice", msg, nil)
+}
+
+// AnswerPreCheckoutQuery wajib dipanggil maksimal 10 detik setelah pre_checkout_query diterima
+func (c *TelegramClient) AnswerPreCheckoutQuery(queryID string, ok bool, errorMessage string) error {
+	msg := map[string]interface{}{"pre_checkout_query_id": queryID, "ok": ok}
+	if !ok {
+		msg["error_message"] = errorMessage
+	}
+	return c.call("answerPreCheckoutQuery", msg, nil)
+}
+
+// RefundStarPayment mengembalikan pembayaran Telegram Stars ke user
+func (c *TelegramClient) RefundStarPayment(userID int64, chargeID string) error {
+	msg := map[string]interface{}{"user_id": userID, "telegram_payment_charge_id": chargeID}
+	return c.send(userID, "refundStarPayment", msg, nil)
+}
+
+// GetFilePath mengembalikan file_path untuk file_id (dipakai sebelum download)
+func (c *TelegramClient) GetFilePath(fileID string) (string, error) {
+	var file struct {
+		FileID   string `json:"file_id"`
+		FilePath string `json:"file_path"`
+	}
+	if err := c.call("getFile", map[string]interface{}{"file_id": fileID}, &file); err != nil {
+		return "", err
+	}
+	return file.FilePath, nil
+}
+
+// DownloadFile mengunduh isi file dari file_path hasil getFile
+func (c *TelegramClient) DownloadFile(filePath string) ([]byte, error) {
+	resp, err := c.HTTP.Get(c.FileURL(filePath))
+	if err != nil {
+		return nil, err
+	}
 	defer resp.Body.Close()
-	return checkAPIError(resp)
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("download file status %d", resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// GetMe mengembalikan username bot (dipakai untuk link referral)
+func (c *TelegramClient) GetMe() (string, error) {
+	var me struct {
+		Username string `json:"username"`
+	}
+	err := c.call("getMe", map[string]interface{}{}, &me)
+	return me.Username, err
 }
 
-func SendChatAction(token string, chatID int64, action string) {
-	url := fmt.Sprintf("https://api.telegram.org/bot%s/sendChatAction?chat_id=%d&action=%s", token, chatID, action)
-	http.Get(url)
+// SetWebhook mendaftarkan URL webhook ke Telegram beserta secret token
+func (c *TelegramClient) SetWebhook(webhookURL string, secret string) error {
+	msg := map[string]interface{}{
+		"url":                  webhookURL,
+		"drop_pending_updates": false,
+	}
+	if secret != "" {
+		msg["secret_token"] = secret
+	}
+	return c.call("setWebhook", msg, nil)
 }
 
-func AnswerCallback(token string, callbackID string) {
-	http.Get(fmt.Sprintf("https://api.telegram.org/bot%s/answerCallbackQuery?callback_query_id=%s", token, callbackID))
+// DeleteWebhook menghapus webhook agar getUpdates (long polling) bisa dipakai lagi
+func (c *TelegramClient) DeleteWebhook() error {
+	return c.call("deleteWebhook", map[string]interface{}{}, nil)
 }
 
 func buildKeyboard(buttons []map[string]string) map[string]interface{} {
@@ -0,0 +1,130 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// cancelButtons membuat tombol "⛔ Cancel" untuk pesan status generasi
+func (b *BotApp) cancelButtons(job *GenerationJob) []map[string]string {
+	return []map[string]string{
+		{"text": b.I18n.Get(job.Language, "gen_cancel_btn"), "callback_data": "gen_cancel|" + job.GenerationID},
+	}
+}
+
+// sendStatus mengirim pesan status generasi beserta tombol cancel.
+// Harus dipanggil sebelum job di-detach agar pesannya ikut tersimpan di job.
+func (b *BotApp) sendStatus(job *GenerationJob, text string) {
+	msgID, err := b.TG.SendMessageID(job.ChatID, text, b.cancelButtons(job))
+	if err != nil {
+		fmt.Printf("[ERROR] Send status for generation %s: %v\n", job.GenerationID, err)
+		return
+	}
+	job.setStatus(msgID, text)
+}
+
+// editStatus mengganti isi pesan status (tanpa tombol), atau mengirim pesan baru
+// jika pesan status tidak ada (mis. job dimuat ulang dari webhook setelah restart)
+func (b *BotApp) editStatus(job *GenerationJob, text string) {
+	msgID, _ := job.status()
+	if msgID == 0 {
+		b.TG.SendMessage(job.ChatID, text, nil)
+		return
+	}
+	if err := b.TG.EditMessageText(job.ChatID, msgID, text, nil); err != nil {
+		fmt.Printf("[ERROR] Edit status for generation %s: %v\n", job.GenerationID, err)
+	}
+}
+
+// clearStatus membuang tombol cancel setelah generasi selesai
+func (b *BotApp) clearStatus(job *GenerationJob) {
+	if msgID, text := job.status(); msgID != 0 {
+		b.editStatus(job, text)
+	}
+}
+
+// HandleCancelGeneration memproses tombol cancel. Job yang masih berjalan di goroutine
+// dibatalkan lewat context-nya (Generate ikut membatalkan prediction); job webhook
+// dibatalkan langsung di Replicate dan diselesaikan saat webhook "canceled" datang.
+func (b *BotApp) HandleCancelGeneration(callbackID string, chatID int64, msgID int, user *User, genID string) {
+	job, detached := b.Jobs.Find(genID)
+	owner := int64(0)
+	if job != nil {
+		owner = job.UserID
+	} else {
+		// Job sudah selesai: pemilik dicek dari riwayat sebelum pesan status diedit
+		gen, err := b.DB.GetGeneration(genID)
+		if err != nil {
+			fmt.Printf("[ERROR] Cancel generation %s: %v\n", genID, err)
+			b.TG.AnswerCallback(callbackID)
+			return
+		}
+		if gen != nil {
+			owner = gen.UserID
+		}
+	}
+	if owner != user.ID {
+		// Di grup, tombol cancel terlihat oleh semua anggota
+		b.TG.AnswerCallbackText(callbackID, b.I18n.Get(user.LanguageCode, "gen_cancel_not_owner"))
+		return
+	}
+	b.TG.AnswerCallback(callbackID)
+	if job == nil {
+		b.TG.EditMessageText(chatID, msgID, b.I18n.Get(user.LanguageCode, "gen_cancel_too_late"), nil)
+		return
+	}
+	if job.CanceledByUser() {
+		return
+	}
+	// Diedit sebelum context dibatalkan agar tidak menimpa pesan "dibatalkan" dari cancelJob
+	b.TG.EditMessageText(chatID, msgID, b.I18n.Get(user.LanguageCode, "gen_canceling"), nil)
+	if !job.RequestCancel() {
+		return
+	}
+	fmt.Printf("[INFO] Generation %s canceled by user %d\n", genID, user.ID)
+
+	if detached {
+		b.cancelPrediction(job)
+	}
+}
+
+// cancelPrediction membatalkan prediction job webhook berdasarkan ID yang tersimpan di generasi
+func (b *BotApp) cancelPrediction(job *GenerationJob) {
+	gen, err := b.DB.GetGeneration(job.GenerationID)
+	if err != nil || gen == nil || gen.PredictionID == "" {
+		// Submit masih berjalan: runGeneration membatalkan prediction setelah Submit selesai
+		fmt.Printf("[WARN] Cancel generation %s: prediction not found (%v)\n", job.GenerationID, err)
+		return
+	}
+	backend, err := b.backendFor(b.GetModelByID(gen.ModelID))
+	if err != nil {
+		fmt.Printf("[ERROR] Cancel generation %s: %v\n", job.GenerationID, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := backend.Cancel(ctx, &Prediction{ID: gen.PredictionID}); err != nil {
+		fmt.Printf("[ERROR] Cancel prediction %s: %v\n", gen.PredictionID, err)
+	}
+}
+
+// cancelJob me-refund biaya job yang dibatalkan lalu memperbarui pesan statusnya
+func (b *BotApp) cancelJob(job *GenerationJob) {
+	if !job.Settle() {
+		return
+	}
+	amount := job.Refundable()
+	if err := b.refundCost(job, "canceled"); err != nil {
+		b.editStatus(job, b.I18n.Get(job.Language, "error_generic"))
+		return
+	}
+	b.editStatus(job, b.I18n.Get(job.Language, "gen_canceled", b.FormatAmount(job.Language, amount, job.Currency)))
+}
+
+// isCanceled bernilai true jika err adalah prediction yang dibatalkan di backend
+func isCanceled(err error) bool {
+	var perr *PredictionError
+	return errors.As(err, &perr) && perr.Status == PredictionCanceled
+}
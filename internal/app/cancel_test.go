@@ -0,0 +1,65 @@
+package app
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func cancelTestBot(t *testing.T) (*BotApp, *fakeTelegram) {
+	t.Helper()
+	tg, client := newFakeTelegram(t)
+	plans, err := LoadPlans(filepath.Join(t.TempDir(), "plans.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &BotApp{TG: client, DB: NewMemoryStore(), I18n: NewI18nManager(), Plans: plans, Jobs: NewJobTracker()}, tg
+}
+
+// Pesan status ditulis goroutine generasi sementara tombol cancel membacanya (go test -race)
+func TestJobStatusConcurrentAccess(t *testing.T) {
+	b, _ := cancelTestBot(t)
+	job := &GenerationJob{GenerationID: "gen-race", UserID: 1, ChatID: 1}
+	if _, err := b.Jobs.Start(job, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Jobs.Finish(job)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		b.sendStatus(job, "Generating...")
+	}()
+	go func() {
+		defer wg.Done()
+		b.clearStatus(job)
+		b.editStatus(job, "Canceled")
+	}()
+	wg.Wait()
+
+	if msgID, text := job.status(); msgID != 1 || text != "Generating..." {
+		t.Errorf("status = %d %q", msgID, text)
+	}
+}
+
+func TestCancelFinishedGenerationChecksOwner(t *testing.T) {
+	b, tg := cancelTestBot(t)
+	if err := b.DB.CreateGeneration(Generation{ID: "gen-done", UserID: 1, ChatID: -100}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Anggota grup lain menekan tombol cancel milik generasi yang sudah selesai
+	b.HandleCancelGeneration("cb-1", -100, 42, &User{ID: 2}, "gen-done")
+	if n := tg.count("editMessageText"); n != 0 {
+		t.Errorf("non-owner press edited the status message %d times", n)
+	}
+	if n := tg.count("answerCallbackQuery"); n != 1 {
+		t.Errorf("answered %d callbacks, want 1", n)
+	}
+
+	b.HandleCancelGeneration("cb-2", -100, 42, &User{ID: 1}, "gen-done")
+	if n := tg.count("editMessageText"); n != 1 {
+		t.Errorf("owner press edited the status message %d times, want 1", n)
+	}
+}
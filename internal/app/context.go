@@ -9,33 +9,51 @@ import (
 )
 
 type BotApp struct {
-	BotToken    string
+	TG          TelegramAPI
 	SupabaseURL string
 	SupabaseKey string
-	DB          *Database
-	Replicate   *ReplicateConfig
+	DB          Store
+	Backends    map[string]ImageBackend // per nama backend, lihat ModelConfig.Backend
 	I18n        *I18nManager
 	Providers   []Provider
 	Models      []ModelConfig
+	Pipelines   []Pipeline
+	Plans       *PlanBook
+	Packs       []CreditPack
+	Referral    ReferralPolicy
+	Tools       ResultTools
+	Username    string // username bot tanpa @, untuk link referral
+	Admins      map[int64]bool
+	Dispatcher  *Dispatcher
+	Jobs        *JobTracker
+	Debug       bool // DEBUG_PAYLOADS=true: log payload ke backend (nilai panjang dipotong)
 }
 
-func NewBotApp(token, sbURL, sbKey string, db *Database, rep *ReplicateConfig, i18n *I18nManager) *BotApp {
+func NewBotApp(tg TelegramAPI, sbURL, sbKey string, db Store, backends map[string]ImageBackend, i18n *I18nManager) *BotApp {
 	// SANITASI URL: Hapus slash di akhir jika ada
 	cleanSbURL := strings.TrimRight(sbURL, "/")
 
 	app := &BotApp{
-		BotToken:    token,
+		TG:          tg,
 		SupabaseURL: cleanSbURL, // Gunakan URL yang bersih
 		SupabaseKey: sbKey,
 		DB:          db,
-		Replicate:   rep,
+		Backends:    backends,
 		I18n:        i18n,
+		Jobs:        NewJobTracker(),
+		Admins:      make(map[int64]bool),
 	}
 	
+	app.Dispatcher = NewDispatcher(DefaultWorkers, app.HandleUpdate)
 	app.loadConfig()
 	
-	if err := app.EnsureBucketExists(); err != nil {
-		log.Fatalf("[FATAL] Gagal menginisialisasi Storage Bucket: %v", err)
+	// Supabase Storage opsional: tanpa Supabase, gambar upload dikirim sebagai data URI
+	if app.SupabaseURL != "" && app.SupabaseKey != "" {
+		if err := app.EnsureBucketExists(); err != nil {
+			log.Fatalf("[FATAL] Gagal menginisialisasi Storage Bucket: %v", err)
+		}
+	} else {
+		fmt.Println("[INFO] Supabase not configured, uploads will be sent inline as data URIs.")
 	}
 
 	return app
@@ -53,8 +71,54 @@ func (b *BotApp) loadConfig() {
 		log.Fatal("Failed to load models.json")
 	}
 	json.Unmarshal(mContent, &b.Models)
+
+	// Model dengan backend yang tidak dikonfigurasi tidak bisa dipakai
+	for i, m := range b.Models {
+		if _, ok := b.Backends[m.BackendName()]; !ok && m.Enabled {
+			fmt.Printf("[INFO] Model %s disabled: backend %s not configured\n", m.ID, m.BackendName())
+			b.Models[i].Enabled = false
+		}
+		// Aturan pricing yang tidak valid bisa membuat generasi gratis, jadi modelnya dimatikan
+		for _, r := range m.Pricing {
+			if err := r.validate(); err != nil && b.Models[i].Enabled {
+				fmt.Printf("[ERROR] Model %s disabled: invalid pricing: %v\n", m.ID, err)
+				b.Models[i].Enabled = false
+				break
+			}
+		}
+	}
 	
-	fmt.Printf("[INFO] Loaded %d providers and %d models.\n", len(b.Providers), len(b.Models))
+	plans, err := LoadPlans("config/plans.json")
+	if err != nil {
+		log.Fatal("Failed to load plans.json: ", err)
+	}
+	b.Plans = plans
+
+	packs, err := loadPacks("config/packs.json")
+	if err != nil {
+		log.Fatal("Failed to load packs.json: ", err)
+	}
+	b.Packs = packs
+
+	referral, err := loadReferralPolicy("config/referral.json")
+	if err != nil {
+		log.Fatal("Failed to load referral.json: ", err)
+	}
+	b.Referral = referral
+
+	pipelines, err := loadPipelines("config/pipelines.json", b.Models)
+	if err != nil {
+		log.Fatal("Failed to load pipelines.json: ", err)
+	}
+	b.Pipelines = pipelines
+
+	tools, err := loadResultTools("config/tools.json")
+	if err != nil {
+		log.Fatal("Failed to load tools.json: ", err)
+	}
+	b.Tools = tools
+
+	fmt.Printf("[INFO] Loaded %d providers, %d models and %d pipelines.\n", len(b.Providers), len(b.Models), len(b.Pipelines))
 }
 
 func (b *BotApp) GetModelByID(id string) ModelConfig {
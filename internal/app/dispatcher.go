@@ -0,0 +1,91 @@
+package app
+
+import (
+	"fmt"
+	"sync"
+)
+
+const DefaultWorkers = 16
+
+// Dispatcher membatasi jumlah update yang diproses bersamaan dan menjamin
+// update dari user yang sama diproses berurutan (FIFO), sementara user
+// berbeda tetap berjalan paralel.
+type Dispatcher struct {
+	handle func(TelegramUpdate)
+	sem    chan struct{}
+	mu     sync.Mutex
+	queues map[int64][]TelegramUpdate // antrean per user yang sedang punya runner aktif
+	wg     sync.WaitGroup
+}
+
+func NewDispatcher(workers int, handle func(TelegramUpdate)) *Dispatcher {
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	return &Dispatcher{
+		handle: handle,
+		sem:    make(chan struct{}, workers),
+		queues: make(map[int64][]TelegramUpdate),
+	}
+}
+
+// Dispatch memasukkan update ke antrean user-nya. Tidak memblokir.
+func (d *Dispatcher) Dispatch(update TelegramUpdate) {
+	// pre_checkout_query harus dijawab dalam 10 detik dan hanya membaca config,
+	// jadi tidak ikut antre di belakang generasi milik user yang sama
+	if update.PreCheckoutQuery.ID != "" {
+		d.wg.Add(1)
+		go func() {
+			defer d.wg.Done()
+			d.process(update)
+		}()
+		return
+	}
+
+	key := update.SenderID()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if queue, ok := d.queues[key]; ok {
+		d.queues[key] = append(queue, update)
+		return
+	}
+	d.queues[key] = []TelegramUpdate{update}
+	d.wg.Add(1)
+	go d.run(key)
+}
+
+// Wait menunggu semua antrean kosong
+func (d *Dispatcher) Wait() {
+	d.wg.Wait()
+}
+
+func (d *Dispatcher) run(key int64) {
+	defer d.wg.Done()
+	for {
+		d.mu.Lock()
+		queue := d.queues[key]
+		if len(queue) == 0 {
+			delete(d.queues, key)
+			d.mu.Unlock()
+			return
+		}
+		update := queue[0]
+		d.queues[key] = queue[1:]
+		d.mu.Unlock()
+
+		d.sem <- struct{}{}
+		d.process(update)
+		<-d.sem
+	}
+}
+
+func (d *Dispatcher) process(update TelegramUpdate) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("[ERROR] Panic while handling update %d: %v\n", update.UpdateID, r)
+		}
+	}()
+	d.handle(update)
+}
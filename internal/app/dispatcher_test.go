@@ -0,0 +1,142 @@
+package app
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func messageUpdate(updateID int, userID int64) TelegramUpdate {
+	var u TelegramUpdate
+	u.UpdateID = updateID
+	u.Message.From.ID = userID
+	u.Message.Chat.ID = userID
+	return u
+}
+
+func TestDispatcherPerUserFIFO(t *testing.T) {
+	const users, perUser = 5, 40
+
+	var mu sync.Mutex
+	seen := make(map[int64][]int)
+	running := make(map[int64]bool)
+
+	d := NewDispatcher(4, func(u TelegramUpdate) {
+		id := u.SenderID()
+		mu.Lock()
+		if running[id] {
+			t.Errorf("user %d has two updates running at once", id)
+		}
+		running[id] = true
+		mu.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		mu.Lock()
+		running[id] = false
+		seen[id] = append(seen[id], u.UpdateID)
+		mu.Unlock()
+	})
+
+	updateID := 0
+	for i := 0; i < perUser; i++ {
+		for user := int64(1); user <= users; user++ {
+			updateID++
+			d.Dispatch(messageUpdate(updateID, user))
+		}
+	}
+	d.Wait()
+
+	for user := int64(1); user <= users; user++ {
+		ids := seen[user]
+		if len(ids) != perUser {
+			t.Fatalf("user %d: handled %d updates, want %d", user, len(ids), perUser)
+		}
+		for i := 1; i < len(ids); i++ {
+			if ids[i] <= ids[i-1] {
+				t.Fatalf("user %d: updates out of order: %v", user, ids)
+			}
+		}
+	}
+}
+
+func TestDispatcherWorkerBound(t *testing.T) {
+	const workers = 3
+
+	var inFlight, peak, handled int32
+	d := NewDispatcher(workers, func(u TelegramUpdate) {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+		atomic.AddInt32(&handled, 1)
+	})
+
+	// Setiap update dari user berbeda, jadi hanya batas worker yang menahan paralelisme
+	for i := 1; i <= 30; i++ {
+		d.Dispatch(messageUpdate(i, int64(i)))
+	}
+	d.Wait()
+
+	if handled != 30 {
+		t.Errorf("handled %d updates, want 30", handled)
+	}
+	if peak > workers {
+		t.Errorf("%d updates ran at once, limit is %d", peak, workers)
+	}
+	if peak < 2 {
+		t.Errorf("updates from different users did not run in parallel (peak %d)", peak)
+	}
+}
+
+func TestDispatcherPreCheckoutSkipsUserQueue(t *testing.T) {
+	release := make(chan struct{})
+	answered := make(chan struct{})
+
+	d := NewDispatcher(1, func(u TelegramUpdate) {
+		if u.PreCheckoutQuery.ID != "" {
+			close(answered)
+			return
+		}
+		<-release
+	})
+
+	d.Dispatch(messageUpdate(1, 7))
+
+	var checkout TelegramUpdate
+	checkout.UpdateID = 2
+	checkout.PreCheckoutQuery.ID = "q"
+	checkout.PreCheckoutQuery.From.ID = 7
+	d.Dispatch(checkout)
+
+	select {
+	case <-answered:
+	case <-time.After(2 * time.Second):
+		t.Error("pre_checkout_query waited behind the user's running update")
+	}
+	close(release)
+	d.Wait()
+}
+
+func TestDispatcherRecoversPanics(t *testing.T) {
+	var handled int32
+	d := NewDispatcher(2, func(u TelegramUpdate) {
+		if u.UpdateID == 1 {
+			panic("boom")
+		}
+		atomic.AddInt32(&handled, 1)
+	})
+	d.Dispatch(messageUpdate(1, 9))
+	d.Dispatch(messageUpdate(2, 9))
+	d.Wait()
+
+	if handled != 1 {
+		t.Errorf("update after a panic was not handled (handled %d)", handled)
+	}
+}
@@ -5,13 +5,37 @@ import (
 	"strings"
 )
 
+// HandleUpdate meneruskan update ke handler yang sesuai (dipakai polling & webhook)
+func (b *BotApp) HandleUpdate(update TelegramUpdate) {
+	// Idempotensi: update yang dikirim ulang (restart/retry webhook) dilewati
+	claimed, err := b.DB.ClaimUpdate(update.UpdateID, update.CallbackQuery.ID)
+	if err != nil {
+		fmt.Printf("[ERROR] Claim update %d: %v\n", update.UpdateID, err)
+		return
+	}
+	if !claimed {
+		fmt.Printf("[INFO] Skipping duplicate update %d\n", update.UpdateID)
+		return
+	}
+
+	if update.PreCheckoutQuery.ID != "" {
+		b.HandlePreCheckout(update)
+	} else if update.CallbackQuery.ID != "" {
+		b.HandleCallback(update)
+	} else if update.Message.SuccessfulPayment != nil {
+		b.HandleSuccessfulPayment(update)
+	} else if update.Message.Text != "" || len(update.Message.Photo) > 0 {
+		b.HandleMessage(update)
+	}
+}
+
 // HandleMessage menangani pesan teks dan foto dari user
 func (b *BotApp) HandleMessage(update TelegramUpdate) {
 	userID := update.Message.From.ID
 	chatID := update.Message.Chat.ID
 	text := update.Message.Text
 
-	user, err := b.DB.GetOrCreateUser(userID)
+	user, err := b.GetUser(userID)
 	if err != nil {
 		return
 	}
@@ -22,26 +46,67 @@ func (b *BotApp) HandleMessage(update TelegramUpdate) {
 			b.processPhotoUpload(user, chatID, update)
 			return
 		} else {
-			SendMessage(b.BotToken, chatID, "⚠️ Please click 'Add Image' button first.", nil)
+			b.TG.SendMessage(chatID, "⚠️ Please click 'Add Image' button first.", nil)
 			return
 		}
 	}
 
 	// === COMMANDS ===
 	if strings.HasPrefix(text, "/") {
-		if text == "/start" {
-			go b.DB.ClearState(userID)
-			SendMessage(b.BotToken, chatID, b.I18n.Get(user.LanguageCode, "welcome", user.Credits), nil)
+		if text == "/start" || strings.HasPrefix(text, "/start ") {
+			b.DB.ClearState(userID)
+			b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "welcome", user.Balance()), nil)
+			b.handleStartPayload(chatID, user, strings.TrimSpace(strings.TrimPrefix(text, "/start")))
+			return
+		}
+		if text == "/invite" {
+			b.ShowInvite(chatID, user)
 			return
 		}
 		if text == "/img" {
-			go b.DB.ClearState(userID)
+			b.DB.ClearState(userID)
 			b.ShowProviderList(chatID, user, false, 0)
 			return
 		}
+		if text == "/buy" {
+			b.ShowCreditPacks(chatID, user)
+			return
+		}
+		if text == "/plans" || text == "/plan" {
+			b.ShowPlans(chatID, user)
+			return
+		}
+		if strings.HasPrefix(text, "/setplan") && b.IsAdmin(userID) {
+			b.handleSetPlanCommand(chatID, user, strings.TrimPrefix(text, "/setplan"))
+			return
+		}
+		if strings.HasPrefix(text, "/refund") && b.IsAdmin(userID) {
+			b.handleRefundCommand(chatID, user, strings.TrimSpace(strings.TrimPrefix(text, "/refund")))
+			return
+		}
+		if text == "/redeem" || strings.HasPrefix(text, "/redeem ") {
+			b.handleRedeem(chatID, user, strings.TrimSpace(strings.TrimPrefix(text, "/redeem")))
+			return
+		}
+		if strings.HasPrefix(text, "/promo") && b.IsAdmin(userID) {
+			b.handlePromoCommand(chatID, user, strings.TrimPrefix(text, "/promo"))
+			return
+		}
+		if strings.HasPrefix(text, "/grant") && b.IsAdmin(userID) {
+			b.handleGrantCommand(chatID, user, strings.TrimPrefix(text, "/grant"))
+			return
+		}
+		if text == "/history" {
+			b.ShowHistory(chatID, 0, user, 0)
+			return
+		}
+		if text == "/credits" {
+			b.ShowCreditHistory(chatID, user)
+			return
+		}
 		if text == "/profile" || text == "/status" {
-			msg := fmt.Sprintf("👤 ID: %d | Credits: %d", user.ID, user.Credits)
-			SendMessage(b.BotToken, chatID, msg, nil)
+			msg := fmt.Sprintf("👤 ID: %d | Credits: %d (free: %d, purchased: %d) | 💎 Diamonds: %d | 📋 Plan: %s%s", user.ID, user.Balance(), user.Credits, user.PaidCredits, user.Diamonds, b.UserPlan(user).Name, b.formatPlanExpiry(user.LanguageCode, user))
+			b.TG.SendMessage(chatID, msg, nil)
 			return
 		}
 	}
@@ -51,11 +116,11 @@ func (b *BotApp) HandleMessage(update TelegramUpdate) {
 		b.ProcessImageGeneration(user, chatID, text)
 		return
 	} else if user.CurrentState == "uploading_images" {
-		SendMessage(b.BotToken, chatID, "Please click 'Done Uploading' before sending text.", nil)
+		b.TG.SendMessage(chatID, "Please click 'Done Uploading' before sending text.", nil)
 		return
 	}
 
-	SendMessage(b.BotToken, chatID, b.I18n.Get(user.LanguageCode, "use_img_cmd"), nil)
+	b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "use_img_cmd"), nil)
 }
 
 // processPhotoUpload menangani logika upload gambar ke Supabase
@@ -88,18 +153,18 @@ func (b *BotApp) processPhotoUpload(user *User, chatID int64, update TelegramUpd
 	}
 
 	if currentCount >= maxImg {
-		SendMessage(b.BotToken, chatID, b.I18n.Get(user.LanguageCode, "upload_limit"), nil)
+		b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "upload_limit"), nil)
 		return
 	}
 
 	// Proses Upload
-	SendChatAction(b.BotToken, chatID, "upload_photo")
+	b.TG.SendChatAction(chatID, "upload_photo")
 	photoID := update.Message.Photo[len(update.Message.Photo)-1].FileID
 
 	publicURL, err := b.UploadTelegramToSupabase(photoID, user.ID)
 	if err != nil {
 		fmt.Printf("[ERROR] Upload failed: %v\n", err)
-		SendMessage(b.BotToken, chatID, "❌ Upload failed.", nil)
+		b.TG.SendMessage(chatID, "❌ Upload failed.", nil)
 		return
 	}
 
@@ -123,7 +188,7 @@ func (b *BotApp) processPhotoUpload(user *User, chatID int64, update TelegramUpd
 		b.DB.UpdateDraftConfig(user.ID, paramName, publicURL)
 	}
 
-	SendMessage(b.BotToken, chatID, b.I18n.Get(user.LanguageCode, "upload_success"), nil)
+	b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "upload_success"), nil)
 }
 
 // HandleCallback menangani interaksi tombol
@@ -133,28 +198,83 @@ func (b *BotApp) HandleCallback(update TelegramUpdate) {
 	chatID := update.CallbackQuery.Message.Chat.ID
 	msgID := update.CallbackQuery.Message.MessageID
 
-	AnswerCallback(b.BotToken, update.CallbackQuery.ID)
+	// Tombol cancel menjawab callback-nya sendiri (toast untuk yang bukan pemilik);
+	// callback query hanya bisa dijawab sekali
+	if !strings.HasPrefix(data, "gen_cancel|") {
+		b.TG.AnswerCallback(update.CallbackQuery.ID)
+	}
 
 	if strings.HasPrefix(data, "lang_") {
 		lang := strings.TrimPrefix(data, "lang_")
 		b.DB.SetLanguage(userID, lang)
-		SendMessage(b.BotToken, chatID, "Language updated.", nil)
+		b.TG.SendMessage(chatID, "Language updated.", nil)
+		return
+	}
+
+	user, err := b.GetUser(userID)
+	if err != nil {
+		fmt.Printf("[ERROR] Load user %d: %v\n", userID, err)
 		return
 	}
 
-	user, _ := b.DB.GetOrCreateUser(userID)
+	// --- BUY CREDIT PACK ---
+	if strings.HasPrefix(data, "buy_") {
+		b.SendPackInvoice(chatID, user, strings.TrimPrefix(data, "buy_"))
+		return
+	}
+
+	// --- GENERATION HISTORY ---
+	if strings.HasPrefix(data, "hist_") {
+		b.handleHistoryCallback(chatID, msgID, user, data)
+		return
+	}
+
+	// --- CANCEL RUNNING GENERATION ---
+	if strings.HasPrefix(data, "gen_cancel|") {
+		b.HandleCancelGeneration(update.CallbackQuery.ID, chatID, msgID, user, strings.TrimPrefix(data, "gen_cancel|"))
+		return
+	}
+
+	// --- ACTIONS UNDER A RESULT ---
+	if strings.HasPrefix(data, "res_") {
+		b.handleResultCallback(chatID, user, data)
+		return
+	}
+
+	// --- SUBSCRIBE TO PLAN ---
+	if strings.HasPrefix(data, "plan_") {
+		b.SendPlanInvoice(chatID, user, strings.TrimPrefix(data, "plan_"))
+		return
+	}
+
+	// --- LOCKED MODEL (UPSELL) ---
+	if strings.HasPrefix(data, "locked_") {
+		b.ShowModelLocked(chatID, msgID, user, b.GetModelByID(strings.TrimPrefix(data, "locked_")))
+		return
+	}
 
 	// --- NAVIGATION ---
 	if data == "nav_providers" || data == "nav_cancel" {
-		go b.DB.ClearState(userID)
+		b.DB.ClearState(userID)
 		b.ShowProviderList(chatID, user, true, msgID)
 		return
 	}
 
+	// --- PIPELINES ---
+	if data == "nav_pipelines" {
+		b.DB.ClearState(userID)
+		b.ShowPipelineList(chatID, msgID, user)
+		return
+	}
+	if strings.HasPrefix(data, "pipe_") {
+		b.SelectPipeline(chatID, msgID, user, strings.TrimPrefix(data, "pipe_"))
+		return
+	}
+
 	// --- TRIGGER UPLOAD MODE ---
 	if data == "trigger_upload" {
 		// Update Status Tanpa Reset Config
-		go b.DB.UpdateCurrentState(userID, "uploading_images")
+		b.DB.UpdateCurrentState(userID, "uploading_images")
 		modelConf := b.GetModelByID(user.SelectedModel)
 		b.ShowUploadPanel(chatID, msgID, user, modelConf)
 		return
@@ -163,10 +283,14 @@ func (b *BotApp) HandleCallback(update TelegramUpdate) {
 	// --- DONE UPLOADING -> BACK TO MAIN ---
 	if data == "upload_done" {
 		// Update Status Tanpa Reset Config
-		go b.DB.UpdateCurrentState(userID, "waiting_prompt")
+		b.DB.UpdateCurrentState(userID, "waiting_prompt")
 		
 		// Refresh User agar dapat data terbaru
-		updatedUser, _ := b.DB.GetOrCreateUser(userID)
+		updatedUser, err := b.GetUser(userID)
+		if err != nil {
+			fmt.Printf("[ERROR] Load user %d: %v\n", userID, err)
+			return
+		}
 		modelConf := b.GetModelByID(updatedUser.SelectedModel)
 		b.ShowModelPanel(chatID, msgID, updatedUser, modelConf)
 		return
@@ -175,6 +299,7 @@ func (b *BotApp) HandleCallback(update TelegramUpdate) {
 	// --- PROVIDER SELECT ---
 	if strings.HasPrefix(data, "prov_") {
 		provID := strings.TrimPrefix(data, "prov_")
+		plan := b.UserPlan(user)
 		var buttons []map[string]string
 		for _, m := range b.Models {
 			if !m.Enabled {
@@ -190,9 +315,19 @@ func (b *BotApp) HandleCallback(update TelegramUpdate) {
 				}
 			}
 			if isMatch {
+				label := fmt.Sprintf("%s (%d Cr)", m.Name, m.Cost)
+				if m.DiamondCost > 0 {
+					label = fmt.Sprintf("%s (%d 💎)", m.Name, m.DiamondCost)
+				}
+				callback := "model_" + m.ID
+				// Model di luar tier plan tetap ditampilkan, tapi terkunci
+				if !plan.AllowsTier(m.Tier) {
+					label = "🔒 " + label
+					callback = "locked_" + m.ID
+				}
 				buttons = append(buttons, map[string]string{
-					"text":          fmt.Sprintf("%s (%d Cr)", m.Name, m.Cost),
-					"callback_data": "model_" + m.ID,
+					"text":          label,
+					"callback_data": callback,
 				})
 			}
 		}
@@ -201,7 +336,7 @@ func (b *BotApp) HandleCallback(update TelegramUpdate) {
 		if len(buttons) == 1 {
 			msg = b.I18n.Get(user.LanguageCode, "model_unavailable")
 		}
-		EditMessageText(b.BotToken, chatID, msgID, msg, buttons)
+		b.TG.EditMessageText(chatID, msgID, msg, buttons)
 		return
 	}
 
@@ -209,18 +344,20 @@ func (b *BotApp) HandleCallback(update TelegramUpdate) {
 	if strings.HasPrefix(data, "model_") {
 		modelID := strings.TrimPrefix(data, "model_")
 		modelConf := b.GetModelByID(modelID)
+		if !b.UserPlan(user).AllowsTier(modelConf.Tier) {
+			b.ShowModelLocked(chatID, msgID, user, modelConf)
+			return
+		}
 		
-		// Gunakan Goroutine untuk update DB (UpdateState mereset draft)
-		go func() {
-			b.DB.UpdateState(userID, "waiting_prompt", modelID)
-			for _, p := range modelConf.Parameters {
-				if p.Default != nil {
-					b.DB.UpdateDraftConfig(userID, p.Name, p.Default)
-				}
+		// Update DB secara berurutan (UpdateState mereset draft). Dispatcher sudah
+		// menjamin update dari user yang sama tidak berjalan paralel.
+		b.DB.UpdateState(userID, "waiting_prompt", modelID)
+		for _, p := range modelConf.Parameters {
+			if p.Default != nil {
+				b.DB.UpdateDraftConfig(userID, p.Name, p.Default)
 			}
-		}()
-		
-		// Simulasi lokal agar UI cepat
+		}
+
 		user.DraftConfig = make(map[string]interface{})
 		for _, p := range modelConf.Parameters {
 			if p.Default != nil {
@@ -244,7 +381,7 @@ func (b *BotApp) HandleCallback(update TelegramUpdate) {
 		content := strings.TrimPrefix(data, "set_val|")
 		parts := strings.SplitN(content, "|", 2)
 		if len(parts) == 2 {
-			go b.DB.UpdateDraftConfig(userID, parts[0], parts[1])
+			b.DB.UpdateDraftConfig(userID, parts[0], parts[1])
 			user.DraftConfig[parts[0]] = parts[1]
 			modelConf := b.GetModelByID(user.SelectedModel)
 			b.ShowModelPanel(chatID, msgID, user, modelConf)
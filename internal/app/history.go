@@ -0,0 +1,221 @@
+package app
+
+import (
+	"fmt"
+	"html"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Jumlah generasi per halaman /history
+const historyPageSize = 5
+
+var generationStatusIcons = map[string]string{
+	GenerationRunning:   "⏳",
+	GenerationSucceeded: "✅",
+	GenerationFailed:    "❌",
+	GenerationCanceled:  "⛔",
+}
+
+// shortDate mengubah timestamp RFC3339 menjadi "01-02 15:04" (UTC)
+func shortDate(ts string) string {
+	if t, err := time.Parse(time.RFC3339Nano, ts); err == nil {
+		return t.UTC().Format("01-02 15:04")
+	}
+	return ts
+}
+
+// truncate memotong teks panjang tanpa merusak karakter multibyte
+func truncate(text string, max int) string {
+	runes := []rune(text)
+	if len(runes) <= max {
+		return text
+	}
+	return string(runes[:max-1]) + "…"
+}
+
+// modelName mengembalikan nama model dari config, atau ID-nya jika model sudah dihapus
+func (b *BotApp) modelName(id string) string {
+	if m := b.GetModelByID(id); m.ID != "" {
+		return m.Name
+	}
+	return id
+}
+
+// ShowHistory menampilkan satu halaman riwayat generasi (/history). msgID 0 = kirim pesan baru.
+func (b *BotApp) ShowHistory(chatID int64, msgID int, user *User, page int) {
+	if page < 0 {
+		page = 0
+	}
+	// Ambil satu item ekstra untuk tahu apakah ada halaman berikutnya
+	gens, err := b.DB.ListGenerations(user.ID, page*historyPageSize, historyPageSize+1)
+	if err != nil {
+		fmt.Printf("[ERROR] History for %d: %v\n", user.ID, err)
+		b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "error_generic"), nil)
+		return
+	}
+	hasNext := len(gens) > historyPageSize
+	if hasNext {
+		gens = gens[:historyPageSize]
+	}
+
+	text := b.I18n.Get(user.LanguageCode, "history_header", page+1)
+	if len(gens) == 0 {
+		text += "\n\n" + b.I18n.Get(user.LanguageCode, "history_empty")
+	}
+
+	var buttons []map[string]string
+	for i, g := range gens {
+		n := page*historyPageSize + i + 1
+		text += fmt.Sprintf("\n\n<b>%d.</b> <code>%s</code> %s <b>%s</b>\n<i>%s</i>",
+			n, shortDate(g.CreatedAt), generationStatusIcons[g.Status], b.modelName(g.ModelID), html.EscapeString(truncate(g.Prompt, 80)))
+		buttons = append(buttons, map[string]string{
+			"text":          b.I18n.Get(user.LanguageCode, "history_view_btn", n),
+			"callback_data": "hist_view|" + g.ID,
+		})
+	}
+	if page > 0 {
+		buttons = append(buttons, map[string]string{"text": "◀️", "callback_data": fmt.Sprintf("hist_page|%d", page-1)})
+	}
+	if hasNext {
+		buttons = append(buttons, map[string]string{"text": "▶️", "callback_data": fmt.Sprintf("hist_page|%d", page+1)})
+	}
+
+	if msgID == 0 {
+		b.TG.SendMessage(chatID, text, buttons)
+	} else {
+		b.TG.EditMessageText(chatID, msgID, text, buttons)
+	}
+}
+
+// loadOwnGeneration mengambil generasi milik user, nil jika tidak ada atau milik user lain
+func (b *BotApp) loadOwnGeneration(chatID int64, user *User, id string) *Generation {
+	gen, err := b.DB.GetGeneration(id)
+	if err != nil {
+		fmt.Printf("[ERROR] Load generation %s: %v\n", id, err)
+	}
+	if gen == nil || gen.UserID != user.ID {
+		b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "history_not_found"), nil)
+		return nil
+	}
+	return gen
+}
+
+// ShowGeneration menampilkan detail satu generasi dengan tombol kirim ulang dan pakai ulang
+func (b *BotApp) ShowGeneration(chatID int64, msgID int, user *User, id string) {
+	gen := b.loadOwnGeneration(chatID, user, id)
+	if gen == nil {
+		return
+	}
+
+	text := b.I18n.Get(user.LanguageCode, "history_detail",
+		b.modelName(gen.ModelID), shortDate(gen.CreatedAt), generationStatusIcons[gen.Status], gen.Status,
+		b.FormatAmount(user.LanguageCode, gen.Cost, gen.Currency), float64(gen.DurationMs)/1000, html.EscapeString(gen.Prompt))
+
+	// Setting diurutkan agar tampilan stabil; URL gambar input cukup dihitung
+	var keys []string
+	for k := range gen.Settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := gen.Settings[k]
+		if list, ok := v.([]interface{}); ok {
+			v = fmt.Sprintf("%d file(s)", len(list))
+		} else if str, ok := v.(string); ok && isFileURL(str) {
+			v = "1 file"
+		}
+		text += fmt.Sprintf("\n• <b>%s:</b> %v", strings.ReplaceAll(k, "_", " "), v)
+	}
+	if gen.PredictionID != "" {
+		text += fmt.Sprintf("\n\n<code>%s</code>", gen.PredictionID)
+	}
+	if gen.Error != "" {
+		text += "\n<i>" + html.EscapeString(truncate(gen.Error, 200)) + "</i>"
+	}
+
+	var buttons []map[string]string
+	if len(gen.Outputs) > 0 {
+		buttons = append(buttons, map[string]string{"text": b.I18n.Get(user.LanguageCode, "history_resend_btn"), "callback_data": "hist_send|" + gen.ID})
+	}
+	buttons = append(buttons,
+		map[string]string{"text": b.I18n.Get(user.LanguageCode, "history_reuse_btn"), "callback_data": "hist_reuse|" + gen.ID},
+		map[string]string{"text": b.I18n.Get(user.LanguageCode, "back_btn"), "callback_data": "hist_page|0"},
+	)
+	b.TG.EditMessageText(chatID, msgID, text, buttons)
+}
+
+// ResendGeneration mengirim ulang output generasi lama (URL Replicate bisa sudah kedaluwarsa)
+func (b *BotApp) ResendGeneration(chatID int64, user *User, id string) {
+	gen := b.loadOwnGeneration(chatID, user, id)
+	if gen == nil {
+		return
+	}
+	if len(gen.Outputs) == 0 {
+		b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "history_not_found"), nil)
+		return
+	}
+	b.sendOutputs(chatID, user.LanguageCode, gen.ID, b.GetModelByID(gen.ModelID), gen.Outputs, resultCaption(gen.Prompt, b.modelName(gen.ModelID)), true)
+}
+
+// ReuseGeneration memuat ulang model dan setting generasi lama ke panel, lalu
+// mengirim prompt lamanya agar bisa disalin atau diubah
+func (b *BotApp) ReuseGeneration(chatID int64, msgID int, user *User, id string) {
+	gen := b.loadOwnGeneration(chatID, user, id)
+	if gen == nil {
+		return
+	}
+	modelConf, ok := b.restoreGeneration(chatID, msgID, user, gen)
+	if !ok {
+		return
+	}
+	b.ShowModelPanel(chatID, msgID, user, modelConf)
+	b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "history_reuse_prompt", html.EscapeString(gen.Prompt)), nil)
+}
+
+// restoreGeneration memasang kembali model dan setting generasi lama sebagai draft
+// (state waiting_prompt). msgID dipakai untuk upsell jika model terkunci, 0 = pesan baru.
+func (b *BotApp) restoreGeneration(chatID int64, msgID int, user *User, gen *Generation) (ModelConfig, bool) {
+	modelConf := b.GetModelByID(gen.ModelID)
+	if modelConf.ID == "" || !modelConf.Enabled {
+		b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "model_unavailable"), nil)
+		return ModelConfig{}, false
+	}
+	if !b.UserPlan(user).AllowsTier(modelConf.Tier) {
+		b.ShowModelLocked(chatID, msgID, user, modelConf)
+		return ModelConfig{}, false
+	}
+
+	b.DB.UpdateState(user.ID, "waiting_prompt", modelConf.ID)
+	for k, v := range gen.Settings {
+		b.DB.UpdateDraftConfig(user.ID, k, v)
+	}
+	user.CurrentState = "waiting_prompt"
+	user.SelectedModel = modelConf.ID
+	user.DraftConfig = gen.Settings
+	if user.DraftConfig == nil {
+		user.DraftConfig = make(map[string]interface{})
+	}
+	return modelConf, true
+}
+
+// handleHistoryCallback menangani tombol hist_page|N, hist_view|ID, hist_send|ID dan hist_reuse|ID
+func (b *BotApp) handleHistoryCallback(chatID int64, msgID int, user *User, data string) {
+	parts := strings.SplitN(data, "|", 2)
+	if len(parts) != 2 {
+		return
+	}
+	switch parts[0] {
+	case "hist_page":
+		page, _ := strconv.Atoi(parts[1])
+		b.ShowHistory(chatID, msgID, user, page)
+	case "hist_view":
+		b.ShowGeneration(chatID, msgID, user, parts[1])
+	case "hist_send":
+		b.ResendGeneration(chatID, user, parts[1])
+	case "hist_reuse":
+		b.ReuseGeneration(chatID, msgID, user, parts[1])
+	}
+}
@@ -0,0 +1,336 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// GenerationJob mewakili satu generasi yang sedang berjalan (kredit sudah dipotong)
+type GenerationJob struct {
+	ID           int64
+	GenerationID string // ID unik generasi, dicatat di credit ledger
+	ModelID      string
+	UserID       int64
+	ChatID       int64
+	Cost         int
+	Currency     string // credits | diamonds
+	PaidCost     int    // bagian Cost yang diambil dari paid_credits, di-refund ke saldo yang sama
+	Language     string
+	Started      time.Time
+
+	cancel   context.CancelFunc
+	settled  int32 // 1 = sudah selesai atau sudah di-refund
+	spent    int32 // bagian Cost yang sudah terpakai oleh langkah pipeline yang selesai
+	canceled int32 // 1 = dibatalkan user lewat tombol cancel
+
+	// Pesan "Generating..." yang berisi tombol cancel (lihat cancel.go). Ditulis goroutine
+	// generasi dan dibaca goroutine cancel/webhook, jadi diakses lewat statusMu.
+	statusMu    sync.Mutex
+	statusMsgID int
+	statusText  string
+}
+
+// setStatus menyimpan pesan status yang sedang tampil
+func (j *GenerationJob) setStatus(msgID int, text string) {
+	j.statusMu.Lock()
+	j.statusMsgID, j.statusText = msgID, text
+	j.statusMu.Unlock()
+}
+
+// status mengembalikan pesan status yang sedang tampil (msgID 0 jika tidak ada)
+func (j *GenerationJob) status() (msgID int, text string) {
+	j.statusMu.Lock()
+	defer j.statusMu.Unlock()
+	return j.statusMsgID, j.statusText
+}
+
+// RequestCancel menandai job dibatalkan user lalu membatalkan context-nya.
+// Hanya pemanggil pertama yang mendapat true.
+func (j *GenerationJob) RequestCancel() bool {
+	if !atomic.CompareAndSwapInt32(&j.canceled, 0, 1) {
+		return false
+	}
+	if j.cancel != nil {
+		j.cancel()
+	}
+	return true
+}
+
+// CanceledByUser bernilai true jika job dihentikan lewat tombol cancel, bukan shutdown
+func (j *GenerationJob) CanceledByUser() bool {
+	return atomic.LoadInt32(&j.canceled) == 1
+}
+
+// Spend menandai sebagian biaya sudah terpakai sehingga tidak ikut di-refund
+func (j *GenerationJob) Spend(amount int) {
+	atomic.AddInt32(&j.spent, int32(amount))
+}
+
+// Refundable adalah biaya yang dikembalikan jika job gagal atau dibatalkan sekarang
+func (j *GenerationJob) Refundable() int {
+	return j.Cost - int(atomic.LoadInt32(&j.spent))
+}
+
+// Settle menandai job selesai. Hanya pemanggil pertama yang mendapat true,
+// sehingga refund tidak pernah terjadi dua kali.
+func (j *GenerationJob) Settle() bool {
+	return atomic.CompareAndSwapInt32(&j.settled, 0, 1)
+}
+
+// JobTracker mencatat generasi yang sedang berjalan agar shutdown bisa
+// menunggu, membatalkan dan me-refund job yang tidak sempat selesai.
+type JobTracker struct {
+	mu       sync.Mutex
+	jobs     map[int64]*GenerationJob
+	detached map[string]*GenerationJob // job yang hasilnya datang lewat webhook, per GenerationID
+	nextID   int64
+	draining bool
+	wg       sync.WaitGroup
+}
+
+func NewJobTracker() *JobTracker {
+	return &JobTracker{jobs: make(map[int64]*GenerationJob), detached: make(map[string]*GenerationJob)}
+}
+
+// Start mendaftarkan job baru. Gagal jika bot sedang shutdown atau user
+// sudah menjalankan limit generasi sekaligus (limit <= 0 = tanpa batas).
+func (t *JobTracker) Start(job *GenerationJob, limit int) (context.Context, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.draining {
+		return nil, fmt.Errorf("shutting_down")
+	}
+	if limit > 0 && t.countLocked(job.UserID) >= limit {
+		return nil, fmt.Errorf("too_many_jobs")
+	}
+	t.nextID++
+	ctx, cancel := context.WithCancel(context.Background())
+	job.ID = t.nextID
+	job.Started = time.Now()
+	job.cancel = cancel
+	t.jobs[job.ID] = job
+	t.wg.Add(1)
+	return ctx, nil
+}
+
+// Finish menghapus job dari daftar aktif
+func (t *JobTracker) Finish(job *GenerationJob) {
+	t.mu.Lock()
+	_, ok := t.jobs[job.ID]
+	delete(t.jobs, job.ID)
+	t.mu.Unlock()
+	job.cancel()
+	if ok {
+		t.wg.Done()
+	}
+}
+
+// Detach melepas job dari goroutine-nya karena hasilnya akan datang lewat webhook:
+// shutdown tidak menunggu atau me-refund job ini, tapi job tetap dihitung dalam
+// batas generasi paralel sampai Complete dipanggil.
+func (t *JobTracker) Detach(job *GenerationJob) {
+	t.mu.Lock()
+	_, ok := t.jobs[job.ID]
+	delete(t.jobs, job.ID)
+	if ok {
+		t.detached[job.GenerationID] = job
+	}
+	t.mu.Unlock()
+	if ok {
+		t.wg.Done()
+	}
+}
+
+// Adopt mendaftarkan job webhook dari proses sebelumnya (lihat ReconcileGenerations)
+// sebagai job yang di-detach, supaya ikut dihitung, bisa dibatalkan dan diawasi sweeper
+func (t *JobTracker) Adopt(job *GenerationJob) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.detached[job.GenerationID]; ok {
+		return
+	}
+	t.nextID++
+	job.ID = t.nextID
+	t.detached[job.GenerationID] = job
+}
+
+// Detached mengembalikan salinan daftar job yang menunggu webhook
+func (t *JobTracker) Detached() []*GenerationJob {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var list []*GenerationJob
+	for _, job := range t.detached {
+		list = append(list, job)
+	}
+	return list
+}
+
+// Complete menghapus job yang di-detach setelah hasilnya diproses dan mengembalikannya
+// (nil jika job tidak ada, mis. setelah restart)
+func (t *JobTracker) Complete(generationID string) *GenerationJob {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	job := t.detached[generationID]
+	delete(t.detached, generationID)
+	return job
+}
+
+// Find mencari job yang masih berjalan (termasuk yang di-detach) berdasarkan GenerationID
+func (t *JobTracker) Find(generationID string) (job *GenerationJob, detached bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, j := range t.jobs {
+		if j.GenerationID == generationID {
+			return j, false
+		}
+	}
+	if j, ok := t.detached[generationID]; ok {
+		return j, true
+	}
+	return nil, false
+}
+
+// Count mengembalikan jumlah generasi user yang sedang berjalan
+func (t *JobTracker) Count(userID int64) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.countLocked(userID)
+}
+
+func (t *JobTracker) countLocked(userID int64) int {
+	n := 0
+	for _, job := range t.jobs {
+		if job.UserID == userID {
+			n++
+		}
+	}
+	for _, job := range t.detached {
+		if job.UserID == userID {
+			n++
+		}
+	}
+	return n
+}
+
+// Wait menunggu semua job yang terdaftar selesai
+func (t *JobTracker) Wait() {
+	t.wg.Wait()
+}
+
+// Drain menolak job baru (dipanggil saat shutdown dimulai)
+func (t *JobTracker) Drain() {
+	t.mu.Lock()
+	t.draining = true
+	t.mu.Unlock()
+}
+
+// Draining mengembalikan true jika bot sedang shutdown
+func (t *JobTracker) Draining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+// CancelAll membatalkan context semua job yang masih berjalan
+func (t *JobTracker) CancelAll() {
+	for _, job := range t.Active() {
+		job.cancel()
+	}
+}
+
+// Active mengembalikan salinan daftar job yang masih berjalan
+func (t *JobTracker) Active() []*GenerationJob {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var list []*GenerationJob
+	for _, job := range t.jobs {
+		list = append(list, job)
+	}
+	return list
+}
+
+// Shutdown berhenti menerima generasi baru, menunggu update & generasi yang
+// sedang berjalan sampai deadline, lalu membatalkan dan me-refund sisanya.
+func (b *BotApp) Shutdown(timeout time.Duration) {
+	b.Jobs.Drain()
+
+	// Generasi berjalan di luar dispatcher, jadi keduanya ditunggu
+	wait := func() {
+		b.Dispatcher.Wait()
+		b.Jobs.Wait()
+	}
+	if waitTimeout(wait, timeout) {
+		fmt.Println("[INFO] All in-flight updates finished.")
+		return
+	}
+
+	active := b.Jobs.Active()
+	fmt.Printf("[WARN] Shutdown deadline reached, cancelling %d generation(s)...\n", len(active))
+	b.Jobs.CancelAll()
+
+	// Beri waktu singkat agar job yang dibatalkan menjalankan refund-nya sendiri
+	if waitTimeout(wait, 10*time.Second) {
+		return
+	}
+
+	for _, job := range b.Jobs.Active() {
+		b.refundJob(job)
+	}
+}
+
+// refundJob mengembalikan kredit job yang belum selesai dan memberi tahu user
+func (b *BotApp) refundJob(job *GenerationJob) {
+	if !job.Settle() {
+		return
+	}
+	amount := job.Refundable()
+	if err := b.refundCost(job, "interrupted"); err != nil {
+		return
+	}
+	b.TG.SendMessage(job.ChatID, b.I18n.Get(job.Language, "gen_interrupted", b.FormatAmount(job.Language, amount, job.Currency)), nil)
+}
+
+// refundCost mengembalikan biaya job yang belum terpakai ke mata uang (dan saldo gratis/dibeli) asalnya
+func (b *BotApp) refundCost(job *GenerationJob, reason string) error {
+	amount := job.Refundable()
+	if amount <= 0 {
+		return nil
+	}
+	meta := job.creditMeta(reason)
+	meta.Paid = min(meta.Paid, amount)
+
+	var err error
+	if job.Currency == CurrencyDiamonds {
+		err = b.DB.AddDiamonds(job.UserID, amount, TxRefund, meta)
+	} else {
+		err = b.DB.AddCredit(job.UserID, amount, TxRefund, meta)
+	}
+	if err != nil {
+		fmt.Printf("[ERROR] Refund failed | User: %d | Cost: %d %s | %v\n", job.UserID, amount, job.Currency, err)
+		return err
+	}
+	fmt.Printf("[INFO] Refunded %d %s to user %d (%s)\n", amount, job.Currency, job.UserID, reason)
+	return nil
+}
+
+func (j *GenerationJob) creditMeta(reason string) CreditMeta {
+	return CreditMeta{Reason: reason, ModelID: j.ModelID, GenerationID: j.GenerationID, Paid: j.PaidCost}
+}
+
+func waitTimeout(wait func(), timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
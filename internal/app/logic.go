@@ -1,92 +1,313 @@
 package app
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"strconv"
+	"html"
 	"strings"
 	"time"
-)
 
-func (b *BotApp) CalculateTotalCost(baseCost int, draftConfig map[string]interface{}) int {
-	multiplier := 1
-	if val, ok := draftConfig["num_outputs"]; ok {
-		switch v := val.(type) {
-		case int:
-			multiplier = v
-		case float64:
-			multiplier = int(v)
-		case string:
-			if i, err := strconv.Atoi(v); err == nil {
-				multiplier = i
-			}
-		}
-	}
-	if multiplier < 1 { multiplier = 1 }
-	return baseCost * multiplier
-}
+	"github.com/google/uuid"
+)
 
 func (b *BotApp) ProcessImageGeneration(user *User, chatID int64, prompt string) {
 	// REFRESH DATA USER: Pastikan kita punya data draft terbaru (termasuk foto yang baru diupload)
-	freshUser, err := b.DB.GetOrCreateUser(user.ID)
+	freshUser, err := b.GetUser(user.ID)
 	if err == nil {
 		user = freshUser
 	}
 
+	if strings.HasPrefix(user.SelectedModel, pipelineStatePrefix) {
+		if b.startPipeline(user, chatID, strings.TrimPrefix(user.SelectedModel, pipelineStatePrefix), prompt) {
+			b.DB.ClearState(user.ID)
+		}
+		return
+	}
+
 	modelConf := b.GetModelByID(user.SelectedModel)
 	if modelConf.ID == "" { return }
 
-	totalCost := b.CalculateTotalCost(modelConf.Cost, user.DraftConfig)
-	fmt.Printf("[INFO] Gen Request | User: %d | Cost: %d | Prompt: %s\n", user.ID, totalCost, prompt)
+	if b.startGeneration(user, chatID, modelConf, prompt, user.DraftConfig) {
+		// Draft sudah tersimpan di job, jadi state bisa langsung dibersihkan
+		// (user bisa lanjut /img selagi generasi berjalan)
+		b.DB.ClearState(user.ID)
+	}
+}
+
+// startGeneration memotong biaya, mencatat generasi lalu menjalankannya di luar
+// antrean dispatcher. Dipakai prompt biasa maupun tombol di bawah hasil.
+// Mengembalikan false jika generasi ditolak (pesan sudah dikirim ke user).
+func (b *BotApp) startGeneration(user *User, chatID int64, modelConf ModelConfig, prompt string, settings map[string]interface{}) bool {
+	// Plan bisa kedaluwarsa setelah model dipilih
+	plan := b.UserPlan(user)
+	if !plan.AllowsTier(modelConf.Tier) {
+		b.ShowModelLocked(chatID, 0, user, modelConf)
+		return false
+	}
+
+	quote := b.CalculateTotalCost(modelConf, settings)
+	totalCost, currency := quote.Total, quote.Currency
+	fmt.Printf("[INFO] Gen Request | User: %d | Cost: %d %s | Prompt: %s\n", user.ID, totalCost, currency, prompt)
+
+	job := &GenerationJob{
+		GenerationID: uuid.NewString(),
+		ModelID:      modelConf.ID,
+		UserID:       user.ID,
+		ChatID:       chatID,
+		Cost:         totalCost,
+		Currency:     currency,
+		Language:     user.LanguageCode,
+	}
+	ctx, ok := b.reserveJob(user, plan, job)
+	if !ok {
+		return false
+	}
+
+	gen := Generation{
+		ID:       job.GenerationID,
+		UserID:   user.ID,
+		ChatID:   chatID,
+		ModelID:  modelConf.ID,
+		Prompt:   prompt,
+		Settings: settings,
+		Cost:     totalCost,
+		Currency: currency,
+		PaidCost: job.PaidCost,
+	}
+	if err := b.DB.CreateGeneration(gen); err != nil {
+		fmt.Printf("[ERROR] Save generation %s: %v\n", gen.ID, err)
+	}
 
-	if err := b.DB.DeductCredit(user.ID, totalCost); err != nil {
-		SendMessage(b.BotToken, chatID, fmt.Sprintf("❌ Insufficient Credits. Need: <b>%d</b>, You have: <b>%d</b>", totalCost, user.Credits), nil)
+	go b.runGeneration(ctx, job, user, modelConf, prompt, settings)
+	return true
+}
+
+// reserveJob memotong biaya job lalu mendaftarkannya di JobTracker dengan batas
+// generasi paralel plan user. Biaya dikembalikan jika job tidak jadi berjalan.
+func (b *BotApp) reserveJob(user *User, plan Plan, job *GenerationJob) (context.Context, bool) {
+	chatID := job.ChatID
+
+	// Bot sedang shutdown: tolak sebelum kredit dipotong
+	if b.Jobs.Draining() {
+		b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "bot_restarting"), nil)
+		return nil, false
+	}
+	if b.Jobs.Count(user.ID) >= plan.Concurrency() {
+		b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "too_many_jobs", plan.Concurrency(), plan.Name), nil)
+		return nil, false
+	}
+
+	if job.Currency == CurrencyDiamonds {
+		if err := b.DB.DeductDiamonds(user.ID, job.Cost, job.creditMeta("generation")); err != nil {
+			b.reserveFailed(chatID, user, err, b.I18n.Get(user.LanguageCode, "insufficient_diamonds", job.Cost, user.Diamonds))
+			return nil, false
+		}
+	} else {
+		paidUsed, err := b.DB.DeductCredit(user.ID, job.Cost, job.creditMeta("generation"))
+		if err != nil {
+			b.reserveFailed(chatID, user, err, b.I18n.Get(user.LanguageCode, "insufficient_credits", job.Cost, user.Balance()))
+			return nil, false
+		}
+		job.PaidCost = paidUsed
+	}
+
+	ctx, err := b.Jobs.Start(job, plan.Concurrency())
+	if err != nil {
+		b.refundCost(job, err.Error())
+		if err.Error() == "too_many_jobs" {
+			b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "too_many_jobs", plan.Concurrency(), plan.Name), nil)
+		} else {
+			b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "bot_restarting"), nil)
+		}
+		return nil, false
+	}
+	return ctx, true
+}
+
+// reserveFailed memberi tahu user kenapa biaya generasi gagal dipotong: saldo kurang
+// (insufficient), atau error database yang tidak boleh dilaporkan sebagai saldo kurang
+func (b *BotApp) reserveFailed(chatID int64, user *User, err error, insufficient string) {
+	if errors.Is(err, ErrInsufficientCredits) || errors.Is(err, ErrInsufficientDiamonds) {
+		b.TG.SendMessage(chatID, insufficient, nil)
 		return
 	}
+	fmt.Printf("[ERROR] Deduct cost | User: %d | %v\n", user.ID, err)
+	b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "error_generic"), nil)
+}
 
-	doneChan := make(chan bool)
+// keepChatAction mengirim chat action (mis. upload_photo) setiap 4 detik sampai stop dipanggil
+func (b *BotApp) keepChatAction(ctx context.Context, chatID int64, action string) (stop func()) {
+	done := make(chan bool)
 	go func() {
 		for {
+			b.TG.SendChatAction(chatID, action)
 			select {
-			case <-doneChan:
+			case <-done:
+				return
+			case <-ctx.Done():
 				return
-			default:
-				SendChatAction(b.BotToken, chatID, "upload_photo")
-				time.Sleep(4 * time.Second)
+			case <-time.After(4 * time.Second):
 			}
 		}
 	}()
+	return func() { close(done) }
+}
+
+// runGeneration menjalankan generasi yang kreditnya sudah dipotong sampai hasil terkirim.
+// Dengan webhook Replicate aktif, goroutine berhenti setelah prediction dibuat dan
+// hasilnya dikirim oleh ReplicateWebhookHandler dari data di tabel generations.
+func (b *BotApp) runGeneration(ctx context.Context, job *GenerationJob, user *User, modelConf ModelConfig, prompt string, settings map[string]interface{}) {
+	defer b.Jobs.Finish(job)
+	chatID := job.ChatID
 
-	SendMessage(b.BotToken, chatID, fmt.Sprintf("🎨 <b>Generating...</b>\n(Cost: %d credits)", totalCost), nil)
+	stopAction := b.keepChatAction(ctx, chatID, chatActionFor(modelConf))
 
-	finalInput := user.DraftConfig
-	imageURLs, err := b.Replicate.Generate(modelConf, prompt, finalInput) 
-	
-	doneChan <- true
-	
+	b.sendStatus(job, fmt.Sprintf("🎨 <b>Generating...</b>\n(Cost: %s)", b.FormatAmount(user.LanguageCode, job.Cost, job.Currency)))
+
+	var pred *Prediction
+	var err error
+	if rep, ok := b.replicateWebhooks(modelConf); ok {
+		// Di-detach sebelum submit: webhook bisa datang sebelum submitWebhook selesai.
+		// Submit tidak ikut diputus tombol cancel, karena request yang diputus bisa tetap
+		// membuat prediction tanpa ID-nya sempat tersimpan.
+		b.Jobs.Detach(job)
+		pred, err = b.submitWebhook(context.WithoutCancel(ctx), rep, job.GenerationID, modelConf, prompt, settings)
+		if err == nil {
+			stopAction()
+			if job.CanceledByUser() {
+				// Cancel ditekan selama submit: HandleCancelGeneration belum melihat prediction ID-nya
+				b.cancelPrediction(job)
+			}
+			return
+		}
+		b.Jobs.Complete(job.GenerationID)
+	} else {
+		pred, err = b.Generate(ctx, modelConf, prompt, settings)
+		if err == nil {
+			pred.Output = b.hostOutputs(modelConf, user.ID, pred.Output)
+		}
+	}
+
+	stopAction()
+	b.finishGeneration(job.GenerationID, job.Started, pred, err, ctx.Err() != nil)
+
+	if err != nil && ctx.Err() != nil && !job.CanceledByUser() {
+		// Dibatalkan oleh shutdown
+		fmt.Printf("[ERROR] %v\n", err)
+		logPredictionLogs(err)
+		b.clearStatus(job)
+		b.refundJob(job)
+		return
+	}
+	b.deliverResult(job, user, modelConf, prompt, pred, err)
+}
+
+// deliverResult me-refund generasi yang gagal atau dibatalkan user, atau mengirim hasilnya ke chat job
+func (b *BotApp) deliverResult(job *GenerationJob, user *User, modelConf ModelConfig, prompt string, pred *Prediction, err error) {
+	if err != nil && (job.CanceledByUser() || isCanceled(err)) {
+		b.cancelJob(job)
+		return
+	}
+	b.clearStatus(job)
 	if err != nil {
 		fmt.Printf("[ERROR] %v\n", err)
-		go b.DB.AddCredit(user.ID, totalCost) 
-		SendMessage(b.BotToken, chatID, b.I18n.Get(user.LanguageCode, "error_generic"), nil)
+		logPredictionLogs(err)
+		if job.Settle() {
+			b.refundCost(job, "generation_failed")
+		}
+		b.TG.SendMessage(job.ChatID, b.I18n.Get(user.LanguageCode, "error_generic"), nil)
 		return
 	}
+	job.Settle()
+
+	b.sendOutputs(job.ChatID, user.LanguageCode, job.GenerationID, modelConf, pred.Output, resultCaption(prompt, modelConf.Name), true)
+
+	if len(pred.Output) > 0 {
+		b.completeReferral(user, job.ChatID)
+	}
+}
 
+// resultCaption membuat caption hasil generasi (prompt dipotong & di-escape untuk HTML)
+func resultCaption(prompt, modelName string) string {
 	displayPrompt := prompt
 	if len(displayPrompt) > 200 {
 		displayPrompt = displayPrompt[:197] + "..."
 	}
-	displayPrompt = strings.ReplaceAll(displayPrompt, "<", "&lt;")
-	displayPrompt = strings.ReplaceAll(displayPrompt, ">", "&gt;")
-	displayPrompt = strings.ReplaceAll(displayPrompt, "&", "&amp;")
-	
-	caption := fmt.Sprintf("✨ <b>Result for:</b>\n<code>%s</code>\n\nGenerated by <b>%s</b>", displayPrompt, modelConf.Name)
+	return fmt.Sprintf("✨ <b>Result for:</b>\n<code>%s</code>\n\nGenerated by <b>%s</b>", html.EscapeString(displayPrompt), modelName)
+}
 
-	if len(imageURLs) == 1 {
-		SendPhoto(b.BotToken, chatID, imageURLs[0], caption)
-	} else if len(imageURLs) > 1 {
-		SendMediaGroup(b.BotToken, chatID, imageURLs, caption)
-	} else {
-		SendMessage(b.BotToken, chatID, "No image generated.", nil)
+// sendOutputs mengirim hasil generasi beserta tombol aksinya. Method Telegram
+// dipilih per file dari type model dan ekstensi URL. Album hanya bisa berisi foto
+// dan video dan tidak bisa punya tombol, jadi tombolnya dikirim di pesan terpisah.
+// rerun = false menyembunyikan tombol regenerate/edit (lihat resultButtons).
+func (b *BotApp) sendOutputs(chatID int64, lang, genID string, modelConf ModelConfig, urls []string, caption string, rerun bool) {
+	var kinds []string
+	album := true
+	for _, url := range urls {
+		kind := outputKind(modelConf.Type, url)
+		kinds = append(kinds, kind)
+		// Data URI harus diunggah satu per satu
+		if (kind != OutputPhoto && kind != OutputVideo) || strings.HasPrefix(url, "data:") {
+			album = false
+		}
+	}
+	buttons := b.resultButtons(lang, genID, kinds, rerun)
+
+	switch {
+	case len(urls) == 0:
+		b.TG.SendMessage(chatID, "No image generated.", nil)
+	case len(urls) == 1:
+		if err := b.sendFile(chatID, modelConf, kinds[0], urls[0], caption, buttons); err != nil {
+			fmt.Printf("[ERROR] Send %s output: %v\n", kinds[0], err)
+		}
+	case album:
+		var media []InputMedia
+		for i, url := range urls {
+			media = append(media, InputMedia{Type: kinds[i], Media: url})
+		}
+		b.TG.SendMediaGroup(chatID, media, caption)
+		if len(buttons) > 0 {
+			b.TG.SendMessage(chatID, b.I18n.Get(lang, "result_actions"), buttons)
+		}
+	default:
+		for i, url := range urls {
+			if i > 0 {
+				caption = ""
+			}
+			if err := b.sendFile(chatID, modelConf, kinds[i], url, caption, nil); err != nil {
+				fmt.Printf("[ERROR] Send %s output: %v\n", kinds[i], err)
+			}
+		}
+		if len(buttons) > 0 {
+			b.TG.SendMessage(chatID, b.I18n.Get(lang, "result_actions"), buttons)
+		}
 	}
+}
 
-	go b.DB.ClearState(user.ID)
-}
\ No newline at end of file
+// finishGeneration mencatat hasil akhir generasi ke riwayat. Mengembalikan false
+// jika generasi sudah selesai sebelumnya (mis. webhook duplikat).
+func (b *BotApp) finishGeneration(genID string, started time.Time, pred *Prediction, genErr error, canceled bool) (bool, error) {
+	gen := Generation{
+		ID:         genID,
+		Status:     GenerationSucceeded,
+		DurationMs: time.Since(started).Milliseconds(),
+	}
+	if pred != nil {
+		gen.Input = pred.Input
+		gen.Outputs = pred.Output
+		gen.PredictionID = pred.ID
+	}
+	if genErr != nil {
+		gen.Status = GenerationFailed
+		if canceled {
+			gen.Status = GenerationCanceled
+		}
+		gen.Error = genErr.Error()
+	}
+	updated, err := b.DB.FinishGeneration(gen)
+	if err != nil {
+		fmt.Printf("[ERROR] Update generation %s: %v\n", gen.ID, err)
+	}
+	return updated, err
+}
@@ -0,0 +1,182 @@
+package app
+
+import (
+	"encoding/base64"
+	"fmt"
+	"mime"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// Jenis output generasi, menentukan method Telegram yang dipakai untuk mengirimnya
+const (
+	OutputPhoto     = "photo"
+	OutputVideo     = "video"
+	OutputAnimation = "animation"
+	OutputDocument  = "document"
+)
+
+// Batas waktu default satu generasi; model video di Replicate bisa berjalan beberapa menit
+const (
+	DefaultImageTimeout = 5 * time.Minute
+	DefaultVideoTimeout = 15 * time.Minute
+)
+
+// outputKind menentukan jenis output dari ekstensi file di URL. URL tanpa
+// ekstensi dianggap sesuai type model (video atau gambar).
+func outputKind(modelType, fileURL string) string {
+	if strings.HasPrefix(fileURL, "data:") {
+		mimeType, _, err := decodeDataURI(fileURL)
+		switch {
+		case err != nil:
+			return OutputDocument
+		case mimeType == "image/gif":
+			return OutputAnimation
+		case mimeType == "image/png", mimeType == "image/jpeg", mimeType == "image/webp":
+			return OutputPhoto
+		case strings.HasPrefix(mimeType, "video/"):
+			return OutputVideo
+		}
+		return OutputDocument
+	}
+	p := fileURL
+	if u, err := url.Parse(fileURL); err == nil {
+		p = u.Path
+	}
+	switch strings.ToLower(strings.TrimPrefix(path.Ext(p), ".")) {
+	case "png", "jpg", "jpeg", "webp":
+		return OutputPhoto
+	case "mp4", "mov", "webm", "m4v":
+		return OutputVideo
+	case "gif":
+		return OutputAnimation
+	case "":
+		if modelType == "video" {
+			return OutputVideo
+		}
+		return OutputPhoto
+	default:
+		return OutputDocument
+	}
+}
+
+// chatActionFor mengembalikan chat action yang ditampilkan selama model berjalan
+func chatActionFor(modelConf ModelConfig) string {
+	if modelConf.Type == "video" {
+		return "upload_video"
+	}
+	return "upload_photo"
+}
+
+// GenerationTimeout mengembalikan batas waktu generasi model (timeout_seconds atau default per type)
+func (m ModelConfig) GenerationTimeout() time.Duration {
+	if m.TimeoutSeconds > 0 {
+		return time.Duration(m.TimeoutSeconds) * time.Second
+	}
+	if m.Type == "video" {
+		return DefaultVideoTimeout
+	}
+	return DefaultImageTimeout
+}
+
+// pollInterval mengembalikan jeda antar polling; video jarang selesai dalam hitungan detik
+func (m ModelConfig) pollInterval() time.Duration {
+	if m.Type == "video" {
+		return 5 * time.Second
+	}
+	return 2 * time.Second
+}
+
+// Method dan field Telegram per jenis output untuk upload multipart
+var uploadMethods = map[string][2]string{
+	OutputPhoto:     {"sendPhoto", "photo"},
+	OutputVideo:     {"sendVideo", "video"},
+	OutputAnimation: {"sendAnimation", "animation"},
+	OutputDocument:  {"sendDocument", "document"},
+}
+
+// decodeDataURI mengurai "data:<mime>;base64,<isi>"
+func decodeDataURI(uri string) (string, []byte, error) {
+	header, payload, ok := strings.Cut(strings.TrimPrefix(uri, "data:"), ",")
+	if !ok || !strings.HasSuffix(header, ";base64") {
+		return "", nil, fmt.Errorf("invalid data uri")
+	}
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", nil, err
+	}
+	return strings.TrimSuffix(header, ";base64"), data, nil
+}
+
+// extensionFor mengembalikan ekstensi file untuk mime type, default .bin
+func extensionFor(mimeType string) string {
+	switch mimeType {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/svg+xml":
+		return ".svg"
+	}
+	if exts, _ := mime.ExtensionsByType(mimeType); len(exts) > 0 {
+		return exts[0]
+	}
+	return ".bin"
+}
+
+// hostOutputs menyiapkan output sebelum dicatat dan dikirim (jika Supabase Storage
+// aktif): SVG dari model sanitize_svg disanitasi lalu di-host ulang, dan data URI dari
+// backend self-hosted diunggah agar riwayat menyimpan URL pendek.
+func (b *BotApp) hostOutputs(modelConf ModelConfig, userID int64, urls []string) []string {
+	if b.SupabaseURL == "" {
+		return urls
+	}
+	out := make([]string, len(urls))
+	for i, u := range urls {
+		out[i] = u
+		var err error
+		switch {
+		case modelConf.SanitizeSVG && isSVGURL(u):
+			out[i], err = b.rehostSVG(userID, i, u)
+		case strings.HasPrefix(u, "data:"):
+			var mimeType string
+			var data []byte
+			if mimeType, data, err = decodeDataURI(u); err == nil {
+				filename := fmt.Sprintf("%d_%d_%d%s", userID, time.Now().UnixNano(), i, extensionFor(mimeType))
+				out[i], err = b.UploadToStorage(filename, mimeType, data)
+			}
+		}
+		if err != nil {
+			fmt.Printf("[ERROR] Host output %d: %v\n", i, err)
+			out[i] = u
+		}
+	}
+	return out
+}
+
+// sendFile mengirim satu output dengan method Telegram yang sesuai jenisnya.
+// SVG dikirim sebagai dokumen beserta preview PNG.
+func (b *BotApp) sendFile(chatID int64, modelConf ModelConfig, kind, fileURL, caption string, buttons []map[string]string) error {
+	if kind == OutputDocument && isSVGURL(fileURL) {
+		return b.sendSVG(chatID, modelConf, fileURL, caption, buttons)
+	}
+	// Data URI (backend self-hosted tanpa Storage) diunggah langsung ke Telegram
+	if strings.HasPrefix(fileURL, "data:") {
+		mimeType, data, err := decodeDataURI(fileURL)
+		if err != nil {
+			return err
+		}
+		method := uploadMethods[kind]
+		return b.TG.UploadFile(chatID, method[0], method[1], "output"+extensionFor(mimeType), data, caption, buttons)
+	}
+	switch kind {
+	case OutputVideo:
+		return b.TG.SendVideo(chatID, fileURL, caption, buttons)
+	case OutputAnimation:
+		return b.TG.SendAnimation(chatID, fileURL, caption, buttons)
+	case OutputDocument:
+		return b.TG.SendDocument(chatID, fileURL, caption, buttons)
+	default:
+		return b.TG.SendPhoto(chatID, fileURL, caption, buttons)
+	}
+}
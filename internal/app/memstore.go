@@ -0,0 +1,598 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryStore menyimpan semua data di memori. Untuk development dan testing;
+// data hilang saat proses berhenti.
+type MemoryStore struct {
+	mu        sync.Mutex
+	users     map[int64]*User
+	ledger    []CreditTransaction
+	offset    int
+	processed map[int]time.Time
+	callbacks map[string]time.Time
+	payments  map[string]*Payment
+	promos    map[string]*PromoCode
+	redeemed  map[string]map[int64]int // kode -> user -> jumlah penukaran
+	referrals map[int64]*Referral      // referee -> referral
+	gens      []*Generation            // urut dari yang terlama
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:     make(map[int64]*User),
+		processed: make(map[int]time.Time),
+		callbacks: make(map[string]time.Time),
+		payments:  make(map[string]*Payment),
+		promos:    make(map[string]*PromoCode),
+		redeemed:  make(map[string]map[int64]int),
+		referrals: make(map[int64]*Referral),
+	}
+}
+
+// copyUser mengembalikan salinan agar pemanggil tidak mengubah data internal
+func copyUser(u *User) *User {
+	c := *u
+	c.DraftConfig = make(map[string]interface{})
+	raw, _ := json.Marshal(u.DraftConfig)
+	json.Unmarshal(raw, &c.DraftConfig) // round-trip JSON agar tipe sama seperti backend lain
+	return &c
+}
+
+func (m *MemoryStore) userLocked(telegramID int64) *User {
+	user, ok := m.users[telegramID]
+	if !ok {
+		// Jatah awal diberikan oleh ResetAllowance pada periode pertama
+		user = &User{
+			ID:           telegramID,
+			LanguageCode: "en",
+			DraftConfig:  make(map[string]interface{}),
+		}
+		m.users[telegramID] = user
+	}
+	return user
+}
+
+func (m *MemoryStore) logLocked(telegramID int64, currency string, amount, balance int, kind string, meta CreditMeta) {
+	m.ledger = append(m.ledger, CreditTransaction{
+		ID:           int64(len(m.ledger) + 1),
+		UserID:       telegramID,
+		Currency:     currency,
+		Amount:       amount,
+		BalanceAfter: balance,
+		Kind:         kind,
+		Reason:       meta.Reason,
+		ModelID:      meta.ModelID,
+		GenerationID: meta.GenerationID,
+		CreatedAt:    time.Now().UTC().Format(time.RFC3339Nano),
+	})
+}
+
+func (m *MemoryStore) GetOrCreateUser(telegramID int64) (*User, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return copyUser(m.userLocked(telegramID)), nil
+}
+
+func (m *MemoryStore) UpdateState(telegramID int64, state string, modelKey string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user := m.userLocked(telegramID)
+	user.CurrentState = state
+	user.SelectedModel = modelKey
+	user.DraftConfig = make(map[string]interface{})
+	return nil
+}
+
+func (m *MemoryStore) UpdateCurrentState(telegramID int64, state string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.userLocked(telegramID).CurrentState = state
+	return nil
+}
+
+func (m *MemoryStore) UpdateDraftConfig(telegramID int64, key string, value interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.userLocked(telegramID).DraftConfig[key] = value
+	return nil
+}
+
+func (m *MemoryStore) ClearState(telegramID int64) error {
+	return m.UpdateState(telegramID, "", "")
+}
+
+func (m *MemoryStore) DeductCredit(telegramID int64, amount int, meta CreditMeta) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user := m.userLocked(telegramID)
+	if user.Balance() < amount {
+		return 0, ErrInsufficientCredits
+	}
+	freeUsed := amount
+	if user.Credits < freeUsed {
+		freeUsed = user.Credits
+	}
+	user.Credits -= freeUsed
+	user.PaidCredits -= amount - freeUsed
+	m.logLocked(telegramID, CurrencyCredits, -amount, user.Balance(), TxDebit, meta)
+	return amount - freeUsed, nil
+}
+
+func (m *MemoryStore) AddCredit(telegramID int64, amount int, kind string, meta CreditMeta) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[telegramID]
+	if !ok {
+		return fmt.Errorf("user_not_found")
+	}
+	user.Credits += amount - meta.Paid
+	user.PaidCredits += meta.Paid
+	m.logLocked(telegramID, CurrencyCredits, amount, user.Balance(), kind, meta)
+	return nil
+}
+
+func (m *MemoryStore) DeductDiamonds(telegramID int64, amount int, meta CreditMeta) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user := m.userLocked(telegramID)
+	if user.Diamonds < amount {
+		return ErrInsufficientDiamonds
+	}
+	user.Diamonds -= amount
+	m.logLocked(telegramID, CurrencyDiamonds, -amount, user.Diamonds, TxDebit, meta)
+	return nil
+}
+
+func (m *MemoryStore) AddDiamonds(telegramID int64, amount int, kind string, meta CreditMeta) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user, ok := m.users[telegramID]
+	if !ok {
+		return fmt.Errorf("user_not_found")
+	}
+	user.Diamonds += amount
+	m.logLocked(telegramID, CurrencyDiamonds, amount, user.Diamonds, kind, meta)
+	return nil
+}
+
+func (m *MemoryStore) ResetAllowance(telegramID int64, lastPeriod, period string, allowance int, topUp bool) (int, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user := m.userLocked(telegramID)
+	if user.LastResetDate != lastPeriod {
+		return user.Credits, false, nil
+	}
+	newCredits := allowance
+	if topUp && user.Credits > allowance {
+		newCredits = user.Credits
+	}
+	if newCredits != user.Credits {
+		delta := newCredits - user.Credits
+		user.Credits = newCredits
+		m.logLocked(telegramID, CurrencyCredits, delta, user.Balance(), TxDailyReset, CreditMeta{Reason: "allowance"})
+	}
+	user.LastResetDate = period
+	return user.Credits, true, nil
+}
+
+func (m *MemoryStore) SetLanguage(telegramID int64, lang string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.userLocked(telegramID).LanguageCode = lang
+	return nil
+}
+
+func (m *MemoryStore) SetPlan(telegramID int64, planID, expiresAt string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	user := m.userLocked(telegramID)
+	user.Plan = planID
+	user.PlanExpiresAt = expiresAt
+	return nil
+}
+
+func (m *MemoryStore) GetCreditHistory(telegramID int64, limit int) ([]CreditTransaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var txs []CreditTransaction
+	for i := len(m.ledger) - 1; i >= 0 && len(txs) < limit; i-- {
+		if m.ledger[i].UserID == telegramID {
+			txs = append(txs, m.ledger[i])
+		}
+	}
+	return txs, nil
+}
+
+func (m *MemoryStore) GetUpdateOffset() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.offset, nil
+}
+
+func (m *MemoryStore) SaveUpdateOffset(offset int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.offset = offset
+	return nil
+}
+
+func (m *MemoryStore) ClaimUpdate(updateID int, callbackID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.processed[updateID]; ok {
+		return false, nil
+	}
+	if _, ok := m.callbacks[callbackID]; ok && callbackID != "" {
+		return false, nil
+	}
+	m.processed[updateID] = time.Now()
+	if callbackID != "" {
+		m.callbacks[callbackID] = time.Now()
+	}
+	return true, nil
+}
+
+func (m *MemoryStore) PruneProcessedUpdates(maxAge time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cutoff := time.Now().Add(-maxAge)
+	for id, at := range m.processed {
+		if at.Before(cutoff) {
+			delete(m.processed, id)
+		}
+	}
+	for id, at := range m.callbacks {
+		if at.Before(cutoff) {
+			delete(m.callbacks, id)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) CreditPurchase(p Payment) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.payments[p.ChargeID]; ok {
+		return false, nil
+	}
+	user := m.userLocked(p.UserID)
+	p.Status = PaymentPaid
+	p.CreatedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	m.payments[p.ChargeID] = &p
+	meta := CreditMeta{Reason: "stars:" + p.ChargeID}
+	if p.Credits > 0 {
+		user.PaidCredits += p.Credits
+		m.logLocked(p.UserID, CurrencyCredits, p.Credits, user.Balance(), TxPurchase, meta)
+	}
+	if p.Diamonds > 0 {
+		user.Diamonds += p.Diamonds
+		m.logLocked(p.UserID, CurrencyDiamonds, p.Diamonds, user.Diamonds, TxPurchase, meta)
+	}
+	if p.PlanID != "" {
+		user.Plan = p.PlanID
+		user.PlanExpiresAt = p.PlanExpiresAt
+	}
+	return true, nil
+}
+
+func (m *MemoryStore) GetPayment(chargeID string) (*Payment, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.payments[chargeID]
+	if !ok {
+		return nil, nil
+	}
+	c := *p
+	return &c, nil
+}
+
+func (m *MemoryStore) RefundPurchase(chargeID string) (int, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.payments[chargeID]
+	if !ok {
+		return 0, 0, fmt.Errorf("payment_not_found")
+	}
+	if p.Status == PaymentRefunded {
+		return 0, 0, fmt.Errorf("already_refunded")
+	}
+	user := m.userLocked(p.UserID)
+	credits := min(p.Credits, user.PaidCredits)
+	diamonds := min(p.Diamonds, user.Diamonds)
+	user.PaidCredits -= credits
+	user.Diamonds -= diamonds
+	p.Status = PaymentRefunded
+	if p.PlanID != "" {
+		var others []string
+		for _, other := range m.payments {
+			if other.UserID == p.UserID && other.PlanID == p.PlanID && other.Status == PaymentPaid {
+				others = append(others, other.PlanExpiresAt)
+			}
+		}
+		if plan, expires, changed := planAfterRefund(user, p, others, time.Now()); changed {
+			user.Plan, user.PlanExpiresAt = plan, expires
+		}
+	}
+	meta := CreditMeta{Reason: "stars:" + chargeID}
+	if credits > 0 {
+		m.logLocked(p.UserID, CurrencyCredits, -credits, user.Balance(), TxPurchaseRefund, meta)
+	}
+	if diamonds > 0 {
+		m.logLocked(p.UserID, CurrencyDiamonds, -diamonds, user.Diamonds, TxPurchaseRefund, meta)
+	}
+	return credits, diamonds, nil
+}
+
+func (m *MemoryStore) CreatePromo(p PromoCode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p.Code = strings.ToUpper(p.Code)
+	if _, ok := m.promos[p.Code]; ok {
+		return fmt.Errorf("promo_exists")
+	}
+	p.Uses = 0
+	p.CreatedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	m.promos[p.Code] = &p
+	return nil
+}
+
+func (m *MemoryStore) ListPromos() ([]PromoCode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var list []PromoCode
+	for _, p := range m.promos {
+		list = append(list, *p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt > list[j].CreatedAt })
+	return list, nil
+}
+
+func (m *MemoryStore) DisablePromo(code string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.promos[strings.ToUpper(code)]
+	if !ok {
+		return false, nil
+	}
+	p.Disabled = true
+	return true, nil
+}
+
+func (m *MemoryStore) RedeemPromo(code string, telegramID int64, planID string) (*PromoCode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	code = strings.ToUpper(code)
+	p, ok := m.promos[code]
+	if !ok {
+		return nil, ErrPromoNotFound
+	}
+	if err := p.check(planID, time.Now()); err != nil {
+		return nil, err
+	}
+	if p.PerUserLimit > 0 && m.redeemed[code][telegramID] >= p.PerUserLimit {
+		return nil, ErrPromoAlreadyUsed
+	}
+
+	if m.redeemed[code] == nil {
+		m.redeemed[code] = make(map[int64]int)
+	}
+	m.redeemed[code][telegramID]++
+	p.Uses++
+
+	m.grantLocked(telegramID, p.Currency, p.Amount, TxPromo, CreditMeta{Reason: "promo:" + code})
+	c := *p
+	return &c, nil
+}
+
+// grantLocked menambah saldo yang tidak ikut reset (paid_credits atau diamonds)
+func (m *MemoryStore) grantLocked(telegramID int64, currency string, amount int, kind string, meta CreditMeta) {
+	user := m.userLocked(telegramID)
+	if currency == CurrencyDiamonds {
+		user.Diamonds += amount
+		m.logLocked(telegramID, CurrencyDiamonds, amount, user.Diamonds, kind, meta)
+		return
+	}
+	user.PaidCredits += amount
+	m.logLocked(telegramID, CurrencyCredits, amount, user.Balance(), kind, meta)
+}
+
+func (m *MemoryStore) CreateReferral(referrerID, refereeID int64) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if referrerID == refereeID {
+		return false, nil
+	}
+	if _, ok := m.users[referrerID]; !ok {
+		return false, nil
+	}
+	if _, ok := m.referrals[refereeID]; ok {
+		return false, nil
+	}
+	for _, tx := range m.ledger {
+		if tx.UserID == refereeID && tx.Kind == TxDebit {
+			return false, nil // sudah pernah generate, bukan user baru
+		}
+	}
+	m.referrals[refereeID] = &Referral{
+		ReferrerID: referrerID,
+		RefereeID:  refereeID,
+		Status:     ReferralPending,
+		CreatedAt:  time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	return true, nil
+}
+
+func (m *MemoryStore) CompleteReferral(refereeID int64, policy ReferralPolicy) (*Referral, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.referrals[refereeID]
+	if !ok || r.Status != ReferralPending {
+		return nil, nil
+	}
+
+	now := time.Now().UTC()
+	total, today := 0, 0
+	for _, other := range m.referrals {
+		if other.ReferrerID != r.ReferrerID || other.Status != ReferralRewarded {
+			continue
+		}
+		total++
+		if t, err := time.Parse(time.RFC3339Nano, other.RewardedAt); err == nil && now.Sub(t) < 24*time.Hour {
+			today++
+		}
+	}
+
+	r.Status = ReferralRewarded
+	if (policy.MaxTotal > 0 && total >= policy.MaxTotal) || (policy.MaxPerDay > 0 && today >= policy.MaxPerDay) {
+		r.Status = ReferralCapped
+	}
+	r.RewardedAt = now.Format(time.RFC3339Nano)
+
+	if policy.RefereeBonus > 0 {
+		m.grantLocked(refereeID, policy.Currency, policy.RefereeBonus, TxReferral, CreditMeta{Reason: fmt.Sprintf("referral:%d", r.ReferrerID)})
+	}
+	if r.Status == ReferralRewarded && policy.ReferrerBonus > 0 {
+		m.grantLocked(r.ReferrerID, policy.Currency, policy.ReferrerBonus, TxReferral, CreditMeta{Reason: fmt.Sprintf("referral:%d", refereeID)})
+	}
+	c := *r
+	return &c, nil
+}
+
+func (m *MemoryStore) ReferralStats(referrerID int64) (int, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	invited, rewarded := 0, 0
+	for _, r := range m.referrals {
+		if r.ReferrerID != referrerID {
+			continue
+		}
+		invited++
+		if r.Status == ReferralRewarded {
+			rewarded++
+		}
+	}
+	return invited, rewarded, nil
+}
+
+// copyGeneration mengembalikan salinan lewat round-trip JSON, sama seperti copyUser
+func copyGeneration(g *Generation) Generation {
+	var c Generation
+	raw, _ := json.Marshal(g)
+	json.Unmarshal(raw, &c)
+	return c
+}
+
+func (m *MemoryStore) findGenerationLocked(id string) *Generation {
+	for _, g := range m.gens {
+		if g.ID == id {
+			return g
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStore) CreateGeneration(g Generation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.findGenerationLocked(g.ID) != nil {
+		return fmt.Errorf("generation_exists")
+	}
+	c := copyGeneration(&g)
+	c.Status = GenerationRunning
+	c.CreatedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	m.gens = append(m.gens, &c)
+	return nil
+}
+
+func (m *MemoryStore) SetGenerationPrediction(id, predictionID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := m.findGenerationLocked(id)
+	if stored == nil {
+		return fmt.Errorf("generation_not_found")
+	}
+	stored.PredictionID = predictionID
+	return nil
+}
+
+func (m *MemoryStore) FinishGeneration(g Generation) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := m.findGenerationLocked(g.ID)
+	if stored == nil {
+		return false, fmt.Errorf("generation_not_found")
+	}
+	if stored.Status != GenerationRunning {
+		return false, nil
+	}
+	c := copyGeneration(&g)
+	stored.Status = c.Status
+	stored.Input = c.Input
+	stored.Outputs = c.Outputs
+	stored.PredictionID = c.PredictionID
+	stored.DurationMs = c.DurationMs
+	stored.Error = c.Error
+	stored.CompletedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	return true, nil
+}
+
+func (m *MemoryStore) GetGeneration(id string) (*Generation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	g := m.findGenerationLocked(id)
+	if g == nil {
+		return nil, nil
+	}
+	c := copyGeneration(g)
+	return &c, nil
+}
+
+func (m *MemoryStore) SetGenerationOutputs(id string, outputs []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored := m.findGenerationLocked(id)
+	if stored == nil {
+		return fmt.Errorf("generation_not_found")
+	}
+	stored.Outputs = append([]string(nil), outputs...)
+	return nil
+}
+
+func (m *MemoryStore) ListRunningGenerations() ([]Generation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var list []Generation
+	for _, g := range m.gens {
+		if g.Status == GenerationRunning {
+			list = append(list, copyGeneration(g))
+		}
+	}
+	return list, nil
+}
+
+func (m *MemoryStore) ListGenerations(telegramID int64, offset, limit int) ([]Generation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var list []Generation
+	skipped := 0
+	for i := len(m.gens) - 1; i >= 0 && len(list) < limit; i-- {
+		if m.gens[i].UserID != telegramID {
+			continue
+		}
+		if skipped < offset {
+			skipped++
+			continue
+		}
+		list = append(list, copyGeneration(m.gens[i]))
+	}
+	return list, nil
+}
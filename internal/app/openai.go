@@ -0,0 +1,123 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// OpenAIBackend memanggil endpoint /images/generations yang kompatibel dengan
+// OpenAI (OpenAI, Azure, LocalAI, dll). Endpoint ini sinkron: Submit langsung
+// mengembalikan prediction yang selesai.
+type OpenAIBackend struct {
+	BaseURL string // mis. https://api.openai.com/v1
+	APIKey  string
+}
+
+// Parameter yang diteruskan apa adanya ke endpoint; sisanya dibuang karena
+// sebagian server menolak field yang tidak dikenal
+var openAIImageParams = []string{"size", "quality", "style", "background", "output_format", "output_compression", "moderation", "response_format"}
+
+// Ukuran untuk aspect_ratio jika model tidak punya parameter size
+var openAIAspectSizes = map[string]string{
+	"1:1":  "1024x1024",
+	"3:2":  "1536x1024",
+	"16:9": "1536x1024",
+	"2:3":  "1024x1536",
+	"9:16": "1024x1536",
+}
+
+func NewOpenAIBackend(baseURL, apiKey string) *OpenAIBackend {
+	if baseURL == "" {
+		baseURL = "https://api.openai.com/v1"
+	}
+	return &OpenAIBackend{BaseURL: strings.TrimRight(baseURL, "/"), APIKey: apiKey}
+}
+
+type openAIImageResponse struct {
+	Created int64 `json:"created"`
+	Data    []struct {
+		URL     string `json:"url"`
+		B64JSON string `json:"b64_json"`
+	} `json:"data"`
+}
+
+func (o *OpenAIBackend) Submit(ctx context.Context, modelConf ModelConfig, input map[string]interface{}) (*Prediction, error) {
+	payload := map[string]interface{}{
+		"model":  modelConf.BackendModel,
+		"prompt": input["prompt"],
+	}
+	if n, ok := input["num_outputs"]; ok {
+		payload["n"] = n
+	}
+	for _, k := range openAIImageParams {
+		if v, ok := input[k]; ok {
+			payload[k] = v
+		}
+	}
+	if _, ok := payload["size"]; !ok {
+		if ratio, ok := input["aspect_ratio"].(string); ok && openAIAspectSizes[ratio] != "" {
+			payload["size"] = openAIAspectSizes[ratio]
+		}
+	}
+
+	client := &http.Client{Timeout: 5 * time.Minute}
+	jsonData, _ := json.Marshal(payload)
+	req, _ := http.NewRequestWithContext(ctx, "POST", o.BaseURL+"/images/generations", bytes.NewBuffer(jsonData))
+	req.Header.Set("Content-Type", "application/json")
+	if o.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+o.APIKey)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("openai status %d: %s", resp.StatusCode, string(body))
+	}
+
+	var raw interface{}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, err
+	}
+	pred := &Prediction{Status: PredictionSucceeded, Output: o.ParseOutput(raw)}
+	if len(pred.Output) == 0 {
+		pred.Status, pred.Error = PredictionFailed, "no output"
+	}
+	return pred, nil
+}
+
+// Poll tidak dipakai: Submit sudah mengembalikan hasil akhir
+func (o *OpenAIBackend) Poll(ctx context.Context, pred *Prediction) error {
+	return nil
+}
+
+// Cancel tidak didukung endpoint sinkron; request dihentikan lewat ctx
+func (o *OpenAIBackend) Cancel(ctx context.Context, pred *Prediction) error {
+	return nil
+}
+
+// ParseOutput mengambil data[].url, atau data[].b64_json sebagai data URI
+func (o *OpenAIBackend) ParseOutput(raw interface{}) []string {
+	content, _ := json.Marshal(raw)
+	var resp openAIImageResponse
+	json.Unmarshal(content, &resp)
+
+	var urls []string
+	for _, d := range resp.Data {
+		if d.URL != "" {
+			urls = append(urls, d.URL)
+		} else if d.B64JSON != "" {
+			urls = append(urls, "data:image/png;base64,"+d.B64JSON)
+		}
+	}
+	return urls
+}
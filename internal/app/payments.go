@@ -0,0 +1,203 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// CreditPack adalah paket kredit dan/atau diamonds yang bisa dibeli dengan Telegram Stars (config/packs.json)
+type CreditPack struct {
+	ID       string `json:"id"`
+	Title    string `json:"title"`
+	Credits  int    `json:"credits"`
+	Diamonds int    `json:"diamonds"`
+	Stars    int    `json:"stars"`
+}
+
+const invoicePayloadPrefix = "pack:"
+
+func loadPacks(path string) ([]CreditPack, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var packs []CreditPack
+	err = json.Unmarshal(content, &packs)
+	return packs, err
+}
+
+func (b *BotApp) GetPackByID(id string) (CreditPack, bool) {
+	for _, p := range b.Packs {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return CreditPack{}, false
+}
+
+// packFromPayload mengurai invoice_payload "pack:<id>"
+func (b *BotApp) packFromPayload(payload string) (CreditPack, bool) {
+	if !strings.HasPrefix(payload, invoicePayloadPrefix) {
+		return CreditPack{}, false
+	}
+	return b.GetPackByID(strings.TrimPrefix(payload, invoicePayloadPrefix))
+}
+
+// packContents menulis isi paket, mis. "50 credits" atau "50 credits + 5 💎"
+func (b *BotApp) packContents(lang string, pack CreditPack) string {
+	var parts []string
+	if pack.Credits > 0 {
+		parts = append(parts, b.FormatAmount(lang, pack.Credits, CurrencyCredits))
+	}
+	if pack.Diamonds > 0 {
+		parts = append(parts, b.FormatAmount(lang, pack.Diamonds, CurrencyDiamonds))
+	}
+	return strings.Join(parts, " + ")
+}
+
+// IsAdmin mengecek apakah user ada di ADMIN_IDS
+func (b *BotApp) IsAdmin(userID int64) bool {
+	return b.Admins[userID]
+}
+
+// ShowCreditPacks menampilkan daftar paket kredit (/buy)
+func (b *BotApp) ShowCreditPacks(chatID int64, user *User) {
+	if len(b.Packs) == 0 {
+		b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "buy_unavailable"), nil)
+		return
+	}
+	var buttons []map[string]string
+	for _, p := range b.Packs {
+		buttons = append(buttons, map[string]string{
+			"text":          b.I18n.Get(user.LanguageCode, "buy_pack_btn", b.packContents(user.LanguageCode, p), p.Stars),
+			"callback_data": "buy_" + p.ID,
+		})
+	}
+	b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "buy_header", user.Balance(), user.Diamonds), buttons)
+}
+
+// SendPackInvoice mengirim invoice XTR untuk paket yang dipilih
+func (b *BotApp) SendPackInvoice(chatID int64, user *User, packID string) {
+	pack, ok := b.GetPackByID(packID)
+	if !ok {
+		b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "error_generic"), nil)
+		return
+	}
+	desc := b.I18n.Get(user.LanguageCode, "invoice_desc", b.packContents(user.LanguageCode, pack))
+	if err := b.TG.SendInvoice(chatID, pack.Title, desc, invoicePayloadPrefix+pack.ID, pack.Stars); err != nil {
+		fmt.Printf("[ERROR] sendInvoice for %d: %v\n", user.ID, err)
+		b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "error_generic"), nil)
+	}
+}
+
+// invoicePrice mengembalikan harga Stars untuk payload paket kredit atau langganan plan
+func (b *BotApp) invoicePrice(payload string) (int, bool) {
+	if pack, ok := b.packFromPayload(payload); ok {
+		return pack.Stars, true
+	}
+	if plan, ok := b.planFromPayload(payload); ok {
+		return plan.Stars, true
+	}
+	return 0, false
+}
+
+// HandlePreCheckout memvalidasi paket dan harga sebelum Telegram menagih Stars
+func (b *BotApp) HandlePreCheckout(update TelegramUpdate) {
+	q := update.PreCheckoutQuery
+	stars, ok := b.invoicePrice(q.InvoicePayload)
+	if !ok || q.Currency != "XTR" || q.TotalAmount != stars {
+		fmt.Printf("[WARN] Rejecting pre-checkout %s | User: %d | Payload: %s | Amount: %d %s\n", q.ID, q.From.ID, q.InvoicePayload, q.TotalAmount, q.Currency)
+		b.TG.AnswerPreCheckoutQuery(q.ID, false, "This item is no longer available. Please use /buy or /plans again.")
+		return
+	}
+	if err := b.TG.AnswerPreCheckoutQuery(q.ID, true, ""); err != nil {
+		fmt.Printf("[ERROR] answerPreCheckoutQuery %s: %v\n", q.ID, err)
+	}
+}
+
+// HandleSuccessfulPayment mencatat pembayaran dan menambah paid_credits/diamonds secara atomik.
+// Charge ID yang sama tidak pernah dikreditkan dua kali.
+func (b *BotApp) HandleSuccessfulPayment(update TelegramUpdate) {
+	userID := update.Message.From.ID
+	chatID := update.Message.Chat.ID
+	sp := update.Message.SuccessfulPayment
+
+	user, err := b.GetUser(userID)
+	if err != nil {
+		fmt.Printf("[ERROR] Payment %s: load user %d: %v\n", sp.TelegramPaymentChargeID, userID, err)
+		return
+	}
+
+	if plan, ok := b.planFromPayload(sp.InvoicePayload); ok {
+		b.completePlanPurchase(chatID, user, plan, sp)
+		return
+	}
+
+	pack, ok := b.packFromPayload(sp.InvoicePayload)
+	if !ok {
+		fmt.Printf("[ERROR] Payment %s has unknown payload %q\n", sp.TelegramPaymentChargeID, sp.InvoicePayload)
+		b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "payment_failed"), nil)
+		return
+	}
+
+	payment := Payment{
+		ChargeID: sp.TelegramPaymentChargeID,
+		UserID:   userID,
+		PackID:   pack.ID,
+		Stars:    sp.TotalAmount,
+		Credits:  pack.Credits,
+		Diamonds: pack.Diamonds,
+	}
+	credited, err := b.DB.CreditPurchase(payment)
+	if err != nil {
+		fmt.Printf("[ERROR] Payment %s: credit user %d: %v\n", payment.ChargeID, userID, err)
+		b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "payment_failed"), nil)
+		return
+	}
+	if !credited {
+		fmt.Printf("[INFO] Payment %s already credited\n", payment.ChargeID)
+		return
+	}
+
+	fmt.Printf("[INFO] Payment %s | User: %d | Pack: %s | +%d credits +%d diamonds\n", payment.ChargeID, userID, pack.ID, pack.Credits, pack.Diamonds)
+	b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "payment_success", b.packContents(user.LanguageCode, pack), user.Balance()+pack.Credits, user.Diamonds+pack.Diamonds), nil)
+}
+
+// handleRefundCommand: /refund <telegram_payment_charge_id> (khusus admin)
+func (b *BotApp) handleRefundCommand(chatID int64, admin *User, chargeID string) {
+	if chargeID == "" {
+		b.TG.SendMessage(chatID, "Usage: <code>/refund CHARGE_ID</code>", nil)
+		return
+	}
+
+	payment, err := b.DB.GetPayment(chargeID)
+	if err != nil || payment == nil {
+		b.TG.SendMessage(chatID, b.I18n.Get(admin.LanguageCode, "refund_not_found"), nil)
+		return
+	}
+	if payment.Status == PaymentRefunded {
+		b.TG.SendMessage(chatID, b.I18n.Get(admin.LanguageCode, "refund_already"), nil)
+		return
+	}
+
+	if err := b.TG.RefundStarPayment(payment.UserID, payment.ChargeID); err != nil {
+		fmt.Printf("[ERROR] refundStarPayment %s: %v\n", chargeID, err)
+		b.TG.SendMessage(chatID, b.I18n.Get(admin.LanguageCode, "refund_failed", err.Error()), nil)
+		return
+	}
+
+	credits, diamonds, err := b.DB.RefundPurchase(chargeID)
+	if err != nil {
+		// Stars sudah dikembalikan Telegram; catat agar bisa dibereskan manual
+		fmt.Printf("[ERROR] Payment %s refunded on Telegram but not in database: %v\n", chargeID, err)
+		b.TG.SendMessage(chatID, b.I18n.Get(admin.LanguageCode, "refund_failed", "refunded on Telegram, DB not updated: "+err.Error()), nil)
+		return
+	}
+	fmt.Printf("[INFO] Refunded payment %s | User: %d | Revoked: %d credits, %d diamonds\n", chargeID, payment.UserID, credits, diamonds)
+	b.TG.SendMessage(chatID, b.I18n.Get(admin.LanguageCode, "refund_done", payment.Stars, payment.UserID, credits, diamonds), nil)
+}
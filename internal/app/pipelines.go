@@ -0,0 +1,341 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Awalan selected_model saat user memilih pipeline, mis. "pipeline:pro-cutout"
+const pipelineStatePrefix = "pipeline:"
+
+// PipelineStep adalah satu model dalam pipeline. Input menimpa default parameter model.
+type PipelineStep struct {
+	Model string                 `json:"model"`
+	Input map[string]interface{} `json:"input"`
+}
+
+// Pipeline menjalankan beberapa model berurutan (config/pipelines.json). Langkah
+// pertama menerima prompt, langkah berikutnya menerima output langkah sebelumnya
+// lewat image_parameter_name modelnya.
+type Pipeline struct {
+	ID          string         `json:"id"`
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Steps       []PipelineStep `json:"steps"`
+}
+
+// pipelineRun adalah langkah pipeline yang sudah dilengkapi model, setting dan biayanya
+type pipelineRun struct {
+	model    ModelConfig
+	settings map[string]interface{}
+	cost     int
+}
+
+func loadPipelines(path string, models []ModelConfig) ([]Pipeline, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pipelines []Pipeline
+	if err := json.Unmarshal(content, &pipelines); err != nil {
+		return nil, err
+	}
+
+	byID := make(map[string]ModelConfig)
+	for _, m := range models {
+		byID[m.ID] = m
+	}
+	for _, p := range pipelines {
+		if len(p.Steps) == 0 {
+			return nil, fmt.Errorf("pipeline %s has no steps", p.ID)
+		}
+		currency := ""
+		for i, step := range p.Steps {
+			m, ok := byID[step.Model]
+			if !ok {
+				return nil, fmt.Errorf("pipeline %s: unknown model %s", p.ID, step.Model)
+			}
+			if i > 0 && !m.AcceptsImageInput {
+				return nil, fmt.Errorf("pipeline %s: model %s does not accept image input", p.ID, m.ID)
+			}
+			// Biaya dipotong sekaligus di awal, jadi semua langkah harus satu mata uang
+			stepCurrency := CurrencyCredits
+			if m.DiamondCost > 0 {
+				stepCurrency = CurrencyDiamonds
+			}
+			if currency != "" && stepCurrency != currency {
+				return nil, fmt.Errorf("pipeline %s mixes credits and diamonds", p.ID)
+			}
+			currency = stepCurrency
+		}
+	}
+	return pipelines, nil
+}
+
+func (b *BotApp) GetPipelineByID(id string) (Pipeline, bool) {
+	for _, p := range b.Pipelines {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return Pipeline{}, false
+}
+
+// preparePipeline melengkapi setiap langkah dengan model, setting dan biayanya.
+// Mengembalikan model pertama yang tidak tersedia jika ada.
+func (b *BotApp) preparePipeline(p Pipeline) ([]pipelineRun, ModelConfig, bool) {
+	var runs []pipelineRun
+	for _, step := range p.Steps {
+		m := b.GetModelByID(step.Model)
+		if m.ID == "" || !m.Enabled {
+			return nil, m, false
+		}
+		settings := make(map[string]interface{})
+		for _, param := range m.Parameters {
+			if param.Default != nil {
+				settings[param.Name] = param.Default
+			}
+		}
+		for k, v := range step.Input {
+			settings[k] = v
+		}
+		runs = append(runs, pipelineRun{model: m, settings: settings, cost: b.CalculateTotalCost(m, settings).Total})
+	}
+	return runs, ModelConfig{}, true
+}
+
+// pipelineQuote menjumlahkan biaya semua langkah
+func pipelineQuote(runs []pipelineRun) (int, string) {
+	total := 0
+	currency := CurrencyCredits
+	for _, r := range runs {
+		total += r.cost
+		if r.model.DiamondCost > 0 {
+			currency = CurrencyDiamonds
+		}
+	}
+	return total, currency
+}
+
+// pipelineStepNames menulis urutan langkah, mis. "Flux Pro → Recraft Upscaler"
+func pipelineStepNames(runs []pipelineRun) string {
+	var names []string
+	for _, r := range runs {
+		names = append(names, r.model.Name)
+	}
+	return strings.Join(names, " → ")
+}
+
+// lockedStep mengembalikan model pertama di pipeline yang tier-nya tidak termasuk plan
+func lockedStep(plan Plan, runs []pipelineRun) (ModelConfig, bool) {
+	for _, r := range runs {
+		if !plan.AllowsTier(r.model.Tier) {
+			return r.model, true
+		}
+	}
+	return ModelConfig{}, false
+}
+
+// ShowPipelineList menampilkan daftar pipeline yang bisa dipilih
+func (b *BotApp) ShowPipelineList(chatID int64, msgID int, user *User) {
+	plan := b.UserPlan(user)
+	var buttons []map[string]string
+	for _, p := range b.Pipelines {
+		runs, _, ok := b.preparePipeline(p)
+		if !ok {
+			continue
+		}
+		total, currency := pipelineQuote(runs)
+		label := fmt.Sprintf("%s (%d Cr)", p.Name, total)
+		if currency == CurrencyDiamonds {
+			label = fmt.Sprintf("%s (%d 💎)", p.Name, total)
+		}
+		if _, locked := lockedStep(plan, runs); locked {
+			label = "🔒 " + label
+		}
+		buttons = append(buttons, map[string]string{"text": label, "callback_data": "pipe_" + p.ID})
+	}
+	buttons = append(buttons, map[string]string{"text": b.I18n.Get(user.LanguageCode, "back_to_prov"), "callback_data": "nav_providers"})
+
+	text := b.I18n.Get(user.LanguageCode, "pipelines_header")
+	if len(buttons) == 1 {
+		text = b.I18n.Get(user.LanguageCode, "model_unavailable")
+	}
+	b.TG.EditMessageText(chatID, msgID, text, buttons)
+}
+
+// SelectPipeline memilih pipeline sebagai "model" aktif lalu menunggu prompt
+func (b *BotApp) SelectPipeline(chatID int64, msgID int, user *User, id string) {
+	p, ok := b.GetPipelineByID(id)
+	if !ok {
+		b.TG.EditMessageText(chatID, msgID, b.I18n.Get(user.LanguageCode, "model_unavailable"), nil)
+		return
+	}
+	runs, _, ok := b.preparePipeline(p)
+	if !ok {
+		b.TG.EditMessageText(chatID, msgID, b.I18n.Get(user.LanguageCode, "model_unavailable"), nil)
+		return
+	}
+	if m, locked := lockedStep(b.UserPlan(user), runs); locked {
+		b.ShowModelLocked(chatID, msgID, user, m)
+		return
+	}
+
+	b.DB.UpdateState(user.ID, "waiting_prompt", pipelineStatePrefix+p.ID)
+
+	total, currency := pipelineQuote(runs)
+	text := b.I18n.Get(user.LanguageCode, "pipeline_panel", p.Name, p.Description, pipelineStepNames(runs),
+		b.FormatAmount(user.LanguageCode, total, currency), user.Balance(), user.Diamonds)
+	buttons := []map[string]string{
+		{"text": b.I18n.Get(user.LanguageCode, "back_btn"), "callback_data": "nav_pipelines"},
+		{"text": b.I18n.Get(user.LanguageCode, "cancel_btn"), "callback_data": "nav_cancel"},
+	}
+	b.TG.EditMessageText(chatID, msgID, text, buttons)
+}
+
+// startPipeline memotong total biaya semua langkah di awal lalu menjalankan pipeline
+// di luar antrean dispatcher. Mengembalikan false jika ditolak.
+func (b *BotApp) startPipeline(user *User, chatID int64, id string, prompt string) bool {
+	p, ok := b.GetPipelineByID(id)
+	if !ok {
+		b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "model_unavailable"), nil)
+		return false
+	}
+	runs, _, ok := b.preparePipeline(p)
+	if !ok {
+		b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "model_unavailable"), nil)
+		return false
+	}
+	plan := b.UserPlan(user)
+	if m, locked := lockedStep(plan, runs); locked {
+		b.ShowModelLocked(chatID, 0, user, m)
+		return false
+	}
+
+	total, currency := pipelineQuote(runs)
+	fmt.Printf("[INFO] Pipeline Request | User: %d | Pipeline: %s | Cost: %d %s | Prompt: %s\n", user.ID, p.ID, total, currency, prompt)
+
+	job := &GenerationJob{
+		GenerationID: uuid.NewString(),
+		ModelID:      pipelineStatePrefix + p.ID,
+		UserID:       user.ID,
+		ChatID:       chatID,
+		Cost:         total,
+		Currency:     currency,
+		Language:     user.LanguageCode,
+	}
+	ctx, ok := b.reserveJob(user, plan, job)
+	if !ok {
+		return false
+	}
+	go b.runPipeline(ctx, job, user, p, runs, prompt)
+	return true
+}
+
+// runPipeline menjalankan langkah demi langkah. Setiap langkah dicatat sebagai
+// generasi tersendiri; jika satu langkah gagal, biaya langkah yang belum selesai
+// dikembalikan dan output terakhir yang berhasil tetap dikirim.
+func (b *BotApp) runPipeline(ctx context.Context, job *GenerationJob, user *User, p Pipeline, runs []pipelineRun, prompt string) {
+	defer b.Jobs.Finish(job)
+	chatID := job.ChatID
+	lang := user.LanguageCode
+
+	// Chat action mengikuti langkah terakhir (mis. pipeline yang berakhir di model video)
+	stopAction := b.keepChatAction(ctx, chatID, chatActionFor(runs[len(runs)-1].model))
+	defer stopAction()
+
+	b.sendStatus(job, b.I18n.Get(lang, "pipeline_started", p.Name, pipelineStepNames(runs), b.FormatAmount(lang, job.Cost, job.Currency)))
+
+	var outputs []string
+	lastGenID := ""
+	for i, run := range runs {
+		if i > 0 {
+			b.TG.SendMessage(chatID, b.I18n.Get(lang, "pipeline_step", i+1, len(runs), run.model.Name), nil)
+			// Output langkah sebelumnya menjadi gambar input langkah ini
+			if run.model.AcceptsMultipleImages {
+				var images []interface{}
+				for _, url := range outputs {
+					images = append(images, url)
+				}
+				run.settings[imageParam(run.model)] = images
+			} else {
+				run.settings[imageParam(run.model)] = outputs[0]
+			}
+		}
+
+		// Langkah pertama memakai generation_id job agar tercatat sama di ledger
+		genID := job.GenerationID
+		if i > 0 {
+			genID = uuid.NewString()
+		}
+		gen := Generation{
+			ID:       genID,
+			UserID:   user.ID,
+			ChatID:   chatID,
+			ModelID:  run.model.ID,
+			Prompt:   prompt,
+			Settings: run.settings,
+			Cost:     run.cost,
+			Currency: job.Currency,
+		}
+		if err := b.DB.CreateGeneration(gen); err != nil {
+			fmt.Printf("[ERROR] Save generation %s: %v\n", gen.ID, err)
+		}
+
+		started := time.Now()
+		pred, err := b.Generate(ctx, run.model, prompt, run.settings)
+		if err == nil && len(pred.Output) == 0 {
+			err = fmt.Errorf("no output")
+		}
+		if err == nil {
+			pred.Output = b.hostOutputs(run.model, user.ID, pred.Output)
+		}
+		b.finishGeneration(genID, started, pred, err, ctx.Err() != nil)
+
+		if err != nil {
+			fmt.Printf("[ERROR] Pipeline %s step %d (%s): %v\n", p.ID, i+1, run.model.ID, err)
+			logPredictionLogs(err)
+			if job.CanceledByUser() {
+				// Langkah yang sudah selesai tetap terpakai
+				b.cancelJob(job)
+				if len(outputs) > 0 {
+					b.sendOutputs(chatID, lang, lastGenID, runs[i-1].model, outputs, resultCaption(prompt, runs[i-1].model.Name), false)
+				}
+				return
+			}
+			b.clearStatus(job)
+			if ctx.Err() != nil {
+				// Dibatalkan oleh shutdown
+				b.refundJob(job)
+				return
+			}
+			refund := job.Refundable()
+			if job.Settle() {
+				b.refundCost(job, "pipeline_failed")
+			}
+			if len(outputs) > 0 {
+				b.sendOutputs(chatID, lang, lastGenID, runs[i-1].model, outputs, resultCaption(prompt, runs[i-1].model.Name), false)
+			}
+			b.TG.SendMessage(chatID, b.I18n.Get(lang, "pipeline_failed", i+1, run.model.Name, b.FormatAmount(lang, refund, job.Currency)), nil)
+			return
+		}
+
+		job.Spend(run.cost)
+		outputs = pred.Output
+		lastGenID = genID
+	}
+	job.Settle()
+	b.clearStatus(job)
+
+	b.sendOutputs(chatID, lang, lastGenID, runs[len(runs)-1].model, outputs, resultCaption(prompt, p.Name), false)
+	b.completeReferral(user, chatID)
+}
@@ -0,0 +1,230 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+	_ "time/tzdata" // agar zona waktu plan tetap bisa dimuat di container minimal
+)
+
+// DailyCredits adalah jatah default plan gratis
+const DailyCredits = 5
+
+// Periode reset jatah kredit gratis
+const (
+	ResetDaily  = "daily"
+	ResetWeekly = "weekly"
+	ResetNone   = "none"
+)
+
+// Mode reset: replace = saldo gratis di-set ke allowance, topup = hanya diisi sampai allowance
+const (
+	ResetReplace = "replace"
+	ResetTopUp   = "topup"
+)
+
+// Tier model (field "tier" di config/models.json)
+const (
+	TierBasic    = "basic"
+	TierStandard = "standard"
+	TierPremium  = "premium"
+)
+
+// Plan mengatur jatah kredit gratis user, tier model yang boleh dipakai dan
+// jumlah generasi paralel. Kredit yang dibeli (paid_credits) disimpan terpisah
+// dan tidak pernah tersentuh reset.
+type Plan struct {
+	ID            string   `json:"id"`
+	Name          string   `json:"name"`
+	Allowance     int      `json:"allowance"`
+	ResetPeriod   string   `json:"reset_period"`
+	Timezone      string   `json:"timezone"`
+	ResetMode     string   `json:"reset_mode"`
+	Tiers         []string `json:"tiers"`          // kosong = semua tier
+	MaxConcurrent int      `json:"max_concurrent"` // generasi paralel per user, 0 = 1
+	Stars         int      `json:"stars"`          // harga langganan, 0 = tidak dijual lewat /plans
+	DurationDays  int      `json:"duration_days"`  // masa aktif satu kali pembelian
+
+	location *time.Location
+}
+
+// DefaultPlan dipakai jika config/plans.json tidak ada (perilaku lama: 5 kredit, reset tiap tengah malam UTC)
+var DefaultPlan = Plan{ID: "free", Name: "Free", Allowance: DailyCredits, ResetPeriod: ResetDaily, Timezone: "UTC", ResetMode: ResetReplace}
+
+// AllowsTier mengecek apakah model dengan tier tertentu boleh dipakai di plan ini.
+// Model tanpa tier selalu boleh.
+func (p Plan) AllowsTier(tier string) bool {
+	if len(p.Tiers) == 0 || tier == "" {
+		return true
+	}
+	for _, t := range p.Tiers {
+		if t == tier {
+			return true
+		}
+	}
+	return false
+}
+
+// Concurrency adalah jumlah generasi yang boleh berjalan bersamaan untuk satu user
+func (p Plan) Concurrency() int {
+	if p.MaxConcurrent <= 0 {
+		return 1
+	}
+	return p.MaxConcurrent
+}
+
+// Purchasable mengembalikan true jika plan bisa dibeli dengan Telegram Stars
+func (p Plan) Purchasable() bool {
+	return p.Stars > 0 && p.DurationDays > 0
+}
+
+// PeriodKey mengembalikan kunci periode reset saat ini. Reset terjadi saat kunci
+// ini berbeda dengan last_reset_date user.
+func (p Plan) PeriodKey(now time.Time) string {
+	loc := p.location
+	if loc == nil {
+		loc = time.UTC
+	}
+	local := now.In(loc)
+	switch p.ResetPeriod {
+	case ResetWeekly:
+		year, week := local.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	case ResetNone:
+		return ResetNone
+	default:
+		return local.Format("2006-01-02")
+	}
+}
+
+// PlanBook berisi semua plan yang dimuat dari config
+type PlanBook struct {
+	plans       map[string]Plan
+	order       []string
+	DefaultPlan string
+}
+
+// LoadPlans membaca config/plans.json. Plan pertama menjadi plan default untuk user baru.
+func LoadPlans(path string) (*PlanBook, error) {
+	book := &PlanBook{plans: make(map[string]Plan)}
+
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		book.add(DefaultPlan)
+		book.DefaultPlan = DefaultPlan.ID
+		return book, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var plans []Plan
+	if err := json.Unmarshal(content, &plans); err != nil {
+		return nil, err
+	}
+	if len(plans) == 0 {
+		return nil, fmt.Errorf("%s has no plans", path)
+	}
+	for _, p := range plans {
+		if p.Timezone == "" {
+			p.Timezone = "UTC"
+		}
+		loc, err := time.LoadLocation(p.Timezone)
+		if err != nil {
+			return nil, fmt.Errorf("plan %s: %v", p.ID, err)
+		}
+		p.location = loc
+		book.add(p)
+	}
+	book.DefaultPlan = plans[0].ID
+	return book, nil
+}
+
+func (pb *PlanBook) add(p Plan) {
+	if p.location == nil {
+		p.location = time.UTC
+	}
+	if _, ok := pb.plans[p.ID]; !ok {
+		pb.order = append(pb.order, p.ID)
+	}
+	pb.plans[p.ID] = p
+}
+
+// List mengembalikan semua plan sesuai urutan di config
+func (pb *PlanBook) List() []Plan {
+	var list []Plan
+	for _, id := range pb.order {
+		list = append(list, pb.plans[id])
+	}
+	return list
+}
+
+// Has mengecek apakah plan dengan ID tersebut ada di config
+func (pb *PlanBook) Has(id string) bool {
+	_, ok := pb.plans[id]
+	return ok
+}
+
+// planExpiry mengurai plan_expires_at user. ok = false jika plan tidak kedaluwarsa.
+func planExpiry(user *User) (time.Time, bool) {
+	if user.PlanExpiresAt == "" {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, user.PlanExpiresAt)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// UserPlan mengembalikan plan yang sedang berlaku untuk user
+func (b *BotApp) UserPlan(user *User) Plan {
+	return b.Plans.Get(user.Plan)
+}
+
+// Get mengembalikan plan berdasarkan ID, fallback ke plan default
+func (pb *PlanBook) Get(id string) Plan {
+	if p, ok := pb.plans[id]; ok {
+		return p
+	}
+	return pb.plans[pb.DefaultPlan]
+}
+
+// GetUser mengambil user lalu menerapkan reset jatah kredit sesuai plan-nya.
+// Handler harus memakai ini, bukan DB.GetOrCreateUser langsung.
+func (b *BotApp) GetUser(telegramID int64) (*User, error) {
+	user, err := b.DB.GetOrCreateUser(telegramID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Langganan habis: kembali ke plan default sebelum jatah dihitung
+	if exp, ok := planExpiry(user); ok && user.Plan != "" && !time.Now().Before(exp) {
+		if err := b.DB.SetPlan(telegramID, "", ""); err != nil {
+			fmt.Printf("[ERROR] Expire plan %s for %d: %v\n", user.Plan, telegramID, err)
+		} else {
+			fmt.Printf("[INFO] Plan %s expired for user %d\n", user.Plan, telegramID)
+			user.Plan, user.PlanExpiresAt = "", ""
+		}
+	}
+
+	plan := b.UserPlan(user)
+	period := plan.PeriodKey(time.Now())
+	if user.LastResetDate == period {
+		return user, nil
+	}
+
+	credits, applied, err := b.DB.ResetAllowance(telegramID, user.LastResetDate, period, plan.Allowance, plan.ResetMode == ResetTopUp)
+	if err != nil {
+		fmt.Printf("[ERROR] Allowance reset for %d: %v\n", telegramID, err)
+		return user, nil
+	}
+	if !applied {
+		// Request lain sudah me-reset lebih dulu, ambil data terbaru
+		return b.DB.GetOrCreateUser(telegramID)
+	}
+	user.Credits = credits
+	user.LastResetDate = period
+	return user, nil
+}
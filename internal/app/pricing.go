@@ -0,0 +1,153 @@
+package app
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// CostLine adalah satu komponen biaya yang ditampilkan di panel model
+type CostLine struct {
+	Param string
+	Value string
+	Op    string // "+" (tambahan) atau "×" (pengali)
+	Delta float64
+}
+
+// CostQuote adalah hasil perhitungan biaya satu generasi
+type CostQuote struct {
+	Base     int
+	Currency string
+	Lines    []CostLine
+	Total    int
+}
+
+// defaultPricing dipakai model tanpa field pricing: harga dasar dikali num_outputs
+var defaultPricing = []PricingRule{{Param: "num_outputs", Scale: true}}
+
+// Price mengembalikan harga dasar model dan mata uangnya.
+// Model dengan diamond_cost > 0 dibayar dengan diamonds, sisanya dengan kredit.
+func (m ModelConfig) Price() (int, string) {
+	if m.DiamondCost > 0 {
+		return m.DiamondCost, CurrencyDiamonds
+	}
+	return m.Cost, CurrencyCredits
+}
+
+// validate menolak aturan yang bisa menurunkan harga di bawah harga dasar
+// (tambahan negatif) atau membuatnya tidak masuk akal (pengali <= 0)
+func (r PricingRule) validate() error {
+	for value, add := range r.Add {
+		if add < 0 {
+			return fmt.Errorf("negative add for %s=%s", r.Param, value)
+		}
+	}
+	if r.PerUnit < 0 {
+		return fmt.Errorf("negative per_unit for %s", r.Param)
+	}
+	for value, mul := range r.Multiply {
+		if mul <= 0 {
+			return fmt.Errorf("non-positive multiply for %s=%s", r.Param, value)
+		}
+	}
+	return nil
+}
+
+// paramValue mengambil nilai parameter dari draft, atau default dari models.json
+func (m ModelConfig) paramValue(draftConfig map[string]interface{}, name string) (interface{}, bool) {
+	if val, ok := draftConfig[name]; ok {
+		return val, true
+	}
+	for _, p := range m.Parameters {
+		if p.Name == name && p.Default != nil {
+			return p.Default, true
+		}
+	}
+	return nil, false
+}
+
+func toFloat(val interface{}) (float64, bool) {
+	switch v := val.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// CalculateTotalCost menghitung biaya dari harga dasar dan aturan pricing model.
+// Urutan: harga dasar + tambahan per opsi + biaya per unit, lalu pengali per opsi,
+// lalu scale (mis. num_outputs). Hasil akhir dibulatkan ke atas.
+func (b *BotApp) CalculateTotalCost(modelConf ModelConfig, draftConfig map[string]interface{}) CostQuote {
+	base, currency := modelConf.Price()
+	quote := CostQuote{Base: base, Currency: currency}
+
+	rules := modelConf.Pricing
+	if len(rules) == 0 {
+		rules = defaultPricing
+	}
+
+	type factor struct {
+		line  CostLine
+		value float64
+	}
+	subtotal := float64(base)
+	var factors []factor
+
+	for _, r := range rules {
+		val, ok := modelConf.paramValue(draftConfig, r.Param)
+		if !ok {
+			continue
+		}
+		key := fmt.Sprint(val)
+		num, isNum := toFloat(val)
+
+		if add, ok := r.Add[key]; ok && add > 0 {
+			subtotal += float64(add)
+			quote.Lines = append(quote.Lines, CostLine{Param: r.Param, Value: key, Op: "+", Delta: float64(add)})
+		}
+		if r.PerUnit > 0 && isNum && num > r.Included {
+			extra := (num - r.Included) * r.PerUnit
+			subtotal += extra
+			quote.Lines = append(quote.Lines, CostLine{Param: r.Param, Value: key, Op: "+", Delta: extra})
+		}
+		if mul, ok := r.Multiply[key]; ok && mul > 0 && mul != 1 {
+			factors = append(factors, factor{CostLine{Param: r.Param, Value: key, Op: "×", Delta: mul}, mul})
+		}
+		if r.Scale && isNum && num > 1 {
+			factors = append(factors, factor{CostLine{Param: r.Param, Value: key, Op: "×", Delta: num}, num})
+		}
+	}
+
+	for _, f := range factors {
+		subtotal *= f.value
+		quote.Lines = append(quote.Lines, f.line)
+	}
+
+	// Toleransi kecil agar 0.1 * 30 tidak dibulatkan menjadi 4
+	quote.Total = int(math.Ceil(subtotal - 1e-9))
+	return quote
+}
+
+// FormatBreakdown menulis rincian biaya, mis. "25 base + 5 (resolution 1080p) × 2 (num outputs 2)"
+func (b *BotApp) FormatBreakdown(lang string, quote CostQuote) string {
+	text := b.I18n.Get(lang, "cost_base", quote.Base)
+	for _, l := range quote.Lines {
+		param := strings.ReplaceAll(l.Param, "_", " ")
+		text += fmt.Sprintf(" %s %s (%s %s)", l.Op, strconv.FormatFloat(l.Delta, 'f', -1, 64), param, l.Value)
+	}
+	return text
+}
+
+// FormatAmount menulis jumlah beserta mata uangnya, mis. "5 credits" atau "1 💎"
+func (b *BotApp) FormatAmount(lang string, amount int, currency string) string {
+	if currency == CurrencyDiamonds {
+		return b.I18n.Get(lang, "amount_diamonds", amount)
+	}
+	return b.I18n.Get(lang, "amount_credits", amount)
+}
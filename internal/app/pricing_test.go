@@ -0,0 +1,93 @@
+package app
+
+import "testing"
+
+func TestPricingRuleValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    PricingRule
+		wantErr bool
+	}{
+		{"empty", PricingRule{Param: "resolution"}, false},
+		{"positive add", PricingRule{Param: "resolution", Add: map[string]int{"1080p": 5, "720p": 0}}, false},
+		{"negative add", PricingRule{Param: "resolution", Add: map[string]int{"720p": -5}}, true},
+		{"positive per_unit", PricingRule{Param: "duration", PerUnit: 2, Included: 5}, false},
+		{"negative per_unit", PricingRule{Param: "duration", PerUnit: -1}, true},
+		{"multiply", PricingRule{Param: "quality", Multiply: map[string]float64{"high": 1.5, "low": 0.5}}, false},
+		{"zero multiply", PricingRule{Param: "quality", Multiply: map[string]float64{"free": 0}}, true},
+		{"negative multiply", PricingRule{Param: "quality", Multiply: map[string]float64{"x": -2}}, true},
+		{"scale", PricingRule{Param: "num_outputs", Scale: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.validate()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCalculateTotalCost(t *testing.T) {
+	video := ModelConfig{
+		Cost: 10,
+		Parameters: []ModelParameter{
+			{Name: "resolution", Default: "720p"},
+			{Name: "duration", Default: float64(5)},
+		},
+		Pricing: []PricingRule{
+			{Param: "resolution", Add: map[string]int{"1080p": 5}},
+			{Param: "duration", PerUnit: 2, Included: 5},
+			{Param: "quality", Multiply: map[string]float64{"high": 1.5}},
+			{Param: "num_outputs", Scale: true},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		model     ModelConfig
+		draft     map[string]interface{}
+		wantTotal int
+		wantLines int
+	}{
+		{"defaults", video, map[string]interface{}{}, 10, 0},
+		{"add", video, map[string]interface{}{"resolution": "1080p"}, 15, 1},
+		{"per unit above included", video, map[string]interface{}{"duration": "8"}, 16, 1},
+		{"per unit within included", video, map[string]interface{}{"duration": 3}, 10, 0},
+		{"multiply after add", video, map[string]interface{}{"resolution": "1080p", "quality": "high"}, 23, 2}, // ceil(15 * 1.5)
+		{"scale", video, map[string]interface{}{"num_outputs": float64(3)}, 30, 1},
+		{"all", video, map[string]interface{}{"resolution": "1080p", "duration": 10, "quality": "high", "num_outputs": 2}, 75, 4},
+		{"default pricing scales num_outputs", ModelConfig{Cost: 4}, map[string]interface{}{"num_outputs": 4}, 16, 1},
+		{"diamonds", ModelConfig{Cost: 4, DiamondCost: 2}, map[string]interface{}{"num_outputs": 2}, 4, 1},
+		{"rounding tolerance", ModelConfig{Cost: 0, Pricing: []PricingRule{{Param: "duration", PerUnit: 0.1}}}, map[string]interface{}{"duration": 30}, 3, 1},
+		// Nilai yang lolos dari validate tetap tidak pernah menurunkan harga
+		{"invalid values ignored", ModelConfig{Cost: 10, Pricing: []PricingRule{
+			{Param: "resolution", Add: map[string]int{"720p": -5}},
+			{Param: "quality", Multiply: map[string]float64{"low": 0}},
+			{Param: "duration", PerUnit: -1},
+		}}, map[string]interface{}{"resolution": "720p", "quality": "low", "duration": 10}, 10, 0},
+	}
+
+	b := &BotApp{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quote := b.CalculateTotalCost(tt.model, tt.draft)
+			if quote.Total != tt.wantTotal {
+				t.Errorf("Total = %d, want %d (lines %+v)", quote.Total, tt.wantTotal, quote.Lines)
+			}
+			if len(quote.Lines) != tt.wantLines {
+				t.Errorf("len(Lines) = %d, want %d (%+v)", len(quote.Lines), tt.wantLines, quote.Lines)
+			}
+		})
+	}
+}
+
+func TestCalculateTotalCostCurrency(t *testing.T) {
+	b := &BotApp{}
+	if q := b.CalculateTotalCost(ModelConfig{Cost: 4, DiamondCost: 2}, nil); q.Currency != CurrencyDiamonds || q.Base != 2 {
+		t.Errorf("diamond model quote = %+v", q)
+	}
+	if q := b.CalculateTotalCost(ModelConfig{Cost: 4}, nil); q.Currency != CurrencyCredits || q.Base != 4 {
+		t.Errorf("credit model quote = %+v", q)
+	}
+}
@@ -0,0 +1,226 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// handleRedeem: /redeem CODE
+func (b *BotApp) handleRedeem(chatID int64, user *User, code string) {
+	if code == "" {
+		b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "redeem_usage"), nil)
+		return
+	}
+
+	plan := b.UserPlan(user)
+	promo, err := b.DB.RedeemPromo(code, user.ID, plan.ID)
+	if err != nil {
+		for _, e := range []error{ErrPromoNotFound, ErrPromoExpired, ErrPromoExhausted, ErrPromoAlreadyUsed, ErrPromoNotAllowed} {
+			if errors.Is(err, e) {
+				b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, e.Error()), nil)
+				return
+			}
+		}
+		fmt.Printf("[ERROR] Redeem %s for %d: %v\n", code, user.ID, err)
+		b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "error_generic"), nil)
+		return
+	}
+
+	fmt.Printf("[INFO] Promo %s redeemed | User: %d | +%d %s\n", promo.Code, user.ID, promo.Amount, promo.Currency)
+	b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "redeem_success", b.FormatAmount(user.LanguageCode, promo.Amount, promo.Currency)), nil)
+}
+
+// handlePromoCommand: /promo create|list|disable (khusus admin)
+func (b *BotApp) handlePromoCommand(chatID int64, admin *User, args string) {
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		b.TG.SendMessage(chatID, b.I18n.Get(admin.LanguageCode, "promo_admin_usage"), nil)
+		return
+	}
+
+	switch fields[0] {
+	case "create":
+		promo, err := parsePromo(fields[1:])
+		if err != nil {
+			b.TG.SendMessage(chatID, b.I18n.Get(admin.LanguageCode, "promo_create_failed", html.EscapeString(err.Error())), nil)
+			return
+		}
+		promo.CreatedBy = admin.ID
+		if err := b.DB.CreatePromo(promo); err != nil {
+			b.TG.SendMessage(chatID, b.I18n.Get(admin.LanguageCode, "promo_create_failed", html.EscapeString(err.Error())), nil)
+			return
+		}
+		fmt.Printf("[INFO] Promo %s created by %d\n", promo.Code, admin.ID)
+		b.TG.SendMessage(chatID, b.I18n.Get(admin.LanguageCode, "promo_created", b.formatPromo(admin.LanguageCode, promo)), nil)
+
+	case "list":
+		promos, err := b.DB.ListPromos()
+		if err != nil {
+			fmt.Printf("[ERROR] List promos: %v\n", err)
+			b.TG.SendMessage(chatID, b.I18n.Get(admin.LanguageCode, "error_generic"), nil)
+			return
+		}
+		if len(promos) == 0 {
+			b.TG.SendMessage(chatID, b.I18n.Get(admin.LanguageCode, "promo_list_empty"), nil)
+			return
+		}
+		text := b.I18n.Get(admin.LanguageCode, "promo_list_header")
+		for i, p := range promos {
+			if i == 30 {
+				text += "\n…"
+				break
+			}
+			text += "\n" + b.formatPromo(admin.LanguageCode, p)
+		}
+		b.TG.SendMessage(chatID, text, nil)
+
+	case "disable":
+		if len(fields) < 2 {
+			b.TG.SendMessage(chatID, b.I18n.Get(admin.LanguageCode, "promo_admin_usage"), nil)
+			return
+		}
+		ok, err := b.DB.DisablePromo(fields[1])
+		if err != nil || !ok {
+			b.TG.SendMessage(chatID, b.I18n.Get(admin.LanguageCode, "promo_not_found"), nil)
+			return
+		}
+		b.TG.SendMessage(chatID, b.I18n.Get(admin.LanguageCode, "promo_disabled_ok", html.EscapeString(strings.ToUpper(fields[1]))), nil)
+
+	default:
+		b.TG.SendMessage(chatID, b.I18n.Get(admin.LanguageCode, "promo_admin_usage"), nil)
+	}
+}
+
+// parsePromo mengurai: CODE AMOUNT [credits|diamonds] [uses=N] [per_user=N] [expires=YYYY-MM-DD|Nd] [plans=free,pro]
+func parsePromo(fields []string) (PromoCode, error) {
+	if len(fields) < 2 {
+		return PromoCode{}, fmt.Errorf("need CODE and AMOUNT")
+	}
+	amount, err := strconv.Atoi(fields[1])
+	if err != nil || amount <= 0 {
+		return PromoCode{}, fmt.Errorf("invalid amount %q", fields[1])
+	}
+	promo := PromoCode{
+		Code:         strings.ToUpper(fields[0]),
+		Amount:       amount,
+		Currency:     CurrencyCredits,
+		PerUserLimit: 1,
+	}
+
+	for _, f := range fields[2:] {
+		key, value, hasValue := strings.Cut(f, "=")
+		if !hasValue {
+			if f != CurrencyCredits && f != CurrencyDiamonds {
+				return PromoCode{}, fmt.Errorf("unknown currency %q", f)
+			}
+			promo.Currency = f
+			continue
+		}
+		switch key {
+		case "uses":
+			promo.MaxUses, err = strconv.Atoi(value)
+		case "per_user":
+			promo.PerUserLimit, err = strconv.Atoi(value)
+		case "expires":
+			var exp time.Time
+			exp, err = parseExpiry(value, time.Now())
+			promo.ExpiresAt = exp.UTC().Format(time.RFC3339)
+		case "plans":
+			promo.AllowedPlans = value
+		default:
+			err = fmt.Errorf("unknown option %q", key)
+		}
+		if err != nil {
+			return PromoCode{}, fmt.Errorf("%s: %v", key, err)
+		}
+	}
+	return promo, nil
+}
+
+// parseExpiry menerima jumlah hari ("7d"), tanggal ("2026-12-31", berlaku sampai akhir hari UTC) atau RFC3339
+func parseExpiry(value string, now time.Time) (time.Time, error) {
+	if days, err := strconv.Atoi(strings.TrimSuffix(value, "d")); err == nil && strings.HasSuffix(value, "d") {
+		return now.Add(time.Duration(days) * 24 * time.Hour), nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t.Add(24 * time.Hour), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func (b *BotApp) formatPromo(lang string, p PromoCode) string {
+	line := fmt.Sprintf("<code>%s</code> · %s · %d", html.EscapeString(p.Code), b.FormatAmount(lang, p.Amount, p.Currency), p.Uses)
+	if p.MaxUses > 0 {
+		line += fmt.Sprintf("/%d", p.MaxUses)
+	}
+	line += " used"
+	if p.PerUserLimit > 0 {
+		line += fmt.Sprintf(" · %d/user", p.PerUserLimit)
+	}
+	if p.ExpiresAt != "" {
+		if t, err := time.Parse(time.RFC3339Nano, p.ExpiresAt); err == nil {
+			line += " · exp " + t.UTC().Format("2006-01-02 15:04")
+		}
+	}
+	if p.AllowedPlans != "" {
+		line += " · plans " + html.EscapeString(p.AllowedPlans)
+	}
+	if p.Disabled {
+		line += " · ⛔"
+	}
+	return line
+}
+
+// handleGrantCommand: /grant USER_ID AMOUNT [credits|diamonds] [reason...] (khusus admin)
+func (b *BotApp) handleGrantCommand(chatID int64, admin *User, args string) {
+	fields := strings.Fields(args)
+	if len(fields) < 2 {
+		b.TG.SendMessage(chatID, b.I18n.Get(admin.LanguageCode, "grant_usage"), nil)
+		return
+	}
+	targetID, err1 := strconv.ParseInt(fields[0], 10, 64)
+	amount, err2 := strconv.Atoi(fields[1])
+	if err1 != nil || err2 != nil || amount <= 0 {
+		b.TG.SendMessage(chatID, b.I18n.Get(admin.LanguageCode, "grant_usage"), nil)
+		return
+	}
+
+	currency := CurrencyCredits
+	rest := fields[2:]
+	if len(rest) > 0 && (rest[0] == CurrencyCredits || rest[0] == CurrencyDiamonds) {
+		currency = rest[0]
+		rest = rest[1:]
+	}
+	reason := fmt.Sprintf("admin:%d", admin.ID)
+	if len(rest) > 0 {
+		reason += " " + strings.Join(rest, " ")
+	}
+
+	target, err := b.GetUser(targetID)
+	if err != nil {
+		b.TG.SendMessage(chatID, b.I18n.Get(admin.LanguageCode, "error_generic"), nil)
+		return
+	}
+
+	// Grant masuk ke paid_credits agar tidak hilang saat reset jatah
+	meta := CreditMeta{Reason: reason}
+	if currency == CurrencyDiamonds {
+		err = b.DB.AddDiamonds(targetID, amount, TxGrant, meta)
+	} else {
+		meta.Paid = amount
+		err = b.DB.AddCredit(targetID, amount, TxGrant, meta)
+	}
+	if err != nil {
+		fmt.Printf("[ERROR] Grant %d %s to %d: %v\n", amount, currency, targetID, err)
+		b.TG.SendMessage(chatID, b.I18n.Get(admin.LanguageCode, "error_generic"), nil)
+		return
+	}
+
+	fmt.Printf("[INFO] Grant | Admin: %d | User: %d | +%d %s | %s\n", admin.ID, targetID, amount, currency, reason)
+	b.TG.SendMessage(chatID, b.I18n.Get(admin.LanguageCode, "grant_done", b.FormatAmount(admin.LanguageCode, amount, currency), targetID), nil)
+	b.TG.SendMessage(targetID, b.I18n.Get(target.LanguageCode, "grant_received", b.FormatAmount(target.LanguageCode, amount, currency)), nil)
+}
@@ -0,0 +1,149 @@
+package app
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Batas kirim Bot API: ~30 pesan/detik global, ~1 pesan/detik per chat,
+// dan 20 pesan/menit untuk grup (chat_id negatif).
+const (
+	DefaultGlobalPerSecond = 30
+	DefaultChatInterval    = time.Second
+	DefaultGroupPerMinute  = 20
+)
+
+type chatBudget struct {
+	next   time.Time   // slot kirim berikutnya untuk chat ini
+	window []time.Time // slot yang sudah dipesan dalam 1 menit terakhir (grup)
+}
+
+// SendLimiter mengantrekan pengiriman. Setiap pemanggil memesan slot secara
+// berurutan di bawah mutex lalu tidur sampai slotnya tiba, sehingga antrean
+// bersifat FIFO per chat dan tidak ada pesan yang dibuang.
+type SendLimiter struct {
+	mu             sync.Mutex
+	globalInterval time.Duration
+	chatInterval   time.Duration
+	groupPerMinute int
+	nextGlobal     time.Time
+	chats          map[int64]*chatBudget
+}
+
+func NewSendLimiter(globalPerSecond int, chatInterval time.Duration, groupPerMinute int) *SendLimiter {
+	if globalPerSecond <= 0 {
+		globalPerSecond = DefaultGlobalPerSecond
+	}
+	return &SendLimiter{
+		globalInterval: time.Second / time.Duration(globalPerSecond),
+		chatInterval:   chatInterval,
+		groupPerMinute: groupPerMinute,
+		chats:          make(map[int64]*chatBudget),
+	}
+}
+
+// Wait memblokir sampai chatID boleh menerima pesan berikutnya, atau sampai ctx
+// dibatalkan. chatID 0 berarti hanya budget global yang berlaku.
+func (l *SendLimiter) Wait(ctx context.Context, chatID int64) error {
+	if chatID != 0 {
+		if err := sleepCtx(ctx, time.Until(l.reserveChat(chatID))); err != nil {
+			return err
+		}
+	}
+	return sleepCtx(ctx, time.Until(l.reserveGlobal()))
+}
+
+// sleepCtx tidur selama d kecuali ctx dibatalkan lebih dulu
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (l *SendLimiter) reserveChat(chatID int64) time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if len(l.chats) > 1000 {
+		l.pruneLocked(now)
+	}
+
+	budget, ok := l.chats[chatID]
+	if !ok {
+		budget = &chatBudget{}
+		l.chats[chatID] = budget
+	}
+
+	slot := now
+	if budget.next.After(slot) {
+		slot = budget.next
+	}
+
+	if chatID < 0 && l.groupPerMinute > 0 {
+		// Buang slot yang sudah lewat dari jendela 1 menit
+		cut := 0
+		for cut < len(budget.window) && slot.Sub(budget.window[cut]) >= time.Minute {
+			cut++
+		}
+		budget.window = budget.window[cut:]
+		if len(budget.window) >= l.groupPerMinute {
+			slot = budget.window[len(budget.window)-l.groupPerMinute].Add(time.Minute)
+		}
+		budget.window = append(budget.window, slot)
+	}
+
+	budget.next = slot.Add(l.chatInterval)
+	return slot
+}
+
+func (l *SendLimiter) reserveGlobal() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	slot := time.Now()
+	if l.nextGlobal.After(slot) {
+		slot = l.nextGlobal
+	}
+	l.nextGlobal = slot.Add(l.globalInterval)
+	return slot
+}
+
+// Penalize menunda chat (atau semua kiriman jika chatID 0) setelah Telegram membalas 429
+func (l *SendLimiter) Penalize(chatID int64, retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	until := time.Now().Add(retryAfter)
+	if chatID == 0 {
+		if until.After(l.nextGlobal) {
+			l.nextGlobal = until
+		}
+		return
+	}
+	budget, ok := l.chats[chatID]
+	if !ok {
+		budget = &chatBudget{}
+		l.chats[chatID] = budget
+	}
+	if until.After(budget.next) {
+		budget.next = until
+	}
+}
+
+func (l *SendLimiter) pruneLocked(now time.Time) {
+	for id, budget := range l.chats {
+		if budget.next.Before(now) && (len(budget.window) == 0 || now.Sub(budget.window[len(budget.window)-1]) >= time.Minute) {
+			delete(l.chats, id)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const referralPayloadPrefix = "ref_"
+
+// DefaultReferralPolicy dipakai jika config/referral.json tidak ada
+var DefaultReferralPolicy = ReferralPolicy{
+	Currency:      CurrencyCredits,
+	ReferrerBonus: 5,
+	RefereeBonus:  5,
+	MaxPerDay:     10,
+	MaxTotal:      100,
+}
+
+func loadReferralPolicy(path string) (ReferralPolicy, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return DefaultReferralPolicy, nil
+	}
+	if err != nil {
+		return ReferralPolicy{}, err
+	}
+	policy := DefaultReferralPolicy
+	if err := json.Unmarshal(content, &policy); err != nil {
+		return ReferralPolicy{}, err
+	}
+	if policy.Currency != CurrencyDiamonds {
+		policy.Currency = CurrencyCredits
+	}
+	return policy, nil
+}
+
+// handleStartPayload memproses parameter deep link /start <payload>, mis. "ref_12345"
+func (b *BotApp) handleStartPayload(chatID int64, user *User, payload string) {
+	if !strings.HasPrefix(payload, referralPayloadPrefix) {
+		return
+	}
+	referrerID, err := strconv.ParseInt(strings.TrimPrefix(payload, referralPayloadPrefix), 10, 64)
+	if err != nil {
+		return
+	}
+
+	created, err := b.DB.CreateReferral(referrerID, user.ID)
+	if err != nil {
+		fmt.Printf("[ERROR] Referral %d -> %d: %v\n", referrerID, user.ID, err)
+		return
+	}
+	if !created {
+		fmt.Printf("[INFO] Referral %d -> %d ignored (self, existing or not a new user)\n", referrerID, user.ID)
+		return
+	}
+
+	fmt.Printf("[INFO] Referral %d -> %d recorded\n", referrerID, user.ID)
+	if b.Referral.RefereeBonus > 0 {
+		bonus := b.FormatAmount(user.LanguageCode, b.Referral.RefereeBonus, b.Referral.Currency)
+		b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "referral_joined", bonus), nil)
+	}
+}
+
+// ShowInvite menampilkan link referral user dan statistiknya (/invite)
+func (b *BotApp) ShowInvite(chatID int64, user *User) {
+	if b.Username == "" {
+		b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "invite_unavailable"), nil)
+		return
+	}
+	invited, rewarded, err := b.DB.ReferralStats(user.ID)
+	if err != nil {
+		fmt.Printf("[ERROR] Referral stats for %d: %v\n", user.ID, err)
+	}
+
+	link := fmt.Sprintf("https://t.me/%s?start=%s%d", b.Username, referralPayloadPrefix, user.ID)
+	text := b.I18n.Get(user.LanguageCode, "invite_text",
+		link,
+		b.FormatAmount(user.LanguageCode, b.Referral.ReferrerBonus, b.Referral.Currency),
+		b.FormatAmount(user.LanguageCode, b.Referral.RefereeBonus, b.Referral.Currency),
+		invited, rewarded)
+	b.TG.SendMessage(chatID, text, nil)
+}
+
+// completeReferral memberi bonus referral setelah generasi pertama user yang diundang berhasil
+func (b *BotApp) completeReferral(user *User, chatID int64) {
+	r, err := b.DB.CompleteReferral(user.ID, b.Referral)
+	if err != nil {
+		fmt.Printf("[ERROR] Complete referral for %d: %v\n", user.ID, err)
+		return
+	}
+	if r == nil {
+		return
+	}
+
+	fmt.Printf("[INFO] Referral %d -> %d %s\n", r.ReferrerID, r.RefereeID, r.Status)
+	if b.Referral.RefereeBonus > 0 {
+		bonus := b.FormatAmount(user.LanguageCode, b.Referral.RefereeBonus, b.Referral.Currency)
+		b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "referral_bonus_referee", bonus), nil)
+	}
+	if r.Status == ReferralRewarded && b.Referral.ReferrerBonus > 0 {
+		referrer, err := b.DB.GetOrCreateUser(r.ReferrerID)
+		if err != nil {
+			return
+		}
+		bonus := b.FormatAmount(referrer.LanguageCode, b.Referral.ReferrerBonus, b.Referral.Currency)
+		b.TG.SendMessage(r.ReferrerID, b.I18n.Get(referrer.LanguageCode, "referral_bonus_referrer", bonus), nil)
+	}
+}
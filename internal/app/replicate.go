@@ -2,30 +2,39 @@ package app
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
-	"strconv"
 	"strings"
 	"time"
 )
 
 type ReplicateConfig struct {
 	Token string
+
+	// Jika WebhookURL diisi, generasi biasa dikirim dengan webhook (lihat replicate_webhook.go)
+	WebhookURL    string
+	WebhookSecret string // "whsec_..." dari GET /v1/webhooks/default/secret
 }
 
 type ReplicateRequest struct {
-	Input map[string]interface{} `json:"input"`
+	Input               map[string]interface{} `json:"input"`
+	Webhook             string                 `json:"webhook,omitempty"`
+	WebhookEventsFilter []string               `json:"webhook_events_filter,omitempty"`
 }
 
 type ReplicateResponse struct {
-	ID     string      `json:"id"`
-	Status string      `json:"status"`
-	Output interface{} `json:"output"`
-	Error  interface{} `json:"error"`
+	ID     string                 `json:"id"`
+	Status string                 `json:"status"`
+	Input  map[string]interface{} `json:"input"`
+	Output interface{}            `json:"output"`
+	Error  interface{}            `json:"error"`
+	Logs   string                 `json:"logs"`
 	URLs   struct {
-		Get string `json:"get"`
+		Get    string `json:"get"`
+		Cancel string `json:"cancel"`
 	} `json:"urls"`
 }
 
@@ -33,110 +42,29 @@ func NewReplicate(token string) *ReplicateConfig {
 	return &ReplicateConfig{Token: token}
 }
 
-func (r *ReplicateConfig) Generate(modelConf ModelConfig, userInput string, extraInputs map[string]interface{}) ([]string, error) {
-	client := &http.Client{Timeout: 120 * time.Second}
-	payloadData := make(map[string]interface{})
-
-	// 1. Masukkan Default Parameters
-	for _, param := range modelConf.Parameters {
-		if param.Default != nil {
-			payloadData[param.Name] = param.Default
-		}
-	}
-
-	// 2. Masukkan Input User
-	for k, v := range extraInputs {
-		// KASUS A: Input adalah Array (Multiple Images)
-		if list, ok := v.([]interface{}); ok {
-			var rawURLs []string
-			for _, item := range list {
-				if str, ok := item.(string); ok {
-					// Validasi sederhana: harus ada http
-					if strings.HasPrefix(str, "http") {
-						rawURLs = append(rawURLs, str)
-					}
-				}
-			}
-			// LANGSUNG masukkan sebagai Array of Strings.
-			// Tidak perlu dibungkus object {"value":...} lagi.
-			payloadData[k] = rawURLs
-			continue
-		}
-
-		// KASUS B: Input adalah String Tunggal
-		if strVal, isString := v.(string); isString {
-			// Validasi URL untuk gambar
-			isImageParam := (k == "image_input" || k == "input_images" || k == "reference_images" || k == "image")
-			if isImageParam && !strings.HasPrefix(strVal, "http") {
-				return nil, fmt.Errorf("invalid image URL: %s", strVal)
-			}
-
-			// JIKA parameter ini biasanya butuh Array (seperti image_input), kita bungkus string tunggal jadi Array.
-			if k == "image_input" || k == "input_images" || k == "reference_images" {
-				payloadData[k] = []string{strVal}
-				continue
-			}
-
-			// Type Casting untuk Angka
-			var expectedType string
-			for _, p := range modelConf.Parameters {
-				if p.Name == k {
-					expectedType = p.Type
-					break
-				}
-			}
-
-			if expectedType == "integer" {
-				if intVal, err := strconv.Atoi(strVal); err == nil {
-					payloadData[k] = intVal
-				} else {
-					payloadData[k] = v
-				}
-			} else if expectedType == "number" || expectedType == "float" {
-				if floatVal, err := strconv.ParseFloat(strVal, 64); err == nil {
-					payloadData[k] = floatVal
-				} else {
-					payloadData[k] = v
-				}
-			} else {
-				// String biasa (misal aspect_ratio)
-				payloadData[k] = v
-			}
-		} else {
-			// Boolean atau tipe lain
-			payloadData[k] = v
-		}
-	}
-
-	// 3. Set Prompt
-	payloadData["prompt"] = userInput
-
-	// --- DEBUGGING LOG ---
-	debugJSON, _ := json.MarshalIndent(payloadData, "", "  ")
-	fmt.Printf("[DEBUG] Payload to Replicate:\n%s\n", string(debugJSON))
-	// ---------------------
+// Submit membuat prediction dan menunggu sampai 55 detik (Prefer: wait),
+// jadi model cepat biasanya langsung selesai tanpa polling
+func (r *ReplicateConfig) Submit(ctx context.Context, modelConf ModelConfig, input map[string]interface{}) (*Prediction, error) {
+	return r.create(ctx, modelConf, ReplicateRequest{Input: input})
+}
 
-	reqBody := ReplicateRequest{Input: payloadData}
+func (r *ReplicateConfig) create(ctx context.Context, modelConf ModelConfig, reqBody ReplicateRequest) (*Prediction, error) {
+	client := &http.Client{Timeout: 120 * time.Second}
 	
 	// Parsing ID
-	var apiURL string
-	if strings.HasPrefix(modelConf.ReplicateID, "google/") {
-		parts := strings.Split(modelConf.ReplicateID, "/")
-		apiURL = fmt.Sprintf("https://api.replicate.com/v1/models/%s/%s/predictions", parts[0], parts[1])
-	} else {
-		parts := strings.Split(modelConf.ReplicateID, "/")
-		if len(parts) == 2 {
-			apiURL = fmt.Sprintf("https://api.replicate.com/v1/models/%s/%s/predictions", parts[0], parts[1])
-		} else {
-			return nil, fmt.Errorf("invalid replicate_id format")
-		}
+	parts := strings.Split(modelConf.ReplicateID, "/")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid replicate_id format")
 	}
+	apiURL := fmt.Sprintf("https://api.replicate.com/v1/models/%s/%s/predictions", parts[0], parts[1])
 
 	jsonData, _ := json.Marshal(reqBody)
-	req, _ := http.NewRequest("POST", apiURL, bytes.NewBuffer(jsonData))
+	req, _ := http.NewRequestWithContext(ctx, "POST", apiURL, bytes.NewBuffer(jsonData))
 	req.Header.Set("Authorization", "Bearer "+r.Token)
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Prefer", "wait=55") 
+	if reqBody.Webhook == "" {
+		req.Header.Set("Prefer", "wait=55") 
+	}
 
 	resp, err := client.Do(req)
 	if err != nil { return nil, err }
@@ -151,30 +79,92 @@ func (r *ReplicateConfig) Generate(modelConf ModelConfig, userInput string, extr
 	var result ReplicateResponse
 	json.Unmarshal(bodyBytes, &result)
 
-	if result.Error != nil { return nil, fmt.Errorf("%v", result.Error) }
+	pred := &Prediction{}
+	r.update(pred, result)
+	return pred, nil
+}
 
-	if result.Status == "succeeded" { return parseOutput(result.Output), nil }
+// Poll mengambil status terbaru prediction dari urls.get (atau dari ID-nya, mis. prediction webhook yang dimuat dari database)
+func (r *ReplicateConfig) Poll(ctx context.Context, pred *Prediction) error {
+	pollURL := pred.PollURL
+	if pollURL == "" && pred.ID != "" {
+		pollURL = fmt.Sprintf("https://api.replicate.com/v1/predictions/%s", pred.ID)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	req, _ := http.NewRequestWithContext(ctx, "GET", pollURL, nil)
+	req.Header.Set("Authorization", "Bearer "+r.Token)
+	resp, err := client.Do(req)
+	if err != nil { return err }
+	bodyBytes, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("poll status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
 
-	return r.pollResult(result.URLs.Get)
+	var result ReplicateResponse
+	if err := json.Unmarshal(bodyBytes, &result); err != nil {
+		return fmt.Errorf("decode prediction: %v", err)
+	}
+	r.update(pred, result)
+	return nil
 }
 
-func (r *ReplicateConfig) pollResult(url string) ([]string, error) {
+// Cancel menghentikan prediction lewat urls.cancel (atau dari ID-nya, mis. prediction webhook yang dimuat dari database)
+func (r *ReplicateConfig) Cancel(ctx context.Context, pred *Prediction) error {
+	cancelURL := pred.CancelURL
+	if cancelURL == "" && pred.ID != "" {
+		cancelURL = fmt.Sprintf("https://api.replicate.com/v1/predictions/%s/cancel", pred.ID)
+	}
+	if cancelURL == "" {
+		return nil
+	}
 	client := &http.Client{Timeout: 10 * time.Second}
-	for {
-		time.Sleep(2 * time.Second)
-		req, _ := http.NewRequest("GET", url, nil)
-		req.Header.Set("Authorization", "Bearer "+r.Token)
-		resp, err := client.Do(req)
-		if err != nil { return nil, err }
-		bodyBytes, _ := io.ReadAll(resp.Body)
-		resp.Body.Close()
-		var result ReplicateResponse
-		json.Unmarshal(bodyBytes, &result)
-		
-		fmt.Printf("[INFO] Polling: %s\n", result.Status)
-		if result.Status == "succeeded" { return parseOutput(result.Output), nil }
-		if result.Status == "failed" || result.Status == "canceled" { return nil, fmt.Errorf("failed") }
+	req, _ := http.NewRequestWithContext(ctx, "POST", cancelURL, nil)
+	req.Header.Set("Authorization", "Bearer "+r.Token)
+	resp, err := client.Do(req)
+	if err != nil { return err }
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("cancel status %d: %s", resp.StatusCode, string(body))
 	}
+	return nil
+}
+
+func (r *ReplicateConfig) ParseOutput(raw interface{}) []string {
+	return parseOutput(raw)
+}
+
+// update menyalin respons Replicate ke prediction
+func (r *ReplicateConfig) update(pred *Prediction, result ReplicateResponse) {
+	if result.ID != "" {
+		pred.ID = result.ID
+	}
+	if result.URLs.Get != "" {
+		pred.PollURL = result.URLs.Get
+	}
+	if result.URLs.Cancel != "" {
+		pred.CancelURL = result.URLs.Cancel
+	}
+	if result.Input != nil {
+		pred.Input = result.Input
+	}
+	if result.Logs != "" {
+		pred.Logs = result.Logs
+	}
+	pred.Status = result.Status
+	if result.Error != nil {
+		pred.Status = PredictionFailed
+		pred.Error = fmt.Sprintf("%v", result.Error)
+	}
+	if pred.Status == PredictionSucceeded {
+		pred.Output = r.ParseOutput(result.Output)
+	}
+}
+
+// isFileURL menerima URL publik atau data URI (dipakai saat Supabase Storage tidak aktif)
+func isFileURL(s string) bool {
+	return strings.HasPrefix(s, "http") || strings.HasPrefix(s, "data:")
 }
 
 func parseOutput(output interface{}) []string {
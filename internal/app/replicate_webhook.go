@@ -0,0 +1,350 @@
+package app
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Selisih maksimal webhook-timestamp dengan jam server, mencegah replay webhook lama
+const replicateWebhookTolerance = 5 * time.Minute
+
+// Job webhook yang belum mendapat hasil sampai timeout model + webhookGrace dicek
+// langsung ke Replicate oleh sweeper setiap webhookSweepInterval
+const (
+	webhookGrace         = 5 * time.Minute
+	webhookSweepInterval = time.Minute
+)
+
+// replicateWebhooks mengembalikan backend Replicate jika model memakai Replicate
+// dan webhook aktif (REPLICATE_WEBHOOK_URL)
+func (b *BotApp) replicateWebhooks(modelConf ModelConfig) (*ReplicateConfig, bool) {
+	if modelConf.BackendName() != BackendReplicate {
+		return nil, false
+	}
+	rep, ok := b.Backends[BackendReplicate].(*ReplicateConfig)
+	return rep, ok && rep.WebhookURL != ""
+}
+
+// SubmitWebhook membuat prediction tanpa menunggu hasilnya. Replicate memanggil
+// WebhookURL?generation=<id> saat prediction selesai (berhasil, gagal atau dibatalkan).
+func (r *ReplicateConfig) SubmitWebhook(ctx context.Context, modelConf ModelConfig, input map[string]interface{}, generationID string) (*Prediction, error) {
+	u, err := url.Parse(r.WebhookURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook url: %v", err)
+	}
+	q := u.Query()
+	q.Set("generation", generationID)
+	u.RawQuery = q.Encode()
+	return r.create(ctx, modelConf, ReplicateRequest{Input: input, Webhook: u.String(), WebhookEventsFilter: []string{"completed"}})
+}
+
+// VerifyWebhook memeriksa signature webhook Replicate (format Standard Webhooks):
+// HMAC-SHA256 dari "<webhook-id>.<webhook-timestamp>.<body>" dengan secret whsec_.
+func (r *ReplicateConfig) VerifyWebhook(header http.Header, body []byte, now time.Time) error {
+	id, ts, signatures := header.Get("webhook-id"), header.Get("webhook-timestamp"), header.Get("webhook-signature")
+	if id == "" || ts == "" || signatures == "" {
+		return fmt.Errorf("missing webhook headers")
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid webhook timestamp")
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > replicateWebhookTolerance || d < -replicateWebhookTolerance {
+		return fmt.Errorf("webhook timestamp out of tolerance")
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(r.WebhookSecret, "whsec_"))
+	if err != nil || len(key) == 0 {
+		return fmt.Errorf("invalid webhook secret")
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(id + "." + ts + "."))
+	mac.Write(body)
+	expected := mac.Sum(nil)
+
+	// Header bisa berisi beberapa signature ("v1,<base64> v1,<base64>") saat secret dirotasi
+	for _, sig := range strings.Fields(signatures) {
+		version, value, ok := strings.Cut(sig, ",")
+		if !ok || version != "v1" {
+			continue
+		}
+		if got, err := base64.StdEncoding.DecodeString(value); err == nil && hmac.Equal(got, expected) {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid webhook signature")
+}
+
+// submitWebhook menyusun payload lalu membuat prediction dengan webhook.
+// Prediction ID disimpan agar webhook bisa dicocokkan dengan generasinya.
+func (b *BotApp) submitWebhook(ctx context.Context, rep *ReplicateConfig, generationID string, modelConf ModelConfig, prompt string, extraInputs map[string]interface{}) (*Prediction, error) {
+	input, err := buildInput(modelConf, prompt, extraInputs)
+	if err != nil {
+		return nil, err
+	}
+	pred, err := rep.SubmitWebhook(ctx, modelConf, input, generationID)
+	if pred == nil {
+		pred = &Prediction{}
+	}
+	pred.Input = input
+	if err == nil && pred.ID != "" {
+		if err := b.DB.SetGenerationPrediction(generationID, pred.ID); err != nil {
+			fmt.Printf("[ERROR] Save prediction %s for generation %s: %v\n", pred.ID, generationID, err)
+		}
+	}
+	return pred, err
+}
+
+// ReplicateWebhookHandler menerima webhook "completed" dari Replicate. Hasil
+// dicatat sebelum membalas 200, jadi kegagalan database membuat Replicate
+// mengirim ulang webhook; rehost output dan pengiriman ke Telegram berjalan di background.
+func (b *BotApp) ReplicateWebhookHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		rep, ok := b.Backends[BackendReplicate].(*ReplicateConfig)
+		if !ok || rep.WebhookSecret == "" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := rep.VerifyWebhook(r.Header, body, time.Now()); err != nil {
+			fmt.Println("[WARN] Replicate webhook:", err, "from", r.RemoteAddr)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var result ReplicateResponse
+		genID := r.URL.Query().Get("generation")
+		if err := json.Unmarshal(body, &result); err != nil || genID == "" {
+			fmt.Println("[ERROR] Replicate webhook decode:", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		pred := &Prediction{}
+		rep.update(pred, result)
+
+		if err := b.completeWebhookGeneration(genID, pred); err != nil {
+			fmt.Printf("[ERROR] Replicate webhook for generation %s: %v\n", genID, err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// completeWebhookGeneration mencatat hasil prediction ke generasi yang masih running,
+// lalu di background me-rehost output dan mengirim hasilnya. Webhook duplikat atau
+// untuk generasi yang sudah selesai diabaikan.
+func (b *BotApp) completeWebhookGeneration(genID string, pred *Prediction) error {
+	gen, err := b.DB.GetGeneration(genID)
+	if err != nil {
+		return err
+	}
+	if gen == nil || gen.Status != GenerationRunning {
+		return nil
+	}
+	if gen.PredictionID != "" && gen.PredictionID != pred.ID {
+		fmt.Printf("[WARN] Replicate webhook: prediction %s does not match generation %s\n", pred.ID, genID)
+		return nil
+	}
+	if !pred.Done() {
+		return nil
+	}
+
+	modelConf := b.GetModelByID(gen.ModelID)
+	genErr := pred.Err()
+	if genErr == nil && len(pred.Output) == 0 {
+		genErr = fmt.Errorf("no output")
+	}
+
+	started, _ := time.Parse(time.RFC3339Nano, gen.CreatedAt)
+	claimed, err := b.finishGeneration(genID, started, pred, genErr, pred.Status == PredictionCanceled)
+	if err != nil || !claimed {
+		return err
+	}
+	// Job yang di-detach masih menyimpan pesan status dan status cancel-nya
+	job := b.Jobs.Complete(genID)
+
+	go func() {
+		if genErr == nil {
+			hosted := b.hostOutputs(modelConf, gen.UserID, pred.Output)
+			if strings.Join(hosted, "\n") != strings.Join(pred.Output, "\n") {
+				if err := b.DB.SetGenerationOutputs(genID, hosted); err != nil {
+					fmt.Printf("[ERROR] Save hosted outputs for generation %s: %v\n", genID, err)
+				}
+			}
+			pred.Output = hosted
+		}
+
+		user, err := b.GetUser(gen.UserID)
+		if err != nil {
+			fmt.Printf("[ERROR] Replicate webhook: load user %d: %v\n", gen.UserID, err)
+			return
+		}
+		if job == nil {
+			chatID := gen.ChatID
+			if chatID == 0 {
+				chatID = gen.UserID // chat pribadi
+			}
+			job = &GenerationJob{
+				GenerationID: gen.ID,
+				ModelID:      gen.ModelID,
+				UserID:       gen.UserID,
+				ChatID:       chatID,
+				Cost:         gen.Cost,
+				Currency:     gen.Currency,
+				PaidCost:     gen.PaidCost,
+				Language:     user.LanguageCode,
+			}
+		}
+		b.deliverResult(job, user, modelConf, gen.Prompt, pred, genErr)
+	}()
+	return nil
+}
+
+// ReconcileGenerations dipanggil saat startup: generasi Replicate yang masih running dari
+// proses sebelumnya didaftarkan ulang sebagai job webhook lalu langsung dicek statusnya,
+// sehingga hasil yang webhook-nya terlewat tetap terkirim (atau di-refund).
+func (b *BotApp) ReconcileGenerations(ctx context.Context) {
+	gens, err := b.DB.ListRunningGenerations()
+	if err != nil {
+		fmt.Println("[ERROR] Load running generations:", err)
+		return
+	}
+	adopted := 0
+	for _, gen := range gens {
+		if gen.PredictionID == "" || b.GetModelByID(gen.ModelID).BackendName() != BackendReplicate {
+			continue
+		}
+		if job, _ := b.Jobs.Find(gen.ID); job != nil {
+			continue
+		}
+		chatID := gen.ChatID
+		if chatID == 0 {
+			chatID = gen.UserID
+		}
+		started, err := time.Parse(time.RFC3339Nano, gen.CreatedAt)
+		if err != nil {
+			started = time.Now()
+		}
+		// Bahasa diisi sekarang karena job bisa dibaca goroutine cancel/webhook kapan saja;
+		// jika user gagal dimuat, I18n memakai bahasa default
+		lang := ""
+		if user, err := b.DB.GetOrCreateUser(gen.UserID); err == nil {
+			lang = user.LanguageCode
+		}
+		b.Jobs.Adopt(&GenerationJob{
+			GenerationID: gen.ID,
+			ModelID:      gen.ModelID,
+			UserID:       gen.UserID,
+			ChatID:       chatID,
+			Cost:         gen.Cost,
+			Currency:     gen.Currency,
+			PaidCost:     gen.PaidCost,
+			Language:     lang,
+			Started:      started,
+		})
+		adopted++
+	}
+	if adopted == 0 {
+		return
+	}
+	fmt.Printf("[INFO] Reconciling %d running Replicate generation(s)\n", adopted)
+	for _, job := range b.Jobs.Detached() {
+		b.checkWebhookJob(ctx, job)
+	}
+}
+
+// SweepWebhookJobs berjalan sampai ctx dibatalkan dan mengecek job webhook yang
+// sudah melewati deadline-nya, supaya job yang webhook-nya tidak pernah datang
+// tidak tertahan selamanya (dan biayanya di-refund).
+func (b *BotApp) SweepWebhookJobs(ctx context.Context) {
+	ticker := time.NewTicker(webhookSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, job := range b.Jobs.Detached() {
+			if time.Now().After(b.webhookDeadline(job)) {
+				b.checkWebhookJob(ctx, job)
+			}
+		}
+	}
+}
+
+// webhookDeadline adalah batas waktu job webhook sebelum prediction-nya dibatalkan
+func (b *BotApp) webhookDeadline(job *GenerationJob) time.Time {
+	return job.Started.Add(b.GetModelByID(job.ModelID).GenerationTimeout() + webhookGrace)
+}
+
+// checkWebhookJob mengambil status prediction job webhook langsung dari Replicate.
+// Prediction yang sudah selesai diproses seperti webhook biasa; yang masih berjalan
+// setelah deadline dibatalkan dan generasinya dicatat gagal (biaya di-refund).
+func (b *BotApp) checkWebhookJob(ctx context.Context, job *GenerationJob) {
+	gen, err := b.DB.GetGeneration(job.GenerationID)
+	if err != nil {
+		fmt.Printf("[ERROR] Check webhook generation %s: %v\n", job.GenerationID, err)
+		return
+	}
+	if gen == nil || gen.Status != GenerationRunning {
+		// Sudah diselesaikan di tempat lain (mis. webhook datang bersamaan)
+		b.Jobs.Complete(job.GenerationID)
+		return
+	}
+	rep, ok := b.Backends[BackendReplicate].(*ReplicateConfig)
+	if !ok {
+		return
+	}
+	expired := time.Now().After(b.webhookDeadline(job))
+
+	pred := &Prediction{ID: gen.PredictionID}
+	if gen.PredictionID != "" {
+		pollCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+		err := rep.Poll(pollCtx, pred)
+		cancel()
+		if err != nil {
+			// Dicoba lagi pada sweep berikutnya; prediction mungkin masih selesai
+			fmt.Printf("[ERROR] Poll prediction %s for generation %s: %v\n", gen.PredictionID, gen.ID, err)
+			return
+		}
+	}
+	if !pred.Done() {
+		if !expired {
+			return
+		}
+		if pred.ID != "" {
+			cancelCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			if err := rep.Cancel(cancelCtx, pred); err != nil {
+				fmt.Printf("[ERROR] Cancel prediction %s: %v\n", pred.ID, err)
+			}
+			cancel()
+		}
+		fmt.Printf("[WARN] Generation %s: no webhook before deadline, marking as failed\n", gen.ID)
+		pred.Status = PredictionFailed
+		pred.Error = "timed out waiting for webhook"
+	}
+	if err := b.completeWebhookGeneration(gen.ID, pred); err != nil {
+		fmt.Printf("[ERROR] Complete webhook generation %s: %v\n", gen.ID, err)
+	}
+}
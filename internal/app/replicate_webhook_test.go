@@ -0,0 +1,209 @@
+package app
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testWebhookKey = []byte("test-webhook-signing-key")
+
+func testWebhookSecret() string {
+	return "whsec_" + base64.StdEncoding.EncodeToString(testWebhookKey)
+}
+
+// signWebhook membuat header webhook-signature untuk id, timestamp dan body
+func signWebhook(key []byte, id, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(id + "." + ts + "."))
+	mac.Write(body)
+	return "v1," + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func webhookHeader(id, ts, signature string) http.Header {
+	h := http.Header{}
+	h.Set("webhook-id", id)
+	h.Set("webhook-timestamp", ts)
+	h.Set("webhook-signature", signature)
+	return h
+}
+
+func TestVerifyWebhook(t *testing.T) {
+	rep := &ReplicateConfig{WebhookSecret: testWebhookSecret()}
+	now := time.Unix(1_700_000_000, 0)
+	body := []byte(`{"id":"p1","status":"succeeded"}`)
+	ts := strconv.FormatInt(now.Unix(), 10)
+	valid := signWebhook(testWebhookKey, "msg_1", ts, body)
+
+	tests := []struct {
+		name    string
+		header  http.Header
+		body    []byte
+		now     time.Time
+		wantErr string
+	}{
+		{"valid", webhookHeader("msg_1", ts, valid), body, now, ""},
+		{"rotated secrets", webhookHeader("msg_1", ts, signWebhook([]byte("old-key"), "msg_1", ts, body)+" "+valid), body, now, ""},
+		{"inside tolerance", webhookHeader("msg_1", ts, valid), body, now.Add(replicateWebhookTolerance - time.Second), ""},
+		{"missing headers", http.Header{}, body, now, "missing webhook headers"},
+		{"missing signature", webhookHeader("msg_1", ts, ""), body, now, "missing webhook headers"},
+		{"invalid timestamp", webhookHeader("msg_1", "yesterday", valid), body, now, "invalid webhook timestamp"},
+		{"wrong secret", webhookHeader("msg_1", ts, signWebhook([]byte("other-key"), "msg_1", ts, body)), body, now, "invalid webhook signature"},
+		{"tampered body", webhookHeader("msg_1", ts, valid), []byte(`{"id":"p1","status":"failed"}`), now, "invalid webhook signature"},
+		{"signature reused with another id", webhookHeader("msg_2", ts, valid), body, now, "invalid webhook signature"},
+		{"unknown signature version", webhookHeader("msg_1", ts, strings.Replace(valid, "v1,", "v2,", 1)), body, now, "invalid webhook signature"},
+		// Webhook lama yang dikirim ulang ditolak walaupun signature-nya benar
+		{"replay after tolerance", webhookHeader("msg_1", ts, valid), body, now.Add(replicateWebhookTolerance + time.Second), "out of tolerance"},
+		{"timestamp in the future", webhookHeader("msg_1", ts, valid), body, now.Add(-replicateWebhookTolerance - time.Second), "out of tolerance"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := rep.VerifyWebhook(tt.header, tt.body, tt.now)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("VerifyWebhook: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("VerifyWebhook error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyWebhookInvalidSecret(t *testing.T) {
+	rep := &ReplicateConfig{WebhookSecret: "whsec_not base64!"}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	err := rep.VerifyWebhook(webhookHeader("msg_1", ts, "v1,AAAA"), nil, time.Now())
+	if err == nil || !strings.Contains(err.Error(), "invalid webhook secret") {
+		t.Errorf("VerifyWebhook error = %v, want invalid webhook secret", err)
+	}
+}
+
+// fakeTelegram adalah Bot API palsu yang membalas ok untuk semua method
+type fakeTelegram struct {
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func newFakeTelegram(t *testing.T) (*fakeTelegram, *TelegramClient) {
+	t.Helper()
+	f := &fakeTelegram{calls: make(map[string]int)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		f.mu.Lock()
+		f.calls[method]++
+		f.mu.Unlock()
+		w.Write([]byte(`{"ok":true,"result":{"message_id":1}}`))
+	}))
+	t.Cleanup(srv.Close)
+	client := NewTelegramClient("test", srv.URL, 5*time.Second, nil)
+	client.Limiter = nil
+	return f, client
+}
+
+func (f *fakeTelegram) count(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[method]
+}
+
+func TestReplicateWebhookReplay(t *testing.T) {
+	const userID = 501
+	tg, client := newFakeTelegram(t)
+	// Tanpa plans.json dipakai plan default
+	plans, err := LoadPlans(filepath.Join(t.TempDir(), "plans.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := NewMemoryStore()
+	b := &BotApp{
+		TG:       client,
+		DB:       db,
+		I18n:     NewI18nManager(),
+		Plans:    plans,
+		Jobs:     NewJobTracker(),
+		Backends: map[string]ImageBackend{BackendReplicate: &ReplicateConfig{WebhookSecret: testWebhookSecret()}},
+	}
+
+	if _, err := b.GetUser(userID); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddCredit(userID, 10, TxGrant, CreditMeta{Reason: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := db.GetOrCreateUser(userID)
+	startBalance := before.Balance()
+	if _, err := db.DeductCredit(userID, 4, CreditMeta{GenerationID: "gen-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateGeneration(Generation{ID: "gen-1", UserID: userID, ChatID: userID, Cost: 4, Currency: CurrencyCredits, PredictionID: "p1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := b.ReplicateWebhookHandler()
+	body := []byte(`{"id":"p1","status":"failed","error":"out of memory"}`)
+	post := func(ts time.Time) int {
+		sec := strconv.FormatInt(ts.Unix(), 10)
+		req := httptest.NewRequest(http.MethodPost, "/replicate?generation=gen-1", bytes.NewReader(body))
+		for k, v := range webhookHeader("msg_1", sec, signWebhook(testWebhookKey, "msg_1", sec, body)) {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	now := time.Now()
+	if code := post(now); code != http.StatusOK {
+		t.Fatalf("first delivery status = %d", code)
+	}
+	// Pengiriman ulang yang identik (retry Replicate atau replay) tidak boleh me-refund lagi
+	if code := post(now); code != http.StatusOK {
+		t.Fatalf("second delivery status = %d", code)
+	}
+	if code := post(now.Add(-replicateWebhookTolerance - time.Minute)); code != http.StatusUnauthorized {
+		t.Errorf("stale delivery status = %d, want 401", code)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for tg.count("sendMessage") == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond) // beri waktu goroutine pengiriman kedua jika ada
+
+	if n := tg.count("sendMessage"); n != 1 {
+		t.Errorf("sent %d failure messages, want 1", n)
+	}
+	gen, err := db.GetGeneration("gen-1")
+	if err != nil || gen == nil || gen.Status != GenerationFailed {
+		t.Fatalf("generation = %+v, %v", gen, err)
+	}
+	txs, err := db.GetCreditHistory(userID, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refunds := 0
+	for _, tx := range txs {
+		if tx.Kind == TxRefund {
+			refunds++
+		}
+	}
+	if refunds != 1 {
+		t.Errorf("refunded %d times, want 1", refunds)
+	}
+	user, _ := db.GetOrCreateUser(userID)
+	if user.Balance() != startBalance {
+		t.Errorf("balance = %d, want %d", user.Balance(), startBalance)
+	}
+}
@@ -0,0 +1,170 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ResultTools menentukan model yang dipakai tombol di bawah hasil generasi (config/tools.json).
+// Model kosong atau nonaktif = tombolnya tidak ditampilkan.
+type ResultTools struct {
+	Upscale          string `json:"upscale"`
+	RemoveBackground string `json:"remove_background"`
+}
+
+// DefaultResultTools dipakai jika config/tools.json tidak ada
+var DefaultResultTools = ResultTools{Upscale: "recraft-upscaler", RemoveBackground: "remove-background"}
+
+func loadResultTools(path string) (ResultTools, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return DefaultResultTools, nil
+	}
+	if err != nil {
+		return ResultTools{}, err
+	}
+	var tools ResultTools
+	err = json.Unmarshal(content, &tools)
+	return tools, err
+}
+
+// toolModel mengembalikan model tool jika ada, aktif dan menerima gambar
+func (b *BotApp) toolModel(id string) (ModelConfig, bool) {
+	if id == "" {
+		return ModelConfig{}, false
+	}
+	m := b.GetModelByID(id)
+	return m, m.ID != "" && m.Enabled && m.AcceptsImageInput
+}
+
+// imageParam mengembalikan nama parameter gambar input sebuah model
+func imageParam(modelConf ModelConfig) string {
+	if modelConf.ImageParamName != "" {
+		return modelConf.ImageParamName
+	}
+	if modelConf.AcceptsMultipleImages {
+		return "image_input"
+	}
+	return "image"
+}
+
+// resultButtons membuat tombol aksi untuk hasil generasi. Upscale dan hapus
+// background berlaku per gambar (bukan video/dokumen), jadi album mendapat tombol bernomor.
+// Hasil pipeline memakai generasi langkah terakhir, sehingga regenerate/edit hanya akan
+// mengulang langkah itu saja; untuk hasil seperti ini rerun = false dan tombolnya tidak ditampilkan.
+func (b *BotApp) resultButtons(lang, genID string, kinds []string, rerun bool) []map[string]string {
+	if genID == "" || len(kinds) == 0 {
+		return nil
+	}
+	var buttons []map[string]string
+	if rerun {
+		buttons = append(buttons,
+			map[string]string{"text": b.I18n.Get(lang, "result_regen_btn"), "callback_data": "res_regen|" + genID},
+			map[string]string{"text": b.I18n.Get(lang, "result_edit_btn"), "callback_data": "res_edit|" + genID},
+		)
+	}
+
+	tools := []struct{ model, action, label string }{
+		{b.Tools.Upscale, "res_up", "result_upscale_btn"},
+		{b.Tools.RemoveBackground, "res_rmbg", "result_rmbg_btn"},
+	}
+	for i, kind := range kinds {
+		if kind != OutputPhoto {
+			continue
+		}
+		for _, t := range tools {
+			if _, ok := b.toolModel(t.model); !ok {
+				continue
+			}
+			label := b.I18n.Get(lang, t.label)
+			if len(kinds) > 1 {
+				label += fmt.Sprintf(" #%d", i+1)
+			}
+			buttons = append(buttons, map[string]string{
+				"text":          label,
+				"callback_data": fmt.Sprintf("%s|%s|%d", t.action, genID, i),
+			})
+		}
+	}
+	return buttons
+}
+
+// handleResultCallback menangani tombol res_regen|ID, res_edit|ID, res_up|ID|N dan res_rmbg|ID|N
+func (b *BotApp) handleResultCallback(chatID int64, user *User, data string) {
+	parts := strings.Split(data, "|")
+	if len(parts) < 2 {
+		return
+	}
+	gen := b.loadOwnGeneration(chatID, user, parts[1])
+	if gen == nil {
+		return
+	}
+
+	switch parts[0] {
+	case "res_regen":
+		b.regenerate(chatID, user, gen)
+	case "res_edit":
+		if _, ok := b.restoreGeneration(chatID, 0, user, gen); ok {
+			b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "result_edit_prompt", html.EscapeString(gen.Prompt)), nil)
+		}
+	case "res_up", "res_rmbg":
+		if len(parts) != 3 {
+			return
+		}
+		index, err := strconv.Atoi(parts[2])
+		if err != nil || index < 0 || index >= len(gen.Outputs) {
+			b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "history_not_found"), nil)
+			return
+		}
+		toolID := b.Tools.Upscale
+		if parts[0] == "res_rmbg" {
+			toolID = b.Tools.RemoveBackground
+		}
+		b.runTool(chatID, user, gen, toolID, gen.Outputs[index])
+	}
+}
+
+// regenerate menjalankan ulang generasi dengan model, prompt dan setting yang sama.
+// Jika model punya parameter seed, seed baru dipilih agar hasilnya berbeda.
+func (b *BotApp) regenerate(chatID int64, user *User, gen *Generation) {
+	modelConf := b.GetModelByID(gen.ModelID)
+	if modelConf.ID == "" || !modelConf.Enabled {
+		b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "model_unavailable"), nil)
+		return
+	}
+
+	settings := make(map[string]interface{})
+	for k, v := range gen.Settings {
+		settings[k] = v
+	}
+	for _, p := range modelConf.Parameters {
+		if p.Name == "seed" {
+			settings["seed"] = strconv.Itoa(rand.Intn(1 << 31))
+			break
+		}
+	}
+	b.startGeneration(user, chatID, modelConf, gen.Prompt, settings)
+}
+
+// runTool menjalankan model tool (upscale / hapus background) pada satu gambar hasil
+func (b *BotApp) runTool(chatID int64, user *User, gen *Generation, toolID, imageURL string) {
+	modelConf, ok := b.toolModel(toolID)
+	if !ok {
+		b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "model_unavailable"), nil)
+		return
+	}
+
+	settings := make(map[string]interface{})
+	for _, p := range modelConf.Parameters {
+		if p.Default != nil {
+			settings[p.Name] = p.Default
+		}
+	}
+	settings[imageParam(modelConf)] = imageURL
+	b.startGeneration(user, chatID, modelConf, gen.Prompt, settings)
+}
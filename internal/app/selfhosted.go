@@ -0,0 +1,400 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Ukuran gambar SDXL untuk aspect_ratio, dipakai jika width/height tidak diisi
+var sdxlAspectSizes = map[string][2]int{
+	"1:1":  {1024, 1024},
+	"16:9": {1344, 768},
+	"9:16": {768, 1344},
+	"3:2":  {1216, 832},
+	"2:3":  {832, 1216},
+	"4:3":  {1152, 896},
+	"3:4":  {896, 1152},
+}
+
+// withImageSize melengkapi width/height dari aspect_ratio
+func withImageSize(input map[string]interface{}) {
+	if _, ok := input["width"]; ok {
+		return
+	}
+	ratio, _ := input["aspect_ratio"].(string)
+	size, ok := sdxlAspectSizes[ratio]
+	if !ok {
+		size = sdxlAspectSizes["1:1"]
+	}
+	input["width"], input["height"] = size[0], size[1]
+}
+
+// fetchBase64 mengambil isi file dari URL atau data URI sebagai base64 (tanpa prefix data:)
+func fetchBase64(fileURL string) (string, error) {
+	if strings.HasPrefix(fileURL, "data:") {
+		if i := strings.Index(fileURL, ","); i >= 0 {
+			return fileURL[i+1:], nil
+		}
+		return "", fmt.Errorf("invalid data uri")
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(fileURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("download status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// postJSON mengirim payload JSON dan men-decode respons ke out (opsional)
+func postJSON(ctx context.Context, client *http.Client, endpoint string, headers map[string]string, payload, out interface{}) error {
+	jsonData, _ := json.Marshal(payload)
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("status %d: %s", resp.StatusCode, string(body))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+// --- Automatic1111 (stable-diffusion-webui, dijalankan dengan --api) ---
+
+// A1111Backend memanggil /sdapi/v1/txt2img (atau img2img jika ada gambar input).
+// API-nya sinkron: Submit langsung mengembalikan hasil dalam bentuk data URI.
+type A1111Backend struct {
+	BaseURL string
+	Auth    string // "user:password" untuk --api-auth, opsional
+}
+
+// Parameter input yang diteruskan ke A1111 (nama lain dipetakan di Submit)
+var a1111Params = []string{"prompt", "negative_prompt", "steps", "cfg_scale", "width", "height", "seed", "sampler_name", "scheduler", "denoising_strength"}
+
+func NewA1111Backend(baseURL, auth string) *A1111Backend {
+	return &A1111Backend{BaseURL: strings.TrimRight(baseURL, "/"), Auth: auth}
+}
+
+func (a *A1111Backend) Submit(ctx context.Context, modelConf ModelConfig, input map[string]interface{}) (*Prediction, error) {
+	withImageSize(input)
+	payload := make(map[string]interface{})
+	for _, k := range a1111Params {
+		if v, ok := input[k]; ok {
+			payload[k] = v
+		}
+	}
+	if v, ok := input["guidance_scale"]; ok {
+		payload["cfg_scale"] = v
+	}
+	if v, ok := input["num_outputs"]; ok {
+		payload["batch_size"] = v
+	}
+	if modelConf.BackendModel != "" {
+		payload["override_settings"] = map[string]interface{}{"sd_model_checkpoint": modelConf.BackendModel}
+	}
+
+	endpoint := "/sdapi/v1/txt2img"
+	if image := firstImage(input[imageParam(modelConf)]); image != "" {
+		encoded, err := fetchBase64(image)
+		if err != nil {
+			return nil, fmt.Errorf("load init image: %v", err)
+		}
+		payload["init_images"] = []string{encoded}
+		endpoint = "/sdapi/v1/img2img"
+	}
+
+	headers := map[string]string{}
+	if a.Auth != "" {
+		headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(a.Auth))
+	}
+	var raw interface{}
+	client := &http.Client{Timeout: 10 * time.Minute}
+	if err := postJSON(ctx, client, a.BaseURL+endpoint, headers, payload, &raw); err != nil {
+		return nil, fmt.Errorf("a1111 %v", err)
+	}
+
+	pred := &Prediction{Status: PredictionSucceeded, Output: a.ParseOutput(raw)}
+	if len(pred.Output) == 0 {
+		pred.Status, pred.Error = PredictionFailed, "no output"
+	}
+	return pred, nil
+}
+
+// Poll tidak dipakai: Submit sudah mengembalikan hasil akhir
+func (a *A1111Backend) Poll(ctx context.Context, pred *Prediction) error {
+	return nil
+}
+
+// Cancel menghentikan generasi yang sedang berjalan di server
+func (a *A1111Backend) Cancel(ctx context.Context, pred *Prediction) error {
+	headers := map[string]string{}
+	if a.Auth != "" {
+		headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(a.Auth))
+	}
+	return postJSON(ctx, &http.Client{Timeout: 10 * time.Second}, a.BaseURL+"/sdapi/v1/interrupt", headers, map[string]interface{}{}, nil)
+}
+
+// ParseOutput mengubah images[] (base64 PNG) menjadi data URI
+func (a *A1111Backend) ParseOutput(raw interface{}) []string {
+	resp, _ := raw.(map[string]interface{})
+	images, _ := resp["images"].([]interface{})
+	var urls []string
+	for _, img := range images {
+		if str, ok := img.(string); ok && str != "" {
+			urls = append(urls, "data:image/png;base64,"+str)
+		}
+	}
+	return urls
+}
+
+// firstImage mengambil gambar pertama dari nilai parameter gambar (string atau array)
+func firstImage(v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case []string:
+		if len(val) > 0 {
+			return val[0]
+		}
+	case []interface{}:
+		if len(val) > 0 {
+			str, _ := val[0].(string)
+			return str
+		}
+	}
+	return ""
+}
+
+// --- ComfyUI ---
+
+// ComfyUIBackend menjalankan workflow ComfyUI (format API, "Save (API Format)")
+// dari WorkflowDir/<backend_model>.json. String "{{nama}}" di workflow diganti
+// dengan nilai input, mis. "{{prompt}}", "{{seed}}", "{{width}}".
+type ComfyUIBackend struct {
+	BaseURL     string
+	WorkflowDir string
+	clientID    string
+}
+
+func NewComfyUIBackend(baseURL, workflowDir string) *ComfyUIBackend {
+	if workflowDir == "" {
+		workflowDir = "config/comfyui"
+	}
+	return &ComfyUIBackend{BaseURL: strings.TrimRight(baseURL, "/"), WorkflowDir: workflowDir, clientID: uuid.NewString()}
+}
+
+func (c *ComfyUIBackend) Submit(ctx context.Context, modelConf ModelConfig, input map[string]interface{}) (*Prediction, error) {
+	content, err := os.ReadFile(filepath.Join(c.WorkflowDir, modelConf.BackendModel+".json"))
+	if err != nil {
+		return nil, fmt.Errorf("load comfyui workflow: %v", err)
+	}
+	var workflow interface{}
+	if err := json.Unmarshal(content, &workflow); err != nil {
+		return nil, fmt.Errorf("parse comfyui workflow: %v", err)
+	}
+
+	withImageSize(input)
+	if _, ok := input["seed"]; !ok {
+		input["seed"] = rand.Int63n(1 << 48)
+	}
+
+	var result struct {
+		PromptID string `json:"prompt_id"`
+	}
+	payload := map[string]interface{}{"prompt": fillWorkflow(workflow, input), "client_id": c.clientID}
+	if err := postJSON(ctx, &http.Client{Timeout: 30 * time.Second}, c.BaseURL+"/prompt", nil, payload, &result); err != nil {
+		return nil, fmt.Errorf("comfyui %v", err)
+	}
+	return &Prediction{ID: result.PromptID, Status: PredictionStarting}, nil
+}
+
+// Poll membaca /history/<prompt_id>; entri baru muncul setelah workflow selesai
+func (c *ComfyUIBackend) Poll(ctx context.Context, pred *Prediction) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	req, _ := http.NewRequestWithContext(ctx, "GET", c.BaseURL+"/history/"+pred.ID, nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	var history map[string]struct {
+		Outputs interface{} `json:"outputs"`
+		Status  struct {
+			StatusStr string `json:"status_str"`
+			Completed bool   `json:"completed"`
+		} `json:"status"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&history)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	entry, ok := history[pred.ID]
+	if !ok {
+		pred.Status = PredictionProcessing
+		return nil
+	}
+	if entry.Status.StatusStr == "error" {
+		pred.Status, pred.Error = PredictionFailed, "comfyui workflow error"
+		return nil
+	}
+	if !entry.Status.Completed {
+		pred.Status = PredictionProcessing
+		return nil
+	}
+
+	// Server ComfyUI biasanya tidak publik, jadi output diunduh menjadi data URI
+	pred.Output = nil
+	for _, fileURL := range c.ParseOutput(entry.Outputs) {
+		encoded, err := fetchBase64(fileURL)
+		if err != nil {
+			return fmt.Errorf("download comfyui output: %v", err)
+		}
+		mimeType := mime.TypeByExtension(path.Ext(fileURL))
+		if mimeType == "" {
+			mimeType = "image/png"
+		}
+		pred.Output = append(pred.Output, fmt.Sprintf("data:%s;base64,%s", mimeType, encoded))
+	}
+	pred.Status = PredictionSucceeded
+	if len(pred.Output) == 0 {
+		pred.Status, pred.Error = PredictionFailed, "no output"
+	}
+	return nil
+}
+
+// Cancel menghapus prompt dari antrean, dan menghentikannya jika sedang berjalan
+func (c *ComfyUIBackend) Cancel(ctx context.Context, pred *Prediction) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	if err := postJSON(ctx, client, c.BaseURL+"/queue", nil, map[string]interface{}{"delete": []string{pred.ID}}, nil); err != nil {
+		return err
+	}
+
+	var queue struct {
+		Running [][]interface{} `json:"queue_running"`
+	}
+	req, _ := http.NewRequestWithContext(ctx, "GET", c.BaseURL+"/queue", nil)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	err = json.NewDecoder(resp.Body).Decode(&queue)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	// Item queue_running: [number, prompt_id, prompt, extra_data, outputs]
+	for _, item := range queue.Running {
+		if len(item) > 1 && item[1] == pred.ID {
+			return postJSON(ctx, client, c.BaseURL+"/interrupt", nil, map[string]interface{}{}, nil)
+		}
+	}
+	return nil
+}
+
+// ParseOutput mengubah outputs history (images/gifs/videos per node) menjadi URL /view
+func (c *ComfyUIBackend) ParseOutput(raw interface{}) []string {
+	nodes, _ := raw.(map[string]interface{})
+	// Urutkan node agar urutan output stabil
+	var ids []string
+	for id := range nodes {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return nodeLess(ids[i], ids[j]) })
+
+	var urls []string
+	for _, id := range ids {
+		node, _ := nodes[id].(map[string]interface{})
+		for _, key := range []string{"images", "gifs", "videos"} {
+			files, _ := node[key].([]interface{})
+			for _, f := range files {
+				file, _ := f.(map[string]interface{})
+				if file["type"] != "output" {
+					continue // preview/temp bukan hasil akhir
+				}
+				q := url.Values{}
+				for _, k := range []string{"filename", "subfolder", "type"} {
+					q.Set(k, fmt.Sprint(file[k]))
+				}
+				urls = append(urls, c.BaseURL+"/view?"+q.Encode())
+			}
+		}
+	}
+	return urls
+}
+
+// nodeLess mengurutkan ID node ComfyUI secara numerik ("9" sebelum "10")
+func nodeLess(a, b string) bool {
+	na, errA := strconv.Atoi(a)
+	nb, errB := strconv.Atoi(b)
+	if errA == nil && errB == nil {
+		return na < nb
+	}
+	return a < b
+}
+
+// fillWorkflow mengganti placeholder "{{nama}}" di workflow dengan nilai input.
+// Placeholder yang mengisi seluruh string memakai tipe asli nilainya (angka tetap angka).
+func fillWorkflow(node interface{}, input map[string]interface{}) interface{} {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			v[k] = fillWorkflow(child, input)
+		}
+		return v
+	case []interface{}:
+		for i, child := range v {
+			v[i] = fillWorkflow(child, input)
+		}
+		return v
+	case string:
+		if strings.HasPrefix(v, "{{") && strings.HasSuffix(v, "}}") && strings.Count(v, "{{") == 1 {
+			if val, ok := input[strings.TrimSpace(v[2:len(v)-2])]; ok {
+				return val
+			}
+			return v
+		}
+		for key, val := range input {
+			v = strings.ReplaceAll(v, "{{"+key+"}}", fmt.Sprint(val))
+		}
+		return v
+	}
+	return node
+}
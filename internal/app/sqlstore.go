@@ -0,0 +1,975 @@
+package app
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	DialectPostgres = "postgres"
+	DialectSQLite   = "sqlite"
+
+	// Format waktu tetap agar perbandingan string di SQLite tetap urut
+	sqlTimeFormat = "2006-01-02T15:04:05.000000Z"
+)
+
+// SQLStore adalah implementasi Store langsung di atas database/sql.
+// Query ditulis dengan placeholder Postgres ($1, $2, ...) dan diubah ke
+// placeholder bernomor SQLite (?1, ?2, ...) saat dialect = sqlite.
+type SQLStore struct {
+	db      *sql.DB
+	dialect string
+}
+
+// NewPostgresStore membuka koneksi Postgres. Skema mengikuti db/schema.sql.
+func NewPostgresStore(dsn string) (*SQLStore, error) {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+	store := &SQLStore{db: db, dialect: DialectPostgres}
+	return store, store.migrate()
+}
+
+// NewSQLiteStore membuka (atau membuat) file SQLite embedded
+func NewSQLiteStore(path string) (*SQLStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite hanya mengizinkan satu penulis; satu koneksi membuat semua transaksi berurutan
+	db.SetMaxOpenConns(1)
+	store := &SQLStore{db: db, dialect: DialectSQLite}
+	return store, store.migrate()
+}
+
+func (s *SQLStore) q(query string) string {
+	if s.dialect == DialectSQLite {
+		return strings.ReplaceAll(query, "$", "?")
+	}
+	return query
+}
+
+func (s *SQLStore) migrate() error {
+	idType, jsonType, tsType := "bigserial", "jsonb", "timestamptz"
+	if s.dialect == DialectSQLite {
+		idType, jsonType, tsType = "integer", "text", "text"
+	}
+	stmts := []string{
+		`create table if not exists users (
+			id              bigint primary key,
+			language_code   text not null default 'en',
+			credits         integer not null default 0,
+			paid_credits    integer not null default 0,
+			diamonds        integer not null default 0,
+			plan            text not null default '',
+			plan_expires_at ` + tsType + `,
+			last_reset_date text,
+			current_state   text not null default '',
+			selected_model  text not null default '',
+			draft_config    ` + jsonType + ` not null default '{}'
+		)`,
+		`create table if not exists bot_state (
+			key   text primary key,
+			value text not null
+		)`,
+		`create table if not exists processed_updates (
+			update_id         bigint primary key,
+			callback_query_id text unique,
+			created_at        ` + tsType + ` not null
+		)`,
+		`create table if not exists credit_ledger (
+			id            ` + idType + ` primary key,
+			user_id       bigint not null references users(id),
+			currency      text not null default 'credits',
+			amount        integer not null,
+			balance_after integer not null,
+			kind          text not null,
+			reason        text not null default '',
+			model_id      text not null default '',
+			generation_id text not null default '',
+			created_at    ` + tsType + ` not null
+		)`,
+		`create index if not exists credit_ledger_user_idx on credit_ledger (user_id, id desc)`,
+		`create table if not exists payments (
+			charge_id  text primary key,
+			user_id    bigint not null references users(id),
+			pack_id    text not null,
+			stars      integer not null,
+			credits    integer not null,
+			diamonds   integer not null default 0,
+			plan_id    text not null default '',
+			plan_expires_at ` + tsType + `,
+			status     text not null,
+			created_at ` + tsType + ` not null
+		)`,
+		`create table if not exists promo_codes (
+			code           text primary key,
+			amount         integer not null,
+			currency       text not null default 'credits',
+			max_uses       integer not null default 0,
+			per_user_limit integer not null default 1,
+			uses           integer not null default 0,
+			expires_at     ` + tsType + `,
+			allowed_plans  text not null default '',
+			disabled       boolean not null default false,
+			created_by     bigint not null default 0,
+			created_at     ` + tsType + ` not null
+		)`,
+		`create table if not exists promo_redemptions (
+			id         ` + idType + ` primary key,
+			code       text not null references promo_codes(code),
+			user_id    bigint not null references users(id),
+			created_at ` + tsType + ` not null
+		)`,
+		`create index if not exists promo_redemptions_code_user_idx on promo_redemptions (code, user_id)`,
+		`create table if not exists referrals (
+			referee_id  bigint primary key references users(id),
+			referrer_id bigint not null references users(id),
+			status      text not null,
+			created_at  ` + tsType + ` not null,
+			rewarded_at ` + tsType + `
+		)`,
+		`create index if not exists referrals_referrer_idx on referrals (referrer_id, status)`,
+		`create table if not exists generations (
+			id            text primary key,
+			user_id       bigint not null references users(id),
+			chat_id       bigint not null default 0,
+			model_id      text not null,
+			prompt        text not null,
+			settings      ` + jsonType + ` not null default '{}',
+			input         ` + jsonType + ` not null default '{}',
+			cost          integer not null,
+			currency      text not null default 'credits',
+			paid_cost     integer not null default 0,
+			status        text not null,
+			outputs       ` + jsonType + ` not null default '[]',
+			prediction_id text not null default '',
+			duration_ms   bigint not null default 0,
+			error         text not null default '',
+			created_at    ` + tsType + ` not null,
+			completed_at  ` + tsType + `
+		)`,
+		`create index if not exists generations_user_idx on generations (user_id, created_at desc)`,
+		`create index if not exists generations_running_idx on generations (created_at) where status = 'running'`,
+	}
+	for _, stmt := range stmts {
+		if _, err := s.db.Exec(stmt); err != nil {
+			return fmt.Errorf("migrate: %v", err)
+		}
+	}
+
+	// Kolom yang ditambahkan belakangan. SQLite tidak punya "add column if not exists",
+	// jadi error kolom duplikat diabaikan.
+	columns := []string{
+		`alter table users add column paid_credits integer not null default 0`,
+		`alter table users add column plan text not null default ''`,
+		`alter table users add column diamonds integer not null default 0`,
+		`alter table credit_ledger add column currency text not null default 'credits'`,
+		`alter table payments add column diamonds integer not null default 0`,
+		`alter table users add column plan_expires_at ` + tsType,
+		`alter table payments add column plan_id text not null default ''`,
+		`alter table generations add column chat_id bigint not null default 0`,
+		`alter table generations add column paid_cost integer not null default 0`,
+		`alter table payments add column plan_expires_at ` + tsType,
+	}
+	for _, stmt := range columns {
+		if _, err := s.db.Exec(stmt); err != nil && !isDuplicateColumn(err) {
+			return fmt.Errorf("migrate: %v", err)
+		}
+	}
+	return nil
+}
+
+func isDuplicateColumn(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "duplicate column") || strings.Contains(msg, "already exists")
+}
+
+func (s *SQLStore) forUpdate() string {
+	if s.dialect == DialectPostgres {
+		return " for update"
+	}
+	return ""
+}
+
+func sqlNow() string {
+	return time.Now().UTC().Format(sqlTimeFormat)
+}
+
+// sqlExecer dipenuhi oleh *sql.DB dan *sql.Tx
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (s *SQLStore) logCredit(ex sqlExecer, telegramID int64, currency string, amount, balance int, kind string, meta CreditMeta) error {
+	_, err := ex.Exec(s.q(`insert into credit_ledger (user_id, currency, amount, balance_after, kind, reason, model_id, generation_id, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9)`),
+		telegramID, currency, amount, balance, kind, meta.Reason, meta.ModelID, meta.GenerationID, sqlNow())
+	return err
+}
+
+func (s *SQLStore) GetOrCreateUser(telegramID int64) (*User, error) {
+	var user User
+	var lastReset, planExpires sql.NullString
+	var draft []byte
+	err := s.db.QueryRow(s.q(`select id, language_code, credits, paid_credits, diamonds, plan, plan_expires_at, last_reset_date, current_state, selected_model, draft_config
+		from users where id = $1`), telegramID).
+		Scan(&user.ID, &user.LanguageCode, &user.Credits, &user.PaidCredits, &user.Diamonds, &user.Plan, &planExpires, &lastReset, &user.CurrentState, &user.SelectedModel, &draft)
+
+	if err == sql.ErrNoRows {
+		// Jatah awal diberikan oleh ResetAllowance pada periode pertama
+		user = User{
+			ID:           telegramID,
+			LanguageCode: "en",
+			DraftConfig:  make(map[string]interface{}),
+		}
+		_, err = s.db.Exec(s.q(`insert into users (id, language_code, credits, paid_credits, plan, last_reset_date, current_state, selected_model, draft_config)
+			values ($1, $2, 0, 0, '', '', '', '', '{}') on conflict do nothing`), user.ID, user.LanguageCode)
+		if err != nil {
+			return nil, err
+		}
+		return &user, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user.LastResetDate = lastReset.String
+	user.PlanExpiresAt = planExpires.String
+	json.Unmarshal(draft, &user.DraftConfig)
+	if user.DraftConfig == nil {
+		user.DraftConfig = make(map[string]interface{})
+	}
+	return &user, nil
+}
+
+func (s *SQLStore) UpdateState(telegramID int64, state string, modelKey string) error {
+	_, err := s.db.Exec(s.q(`update users set current_state = $1, selected_model = $2, draft_config = '{}' where id = $3`), state, modelKey, telegramID)
+	return err
+}
+
+func (s *SQLStore) UpdateCurrentState(telegramID int64, state string) error {
+	_, err := s.db.Exec(s.q(`update users set current_state = $1 where id = $2`), state, telegramID)
+	return err
+}
+
+func (s *SQLStore) UpdateDraftConfig(telegramID int64, key string, value interface{}) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var draft []byte
+	if err := tx.QueryRow(s.q(`select draft_config from users where id = $1`)+s.forUpdate(), telegramID).Scan(&draft); err != nil {
+		return err
+	}
+	config := make(map[string]interface{})
+	json.Unmarshal(draft, &config)
+	config[key] = value
+
+	raw, _ := json.Marshal(config)
+	if _, err := tx.Exec(s.q(`update users set draft_config = $1 where id = $2`), string(raw), telegramID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) ClearState(telegramID int64) error {
+	return s.UpdateState(telegramID, "", "")
+}
+
+func (s *SQLStore) DeductCredit(telegramID int64, amount int, meta CreditMeta) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Baris dikunci (Postgres: FOR UPDATE, SQLite: satu koneksi) sampai commit
+	var free, paid int
+	err = tx.QueryRow(s.q(`select credits, paid_credits from users where id = $1`)+s.forUpdate(), telegramID).Scan(&free, &paid)
+	if err == sql.ErrNoRows || (err == nil && free+paid < amount) {
+		return 0, ErrInsufficientCredits
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// Jatah gratis dipakai dulu, sisanya dari paid_credits
+	freeUsed := amount
+	if free < freeUsed {
+		freeUsed = free
+	}
+	paidUsed := amount - freeUsed
+	if _, err := tx.Exec(s.q(`update users set credits = credits - $1, paid_credits = paid_credits - $2 where id = $3`), freeUsed, paidUsed, telegramID); err != nil {
+		return 0, err
+	}
+	if err := s.logCredit(tx, telegramID, CurrencyCredits, -amount, free+paid-amount, TxDebit, meta); err != nil {
+		return 0, err
+	}
+	return paidUsed, tx.Commit()
+}
+
+func (s *SQLStore) AddCredit(telegramID int64, amount int, kind string, meta CreditMeta) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var balance int
+	err = tx.QueryRow(s.q(`update users set credits = credits + $1, paid_credits = paid_credits + $2 where id = $3
+		returning credits + paid_credits`), amount-meta.Paid, meta.Paid, telegramID).Scan(&balance)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("user_not_found")
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.logCredit(tx, telegramID, CurrencyCredits, amount, balance, kind, meta); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) DeductDiamonds(telegramID int64, amount int, meta CreditMeta) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Decrement-if-sufficient dalam satu statement
+	var balance int
+	err = tx.QueryRow(s.q(`update users set diamonds = diamonds - $1 where id = $2 and diamonds >= $1
+		returning diamonds`), amount, telegramID).Scan(&balance)
+	if err == sql.ErrNoRows {
+		return ErrInsufficientDiamonds
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.logCredit(tx, telegramID, CurrencyDiamonds, -amount, balance, TxDebit, meta); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) AddDiamonds(telegramID int64, amount int, kind string, meta CreditMeta) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var balance int
+	err = tx.QueryRow(s.q(`update users set diamonds = diamonds + $1 where id = $2 returning diamonds`), amount, telegramID).Scan(&balance)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("user_not_found")
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.logCredit(tx, telegramID, CurrencyDiamonds, amount, balance, kind, meta); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLStore) ResetAllowance(telegramID int64, lastPeriod, period string, allowance int, topUp bool) (int, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	var free, paid int
+	err = tx.QueryRow(s.q(`select credits, paid_credits from users where id = $1 and coalesce(last_reset_date, '') = $2`)+s.forUpdate(),
+		telegramID, lastPeriod).Scan(&free, &paid)
+	if err == sql.ErrNoRows {
+		return 0, false, nil // sudah di-reset oleh request lain
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	newCredits := allowance
+	if topUp && free > allowance {
+		newCredits = free
+	}
+	if _, err := tx.Exec(s.q(`update users set credits = $1, last_reset_date = $2 where id = $3`), newCredits, period, telegramID); err != nil {
+		return 0, false, err
+	}
+	if newCredits != free {
+		if err := s.logCredit(tx, telegramID, CurrencyCredits, newCredits-free, newCredits+paid, TxDailyReset, CreditMeta{Reason: "allowance"}); err != nil {
+			return 0, false, err
+		}
+	}
+	return newCredits, true, tx.Commit()
+}
+
+func (s *SQLStore) SetLanguage(telegramID int64, lang string) error {
+	_, err := s.db.Exec(s.q(`update users set language_code = $1 where id = $2`), lang, telegramID)
+	return err
+}
+
+func (s *SQLStore) SetPlan(telegramID int64, planID, expiresAt string) error {
+	expires, err := sqlTime(expiresAt)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(s.q(`update users set plan = $1, plan_expires_at = $2 where id = $3`), planID, expires, telegramID)
+	return err
+}
+
+// sqlTime mengubah waktu RFC3339 ke format kolom waktu, nil jika kosong
+func sqlTime(value string) (interface{}, error) {
+	if value == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return nil, err
+	}
+	return t.UTC().Format(sqlTimeFormat), nil
+}
+
+func (s *SQLStore) GetCreditHistory(telegramID int64, limit int) ([]CreditTransaction, error) {
+	rows, err := s.db.Query(s.q(`select id, user_id, currency, amount, balance_after, kind, reason, model_id, generation_id, created_at
+		from credit_ledger where user_id = $1 order by id desc limit $2`), telegramID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var txs []CreditTransaction
+	for rows.Next() {
+		var tx CreditTransaction
+		if err := rows.Scan(&tx.ID, &tx.UserID, &tx.Currency, &tx.Amount, &tx.BalanceAfter, &tx.Kind, &tx.Reason, &tx.ModelID, &tx.GenerationID, &tx.CreatedAt); err != nil {
+			return nil, err
+		}
+		txs = append(txs, tx)
+	}
+	return txs, rows.Err()
+}
+
+func (s *SQLStore) GetUpdateOffset() (int, error) {
+	var value string
+	err := s.db.QueryRow(s.q(`select value from bot_state where key = $1`), "update_offset").Scan(&value)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var offset int
+	_, err = fmt.Sscan(value, &offset)
+	return offset, err
+}
+
+func (s *SQLStore) SaveUpdateOffset(offset int) error {
+	_, err := s.db.Exec(s.q(`insert into bot_state (key, value) values ($1, $2)
+		on conflict (key) do update set value = excluded.value`), "update_offset", fmt.Sprint(offset))
+	return err
+}
+
+func (s *SQLStore) ClaimUpdate(updateID int, callbackID string) (bool, error) {
+	var cb interface{}
+	if callbackID != "" {
+		cb = callbackID
+	}
+	res, err := s.db.Exec(s.q(`insert into processed_updates (update_id, callback_query_id, created_at)
+		values ($1, $2, $3) on conflict do nothing`), updateID, cb, sqlNow())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *SQLStore) PruneProcessedUpdates(maxAge time.Duration) error {
+	cutoff := time.Now().UTC().Add(-maxAge).Format(sqlTimeFormat)
+	_, err := s.db.Exec(s.q(`delete from processed_updates where created_at < $1`), cutoff)
+	return err
+}
+
+func (s *SQLStore) CreditPurchase(p Payment) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	planExpires, err := sqlTime(p.PlanExpiresAt)
+	if err != nil {
+		return false, err
+	}
+
+	res, err := tx.Exec(s.q(`insert into payments (charge_id, user_id, pack_id, stars, credits, diamonds, plan_id, plan_expires_at, status, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) on conflict do nothing`),
+		p.ChargeID, p.UserID, p.PackID, p.Stars, p.Credits, p.Diamonds, p.PlanID, planExpires, PaymentPaid, sqlNow())
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+
+	var balance, diamonds int
+	err = tx.QueryRow(s.q(`update users set paid_credits = paid_credits + $1, diamonds = diamonds + $2 where id = $3
+		returning credits + paid_credits, diamonds`), p.Credits, p.Diamonds, p.UserID).Scan(&balance, &diamonds)
+	if err != nil {
+		return false, err
+	}
+	meta := CreditMeta{Reason: "stars:" + p.ChargeID}
+	if p.Credits > 0 {
+		if err := s.logCredit(tx, p.UserID, CurrencyCredits, p.Credits, balance, TxPurchase, meta); err != nil {
+			return false, err
+		}
+	}
+	if p.Diamonds > 0 {
+		if err := s.logCredit(tx, p.UserID, CurrencyDiamonds, p.Diamonds, diamonds, TxPurchase, meta); err != nil {
+			return false, err
+		}
+	}
+	if p.PlanID != "" {
+		if _, err := tx.Exec(s.q(`update users set plan = $1, plan_expires_at = $2 where id = $3`), p.PlanID, planExpires, p.UserID); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
+
+func (s *SQLStore) GetPayment(chargeID string) (*Payment, error) {
+	var p Payment
+	var planExpires sql.NullString
+	err := s.db.QueryRow(s.q(`select charge_id, user_id, pack_id, stars, credits, diamonds, plan_id, plan_expires_at, status, created_at from payments where charge_id = $1`), chargeID).
+		Scan(&p.ChargeID, &p.UserID, &p.PackID, &p.Stars, &p.Credits, &p.Diamonds, &p.PlanID, &planExpires, &p.Status, &p.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.PlanExpiresAt = planExpires.String
+	return &p, nil
+}
+
+func (s *SQLStore) RefundPurchase(chargeID string) (int, int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int64
+	var packCredits, packDiamonds int
+	var planID, status string
+	var planExpires sql.NullString
+	err = tx.QueryRow(s.q(`select user_id, credits, diamonds, plan_id, plan_expires_at, status from payments where charge_id = $1`)+s.forUpdate(), chargeID).
+		Scan(&userID, &packCredits, &packDiamonds, &planID, &planExpires, &status)
+	if err == sql.ErrNoRows {
+		return 0, 0, fmt.Errorf("payment_not_found")
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if status == PaymentRefunded {
+		return 0, 0, fmt.Errorf("already_refunded")
+	}
+
+	var free, paid, diamonds int
+	if err := tx.QueryRow(s.q(`select credits, paid_credits, diamonds from users where id = $1`)+s.forUpdate(), userID).Scan(&free, &paid, &diamonds); err != nil {
+		return 0, 0, err
+	}
+	// Tarik isi paket, maksimal sebesar saldo yang tersisa
+	credits := min(packCredits, paid)
+	revokedDiamonds := min(packDiamonds, diamonds)
+	if _, err := tx.Exec(s.q(`update users set paid_credits = paid_credits - $1, diamonds = diamonds - $2 where id = $3`), credits, revokedDiamonds, userID); err != nil {
+		return 0, 0, err
+	}
+	if _, err := tx.Exec(s.q(`update payments set status = $1 where charge_id = $2`), PaymentRefunded, chargeID); err != nil {
+		return 0, 0, err
+	}
+	if planID != "" {
+		if err := s.revokeRefundedPlan(tx, userID, &Payment{ChargeID: chargeID, PlanID: planID, PlanExpiresAt: planExpires.String}); err != nil {
+			return 0, 0, err
+		}
+	}
+	meta := CreditMeta{Reason: "stars:" + chargeID}
+	if credits > 0 {
+		if err := s.logCredit(tx, userID, CurrencyCredits, -credits, free+paid-credits, TxPurchaseRefund, meta); err != nil {
+			return 0, 0, err
+		}
+	}
+	if revokedDiamonds > 0 {
+		if err := s.logCredit(tx, userID, CurrencyDiamonds, -revokedDiamonds, diamonds-revokedDiamonds, TxPurchaseRefund, meta); err != nil {
+			return 0, 0, err
+		}
+	}
+	return credits, revokedDiamonds, tx.Commit()
+}
+
+// revokeRefundedPlan menerapkan planAfterRefund di dalam transaksi refund
+func (s *SQLStore) revokeRefundedPlan(tx *sql.Tx, userID int64, p *Payment) error {
+	var user User
+	var userExpires sql.NullString
+	if err := tx.QueryRow(s.q(`select plan, plan_expires_at from users where id = $1`), userID).Scan(&user.Plan, &userExpires); err != nil {
+		return err
+	}
+	user.PlanExpiresAt = userExpires.String
+
+	rows, err := tx.Query(s.q(`select plan_expires_at from payments
+		where user_id = $1 and plan_id = $2 and status = $3 and charge_id <> $4 and plan_expires_at is not null`), userID, p.PlanID, PaymentPaid, p.ChargeID)
+	if err != nil {
+		return err
+	}
+	var others []string
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			rows.Close()
+			return err
+		}
+		others = append(others, value)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	plan, expires, changed := planAfterRefund(&user, p, others, time.Now())
+	if !changed {
+		return nil
+	}
+	planExpires, err := sqlTime(expires)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(s.q(`update users set plan = $1, plan_expires_at = $2 where id = $3`), plan, planExpires, userID)
+	return err
+}
+
+const promoColumns = `code, amount, currency, max_uses, per_user_limit, uses, expires_at, allowed_plans, disabled, created_by, created_at`
+
+func scanPromo(row interface{ Scan(...interface{}) error }) (*PromoCode, error) {
+	var p PromoCode
+	var expires sql.NullString
+	err := row.Scan(&p.Code, &p.Amount, &p.Currency, &p.MaxUses, &p.PerUserLimit, &p.Uses, &expires, &p.AllowedPlans, &p.Disabled, &p.CreatedBy, &p.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	p.ExpiresAt = expires.String
+	return &p, nil
+}
+
+func (s *SQLStore) CreatePromo(p PromoCode) error {
+	expires, err := sqlTime(p.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.Exec(s.q(`insert into promo_codes (code, amount, currency, max_uses, per_user_limit, expires_at, allowed_plans, created_by, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9) on conflict do nothing`),
+		strings.ToUpper(p.Code), p.Amount, p.Currency, p.MaxUses, p.PerUserLimit, expires, p.AllowedPlans, p.CreatedBy, sqlNow())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("promo_exists")
+	}
+	return nil
+}
+
+func (s *SQLStore) ListPromos() ([]PromoCode, error) {
+	rows, err := s.db.Query(`select ` + promoColumns + ` from promo_codes order by created_at desc`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []PromoCode
+	for rows.Next() {
+		p, err := scanPromo(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *p)
+	}
+	return list, rows.Err()
+}
+
+func (s *SQLStore) DisablePromo(code string) (bool, error) {
+	res, err := s.db.Exec(s.q(`update promo_codes set disabled = $1 where code = $2`), true, strings.ToUpper(code))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (s *SQLStore) RedeemPromo(code string, telegramID int64, planID string) (*PromoCode, error) {
+	code = strings.ToUpper(code)
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// Baris promo dikunci agar max_uses tidak terlampaui oleh penukaran bersamaan
+	p, err := scanPromo(tx.QueryRow(s.q(`select `+promoColumns+` from promo_codes where code = $1`)+s.forUpdate(), code))
+	if err == sql.ErrNoRows {
+		return nil, ErrPromoNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := p.check(planID, time.Now()); err != nil {
+		return nil, err
+	}
+	if p.PerUserLimit > 0 {
+		var used int
+		if err := tx.QueryRow(s.q(`select count(*) from promo_redemptions where code = $1 and user_id = $2`), code, telegramID).Scan(&used); err != nil {
+			return nil, err
+		}
+		if used >= p.PerUserLimit {
+			return nil, ErrPromoAlreadyUsed
+		}
+	}
+
+	if _, err := tx.Exec(s.q(`insert into promo_redemptions (code, user_id, created_at) values ($1, $2, $3)`), code, telegramID, sqlNow()); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(s.q(`update promo_codes set uses = uses + 1 where code = $1`), code); err != nil {
+		return nil, err
+	}
+	p.Uses++
+
+	if err := s.grant(tx, telegramID, p.Currency, p.Amount, TxPromo, CreditMeta{Reason: "promo:" + code}); err != nil {
+		return nil, err
+	}
+	return p, tx.Commit()
+}
+
+// grant menambah saldo yang tidak ikut reset (paid_credits atau diamonds) di dalam tx
+func (s *SQLStore) grant(tx *sql.Tx, telegramID int64, currency string, amount int, kind string, meta CreditMeta) error {
+	query := `update users set paid_credits = paid_credits + $1 where id = $2 returning credits + paid_credits`
+	if currency == CurrencyDiamonds {
+		query = `update users set diamonds = diamonds + $1 where id = $2 returning diamonds`
+	} else {
+		currency = CurrencyCredits
+	}
+	var balance int
+	if err := tx.QueryRow(s.q(query), amount, telegramID).Scan(&balance); err != nil {
+		return err
+	}
+	return s.logCredit(tx, telegramID, currency, amount, balance, kind, meta)
+}
+
+func (s *SQLStore) CreateReferral(referrerID, refereeID int64) (bool, error) {
+	if referrerID == refereeID {
+		return false, nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// Pengundang harus sudah terdaftar, dan hanya user baru (belum pernah debit) yang bisa diundang
+	var referrers, debits int
+	if err := tx.QueryRow(s.q(`select count(*) from users where id = $1`), referrerID).Scan(&referrers); err != nil {
+		return false, err
+	}
+	if err := tx.QueryRow(s.q(`select count(*) from credit_ledger where user_id = $1 and kind = $2`), refereeID, TxDebit).Scan(&debits); err != nil {
+		return false, err
+	}
+	if referrers == 0 || debits > 0 {
+		return false, nil
+	}
+
+	res, err := tx.Exec(s.q(`insert into referrals (referee_id, referrer_id, status, created_at)
+		values ($1, $2, $3, $4) on conflict do nothing`), refereeID, referrerID, ReferralPending, sqlNow())
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	return true, tx.Commit()
+}
+
+func (s *SQLStore) CompleteReferral(refereeID int64, policy ReferralPolicy) (*Referral, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	r := Referral{RefereeID: refereeID}
+	err = tx.QueryRow(s.q(`select referrer_id, status, created_at from referrals where referee_id = $1 and status = $2`)+s.forUpdate(),
+		refereeID, ReferralPending).Scan(&r.ReferrerID, &r.Status, &r.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Kunci baris pengundang agar batas bonus tidak terlampaui oleh referral bersamaan
+	if _, err := tx.Exec(s.q(`update users set id = id where id = $1`), r.ReferrerID); err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	var total, today int
+	err = tx.QueryRow(s.q(`select count(*), count(case when rewarded_at >= $2 then 1 end)
+		from referrals where referrer_id = $1 and status = $3`),
+		r.ReferrerID, now.Add(-24*time.Hour).Format(sqlTimeFormat), ReferralRewarded).Scan(&total, &today)
+	if err != nil {
+		return nil, err
+	}
+
+	r.Status = ReferralRewarded
+	if (policy.MaxTotal > 0 && total >= policy.MaxTotal) || (policy.MaxPerDay > 0 && today >= policy.MaxPerDay) {
+		r.Status = ReferralCapped
+	}
+	r.RewardedAt = now.Format(sqlTimeFormat)
+	if _, err := tx.Exec(s.q(`update referrals set status = $1, rewarded_at = $2 where referee_id = $3`), r.Status, r.RewardedAt, refereeID); err != nil {
+		return nil, err
+	}
+
+	if policy.RefereeBonus > 0 {
+		if err := s.grant(tx, refereeID, policy.Currency, policy.RefereeBonus, TxReferral, CreditMeta{Reason: fmt.Sprintf("referral:%d", r.ReferrerID)}); err != nil {
+			return nil, err
+		}
+	}
+	if r.Status == ReferralRewarded && policy.ReferrerBonus > 0 {
+		if err := s.grant(tx, r.ReferrerID, policy.Currency, policy.ReferrerBonus, TxReferral, CreditMeta{Reason: fmt.Sprintf("referral:%d", refereeID)}); err != nil {
+			return nil, err
+		}
+	}
+	return &r, tx.Commit()
+}
+
+func (s *SQLStore) ReferralStats(referrerID int64) (int, int, error) {
+	var invited, rewarded int
+	err := s.db.QueryRow(s.q(`select count(*), count(case when status = $2 then 1 end) from referrals where referrer_id = $1`),
+		referrerID, ReferralRewarded).Scan(&invited, &rewarded)
+	return invited, rewarded, err
+}
+
+func (s *SQLStore) CreateGeneration(g Generation) error {
+	settings, _ := json.Marshal(g.Settings)
+	_, err := s.db.Exec(s.q(`insert into generations (id, user_id, chat_id, model_id, prompt, settings, cost, currency, paid_cost, status, created_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`),
+		g.ID, g.UserID, g.ChatID, g.ModelID, g.Prompt, string(settings), g.Cost, g.Currency, g.PaidCost, GenerationRunning, sqlNow())
+	return err
+}
+
+func (s *SQLStore) SetGenerationPrediction(id, predictionID string) error {
+	_, err := s.db.Exec(s.q(`update generations set prediction_id = $1 where id = $2`), predictionID, id)
+	return err
+}
+
+func (s *SQLStore) FinishGeneration(g Generation) (bool, error) {
+	input, _ := json.Marshal(g.Input)
+	if g.Input == nil {
+		input = []byte("{}")
+	}
+	outputs, _ := json.Marshal(g.Outputs)
+	if g.Outputs == nil {
+		outputs = []byte("[]")
+	}
+	res, err := s.db.Exec(s.q(`update generations set status = $1, input = $2, outputs = $3, prediction_id = $4, duration_ms = $5, error = $6, completed_at = $7
+		where id = $8 and status = $9`),
+		g.Status, string(input), string(outputs), g.PredictionID, g.DurationMs, g.Error, sqlNow(), g.ID, GenerationRunning)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return true, nil
+	}
+	// Tidak ada baris yang berubah: sudah selesai, atau memang tidak ada
+	existing, err := s.GetGeneration(g.ID)
+	if err != nil {
+		return false, err
+	}
+	if existing == nil {
+		return false, fmt.Errorf("generation_not_found")
+	}
+	return false, nil
+}
+
+const generationColumns = `id, user_id, chat_id, model_id, prompt, settings, input, cost, currency, paid_cost, status, outputs, prediction_id, duration_ms, error, created_at, completed_at`
+
+func scanGeneration(row interface{ Scan(...interface{}) error }) (*Generation, error) {
+	var g Generation
+	var settings, input, outputs []byte
+	var completed sql.NullString
+	err := row.Scan(&g.ID, &g.UserID, &g.ChatID, &g.ModelID, &g.Prompt, &settings, &input, &g.Cost, &g.Currency, &g.PaidCost, &g.Status,
+		&outputs, &g.PredictionID, &g.DurationMs, &g.Error, &g.CreatedAt, &completed)
+	if err != nil {
+		return nil, err
+	}
+	json.Unmarshal(settings, &g.Settings)
+	json.Unmarshal(input, &g.Input)
+	json.Unmarshal(outputs, &g.Outputs)
+	g.CompletedAt = completed.String
+	return &g, nil
+}
+
+func (s *SQLStore) GetGeneration(id string) (*Generation, error) {
+	g, err := scanGeneration(s.db.QueryRow(s.q(`select `+generationColumns+` from generations where id = $1`), id))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return g, err
+}
+
+func (s *SQLStore) SetGenerationOutputs(id string, outputs []string) error {
+	data, _ := json.Marshal(outputs)
+	_, err := s.db.Exec(s.q(`update generations set outputs = $1 where id = $2`), string(data), id)
+	return err
+}
+
+func (s *SQLStore) ListRunningGenerations() ([]Generation, error) {
+	rows, err := s.db.Query(s.q(`select `+generationColumns+` from generations where status = $1 order by created_at`), GenerationRunning)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []Generation
+	for rows.Next() {
+		g, err := scanGeneration(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *g)
+	}
+	return list, rows.Err()
+}
+
+func (s *SQLStore) ListGenerations(telegramID int64, offset, limit int) ([]Generation, error) {
+	rows, err := s.db.Query(s.q(`select `+generationColumns+` from generations where user_id = $1
+		order by created_at desc limit $2 offset $3`), telegramID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []Generation
+	for rows.Next() {
+		g, err := scanGeneration(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *g)
+	}
+	return list, rows.Err()
+}
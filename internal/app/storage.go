@@ -2,11 +2,14 @@ package app
 
 import (
 	"bytes"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
+	"mime"
 	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"path/filepath"
 	"time"
 )
@@ -14,14 +17,6 @@ import (
 // Nama Bucket didefinisikan sebagai konstanta agar konsisten
 const BucketName = "bot-uploads"
 
-type TelegramFileResponse struct {
-	Ok     bool `json:"ok"`
-	Result struct {
-		FileID   string `json:"file_id"`
-		FilePath string `json:"file_path"`
-	} `json:"result"`
-}
-
 // FUNGSI BARU: Cek & Buat Bucket Otomatis
 func (b *BotApp) EnsureBucketExists() error {
 	client := &http.Client{Timeout: 10 * time.Second}
@@ -74,37 +69,47 @@ func (b *BotApp) EnsureBucketExists() error {
 
 func (b *BotApp) UploadTelegramToSupabase(fileID string, userID int64) (string, error) {
 	// 1. Get File Path
-	client := &http.Client{Timeout: 30 * time.Second}
-	urlInfo := fmt.Sprintf("https://api.telegram.org/bot%s/getFile?file_id=%s", b.BotToken, fileID)
-	
-	respInfo, err := client.Get(urlInfo)
+	filePath, err := b.TG.GetFilePath(fileID)
 	if err != nil { return "", fmt.Errorf("get file info failed: %v", err) }
-	defer respInfo.Body.Close()
-
-	var fileData TelegramFileResponse
-	json.NewDecoder(respInfo.Body).Decode(&fileData)
-	if !fileData.Ok { return "", fmt.Errorf("telegram api error") }
 
 	// 2. Download Content
-	urlContent := fmt.Sprintf("https://api.telegram.org/file/bot%s/%s", b.BotToken, fileData.Result.FilePath)
-	respContent, err := client.Get(urlContent)
+	fileBytes, err := b.TG.DownloadFile(filePath)
 	if err != nil { return "", fmt.Errorf("download content failed: %v", err) }
-	defer respContent.Body.Close()
-
-	fileBytes, err := io.ReadAll(respContent.Body)
-	if err != nil { return "", err }
 
 	// 3. Filename
-	ext := filepath.Ext(fileData.Result.FilePath)
+	ext := filepath.Ext(filePath)
 	if ext == "" { ext = ".jpg" }
+
+	// Tanpa Supabase Storage (development lokal): kirim gambar inline ke Replicate
+	if b.SupabaseURL == "" {
+		mimeType := mime.TypeByExtension(ext)
+		if mimeType == "" { mimeType = "image/jpeg" }
+		return fmt.Sprintf("data:%s;base64,%s", mimeType, base64.StdEncoding.EncodeToString(fileBytes)), nil
+	}
+
 	filename := fmt.Sprintf("%d_%d%s", userID, time.Now().UnixNano(), ext)
+	return b.UploadToStorage(filename, "", fileBytes)
+}
+
+// UploadToStorage mengunggah file ke bucket publik dan mengembalikan URL publiknya.
+// contentType kosong = ditentukan Supabase dari nama file.
+func (b *BotApp) UploadToStorage(filename, contentType string, fileBytes []byte) (string, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
 
 	// 4. Upload ke Supabase (Menggunakan Constant BucketName)
 	supabaseStorageURL := fmt.Sprintf("%s/storage/v1/object/%s/%s", b.SupabaseURL, BucketName, filename)
 	
 	body := new(bytes.Buffer)
 	writer := multipart.NewWriter(body)
-	part, _ := writer.CreateFormFile("file", filename)
+	var part io.Writer
+	if contentType == "" {
+		part, _ = writer.CreateFormFile("file", filename)
+	} else {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, filename))
+		header.Set("Content-Type", contentType)
+		part, _ = writer.CreatePart(header)
+	}
 	part.Write(fileBytes)
 	writer.Close()
 
@@ -124,4 +129,4 @@ func (b *BotApp) UploadTelegramToSupabase(fileID string, userID int64) (string,
 	// 5. Public URL
 	publicURL := fmt.Sprintf("%s/storage/v1/object/public/%s/%s", b.SupabaseURL, BucketName, filename)
 	return publicURL, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,300 @@
+package app
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+type User struct {
+	ID            int64                  `json:"id"`
+	LanguageCode  string                 `json:"language_code"`
+	Credits       int                    `json:"credits"`      // jatah gratis, di-reset sesuai plan
+	PaidCredits   int                    `json:"paid_credits"` // kredit yang dibeli, tidak ikut reset
+	Diamonds      int                    `json:"diamonds"`     // mata uang premium, tidak ikut reset
+	Plan          string                 `json:"plan"`
+	PlanExpiresAt string                 `json:"plan_expires_at,omitempty"` // kosong = plan tidak kedaluwarsa (dikirim sebagai NULL)
+	LastResetDate string                 `json:"last_reset_date"`           // kunci periode reset terakhir (lihat Plan.PeriodKey)
+	CurrentState  string                 `json:"current_state"`
+	SelectedModel string                 `json:"selected_model"`
+	DraftConfig   map[string]interface{} `json:"draft_config"`
+}
+
+// Balance adalah total kredit yang bisa dipakai (gratis + dibeli)
+func (u *User) Balance() int {
+	return u.Credits + u.PaidCredits
+}
+
+// Mata uang saldo user. Kredit = jatah gratis + dibeli, diamonds = mata uang premium.
+const (
+	CurrencyCredits  = "credits"
+	CurrencyDiamonds = "diamonds"
+)
+
+// Jenis transaksi di credit_ledger
+const (
+	TxDebit      = "debit"
+	TxRefund     = "refund"
+	TxDailyReset = "daily_reset"
+	TxGrant      = "grant"
+	TxOpening    = "opening_balance" // saldo lama saat ledger pertama kali dipasang
+
+	TxPurchase       = "purchase"
+	TxPurchaseRefund = "purchase_refund"
+	TxPromo          = "promo"
+	TxReferral       = "referral"
+)
+
+// Status pembayaran Telegram Stars
+const (
+	PaymentPaid     = "paid"
+	PaymentRefunded = "refunded"
+)
+
+// Payment adalah pembelian paket kredit via Telegram Stars
+type Payment struct {
+	ChargeID      string `json:"charge_id"` // telegram_payment_charge_id
+	UserID        int64  `json:"user_id"`
+	PackID        string `json:"pack_id"`
+	Stars         int    `json:"stars"`
+	Credits       int    `json:"credits"`
+	Diamonds      int    `json:"diamonds"`
+	PlanID        string `json:"plan_id"`         // diisi untuk pembelian langganan plan
+	PlanExpiresAt string `json:"plan_expires_at"` // masa aktif plan setelah pembayaran ini
+	Status        string `json:"status"`
+	CreatedAt     string `json:"created_at"`
+}
+
+// PromoCode adalah kode promo yang bisa ditukar lewat /redeem
+type PromoCode struct {
+	Code         string `json:"code"`
+	Amount       int    `json:"amount"`
+	Currency     string `json:"currency"`       // credits | diamonds
+	MaxUses      int    `json:"max_uses"`       // 0 = tanpa batas
+	PerUserLimit int    `json:"per_user_limit"` // 0 = tanpa batas
+	Uses         int    `json:"uses"`
+	ExpiresAt    string `json:"expires_at"`    // kosong = tidak kedaluwarsa
+	AllowedPlans string `json:"allowed_plans"` // ID plan dipisah koma, kosong = semua plan
+	Disabled     bool   `json:"disabled"`
+	CreatedBy    int64  `json:"created_by"`
+	CreatedAt    string `json:"created_at"`
+}
+
+// Saldo tidak cukup saat DeductCredit/DeductDiamonds. Error lain berarti database gagal.
+var (
+	ErrInsufficientCredits  = errors.New("insufficient_credits")
+	ErrInsufficientDiamonds = errors.New("insufficient_diamonds")
+)
+
+// Alasan penukaran promo ditolak. Pesannya dipakai sebagai kunci i18n.
+var (
+	ErrPromoNotFound    = errors.New("promo_not_found")
+	ErrPromoExpired     = errors.New("promo_expired")
+	ErrPromoExhausted   = errors.New("promo_exhausted")
+	ErrPromoAlreadyUsed = errors.New("promo_already_used")
+	ErrPromoNotAllowed  = errors.New("promo_not_allowed")
+)
+
+// check memvalidasi promo untuk user dengan plan planID (tanpa batas per user)
+func (p *PromoCode) check(planID string, now time.Time) error {
+	if p.Disabled {
+		return ErrPromoNotFound
+	}
+	if p.ExpiresAt != "" {
+		if exp, err := time.Parse(time.RFC3339Nano, p.ExpiresAt); err == nil && !now.Before(exp) {
+			return ErrPromoExpired
+		}
+	}
+	if p.MaxUses > 0 && p.Uses >= p.MaxUses {
+		return ErrPromoExhausted
+	}
+	if p.AllowedPlans != "" {
+		for _, id := range strings.Split(p.AllowedPlans, ",") {
+			if strings.TrimSpace(id) == planID {
+				return nil
+			}
+		}
+		return ErrPromoNotAllowed
+	}
+	return nil
+}
+
+// Status referral
+const (
+	ReferralPending  = "pending"  // menunggu generasi pertama yang berhasil dari user yang diundang
+	ReferralRewarded = "rewarded" // bonus diberikan ke kedua pihak
+	ReferralCapped   = "capped"   // pengundang sudah mencapai batas bonus, hanya yang diundang dapat bonus
+)
+
+// Referral menghubungkan user yang diundang (referee) dengan pengundangnya (referrer)
+type Referral struct {
+	ReferrerID int64  `json:"referrer_id"`
+	RefereeID  int64  `json:"referee_id"`
+	Status     string `json:"status"`
+	CreatedAt  string `json:"created_at"`
+	RewardedAt string `json:"rewarded_at"`
+}
+
+// ReferralPolicy adalah besar bonus dan batas anti-abuse program referral (config/referral.json)
+type ReferralPolicy struct {
+	Currency      string `json:"currency"`
+	ReferrerBonus int    `json:"referrer_bonus"`
+	RefereeBonus  int    `json:"referee_bonus"`
+	MaxPerDay     int    `json:"max_rewards_per_day"` // bonus pengundang per 24 jam, 0 = tanpa batas
+	MaxTotal      int    `json:"max_rewards_total"`   // bonus pengundang seumur hidup, 0 = tanpa batas
+}
+
+// Status generasi di tabel generations
+const (
+	GenerationRunning   = "running"
+	GenerationSucceeded = "succeeded"
+	GenerationFailed    = "failed"
+	GenerationCanceled  = "canceled" // dibatalkan shutdown, biaya di-refund
+)
+
+// Generation adalah satu permintaan generasi beserta hasilnya (/history)
+type Generation struct {
+	ID           string                 `json:"id"` // sama dengan generation_id di credit_ledger
+	UserID       int64                  `json:"user_id"`
+	ChatID       int64                  `json:"chat_id"` // tujuan hasil yang dikirim lewat webhook
+	ModelID      string                 `json:"model_id"`
+	Prompt       string                 `json:"prompt"`
+	Settings     map[string]interface{} `json:"settings"` // draft_config user, dipakai ulang lewat /history
+	Input        map[string]interface{} `json:"input"`    // payload final yang dikirim ke model
+	Cost         int                    `json:"cost"`
+	Currency     string                 `json:"currency"`
+	PaidCost     int                    `json:"paid_cost"` // bagian Cost dari paid_credits, untuk refund
+	Status       string                 `json:"status"`
+	Outputs      []string               `json:"outputs"`
+	PredictionID string                 `json:"prediction_id"`
+	DurationMs   int64                  `json:"duration_ms"`
+	Error        string                 `json:"error"`
+	CreatedAt    string                 `json:"created_at"`
+	CompletedAt  string                 `json:"completed_at"`
+}
+
+// CreditMeta menjelaskan alasan sebuah transaksi kredit
+type CreditMeta struct {
+	Reason       string
+	ModelID      string
+	GenerationID string
+	Paid         int // bagian amount yang masuk ke paid_credits (AddCredit), sisanya ke jatah gratis
+}
+
+type CreditTransaction struct {
+	ID           int64  `json:"id"`
+	UserID       int64  `json:"user_id"`
+	Currency     string `json:"currency"` // credits | diamonds
+	Amount       int    `json:"amount"`
+	BalanceAfter int    `json:"balance_after"` // saldo mata uang yang sama setelah transaksi
+	Kind         string `json:"kind"`
+	Reason       string `json:"reason"`
+	ModelID      string `json:"model_id"`
+	GenerationID string `json:"generation_id"`
+	CreatedAt    string `json:"created_at"`
+}
+
+// UserStore mencakup semua operasi pada tabel users.
+// DeductCredit, AddCredit dan ResetAllowance wajib atomik di setiap implementasi.
+// DeductCredit memakai jatah gratis dulu, lalu paid_credits, dan mengembalikan
+// berapa paid_credits yang terpakai (untuk refund ke saldo yang benar).
+// Saldo di ledger (balance_after) selalu total gratis + dibeli.
+// DeductDiamonds dan AddDiamonds sama atomiknya, dicatat di ledger dengan currency diamonds.
+type UserStore interface {
+	GetOrCreateUser(telegramID int64) (*User, error)
+	UpdateState(telegramID int64, state string, modelKey string) error
+	UpdateCurrentState(telegramID int64, state string) error
+	UpdateDraftConfig(telegramID int64, key string, value interface{}) error
+	ClearState(telegramID int64) error
+	DeductCredit(telegramID int64, amount int, meta CreditMeta) (int, error)
+	AddCredit(telegramID int64, amount int, kind string, meta CreditMeta) error
+	DeductDiamonds(telegramID int64, amount int, meta CreditMeta) error
+	AddDiamonds(telegramID int64, amount int, kind string, meta CreditMeta) error
+	ResetAllowance(telegramID int64, lastPeriod, period string, allowance int, topUp bool) (int, bool, error)
+	SetLanguage(telegramID int64, lang string) error
+	SetPlan(telegramID int64, planID, expiresAt string) error
+}
+
+// LedgerStore membaca riwayat transaksi kredit
+type LedgerStore interface {
+	GetCreditHistory(telegramID int64, limit int) ([]CreditTransaction, error)
+}
+
+// UpdateStore menyimpan offset getUpdates dan catatan idempotensi update
+type UpdateStore interface {
+	GetUpdateOffset() (int, error)
+	SaveUpdateOffset(offset int) error
+	// ClaimUpdate mencatat update sebelum diproses; false jika sudah pernah diklaim.
+	// Klaim tidak pernah diulang: update yang gagal di tengah handler tidak diproses lagi.
+	ClaimUpdate(updateID int, callbackID string) (bool, error)
+	PruneProcessedUpdates(maxAge time.Duration) error
+}
+
+// PaymentStore mencatat pembelian kredit. CreditPurchase mencatat pembayaran dan
+// menambah paid_credits dan diamonds dalam satu transaksi; false jika charge ID sudah pernah dicatat.
+// RefundPurchase menandai pembayaran refunded dan menarik kembali isi paket
+// (maksimal sebesar saldo yang tersisa), mengembalikan kredit dan diamonds yang ditarik.
+// Pembayaran dengan PlanID juga mengaktifkan plan tersebut sampai PlanExpiresAt (ikut
+// disimpan di baris pembayaran); refund-nya hanya mencabut masa aktif yang berasal dari
+// pembayaran itu (lihat planAfterRefund).
+type PaymentStore interface {
+	CreditPurchase(p Payment) (bool, error)
+	GetPayment(chargeID string) (*Payment, error)
+	RefundPurchase(chargeID string) (credits int, diamonds int, err error)
+}
+
+// PromoStore menyimpan kode promo. RedeemPromo memvalidasi kode, mencatat penukaran
+// dan menambah saldo (kredit masuk ke paid_credits agar tidak hilang saat reset)
+// dalam satu transaksi. Kode selalu disimpan dalam huruf besar.
+type PromoStore interface {
+	CreatePromo(p PromoCode) error
+	ListPromos() ([]PromoCode, error)
+	DisablePromo(code string) (bool, error)
+	RedeemPromo(code string, telegramID int64, planID string) (*PromoCode, error)
+}
+
+// ReferralStore menyimpan undangan. CreateReferral hanya berhasil untuk user yang
+// belum pernah diundang, belum pernah generate dan bukan pengundangnya sendiri.
+// CompleteReferral menandai referral pending sebagai selesai dan memberi bonus
+// (masuk ke paid_credits/diamonds) dalam satu transaksi; nil jika tidak ada yang pending.
+type ReferralStore interface {
+	CreateReferral(referrerID, refereeID int64) (bool, error)
+	CompleteReferral(refereeID int64, policy ReferralPolicy) (*Referral, error)
+	ReferralStats(referrerID int64) (invited int, rewarded int, err error)
+}
+
+// GenerationStore menyimpan riwayat generasi. CreateGeneration dipanggil saat
+// biaya sudah dipotong (status running), FinishGeneration mengisi status akhir,
+// payload, output, prediction ID, durasi dan error. FinishGeneration hanya
+// mengubah generasi yang masih running dan mengembalikan false jika sudah
+// selesai, sehingga webhook yang terkirim dua kali tidak diproses ulang.
+// SetGenerationOutputs mengganti output generasi yang sudah selesai (mis. setelah
+// di-rehost). ListGenerations mengurutkan dari yang terbaru; ListRunningGenerations
+// dipakai saat startup untuk mencocokkan generasi yang tertinggal dengan backend.
+type GenerationStore interface {
+	CreateGeneration(g Generation) error
+	SetGenerationPrediction(id, predictionID string) error
+	FinishGeneration(g Generation) (bool, error)
+	SetGenerationOutputs(id string, outputs []string) error
+	GetGeneration(id string) (*Generation, error)
+	ListGenerations(telegramID int64, offset, limit int) ([]Generation, error)
+	ListRunningGenerations() ([]Generation, error)
+}
+
+// Store adalah gabungan semua kebutuhan penyimpanan bot.
+// Implementasi: Database (Supabase), SQLStore (Postgres/SQLite), MemoryStore.
+type Store interface {
+	UserStore
+	LedgerStore
+	UpdateStore
+	PaymentStore
+	PromoStore
+	ReferralStore
+	GenerationStore
+}
+
+var (
+	_ Store = (*Database)(nil)
+	_ Store = (*SQLStore)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
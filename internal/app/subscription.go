@@ -0,0 +1,215 @@
+package app
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const planPayloadPrefix = "plan:"
+
+// planFromPayload mengurai invoice_payload "plan:<id>"
+func (b *BotApp) planFromPayload(payload string) (Plan, bool) {
+	if !strings.HasPrefix(payload, planPayloadPrefix) {
+		return Plan{}, false
+	}
+	id := strings.TrimPrefix(payload, planPayloadPrefix)
+	if !b.Plans.Has(id) {
+		return Plan{}, false
+	}
+	plan := b.Plans.Get(id)
+	return plan, plan.Purchasable()
+}
+
+// formatPlanExpiry menulis masa aktif plan user, kosong jika tidak kedaluwarsa
+func (b *BotApp) formatPlanExpiry(lang string, user *User) string {
+	exp, ok := planExpiry(user)
+	if !ok {
+		return ""
+	}
+	return b.I18n.Get(lang, "plan_until", exp.UTC().Format("2006-01-02 15:04")+" UTC")
+}
+
+// planButtons membuat tombol beli untuk plan yang dijual, opsional hanya yang membuka tier tertentu
+func (b *BotApp) planButtons(lang string, current Plan, tier string) []map[string]string {
+	var buttons []map[string]string
+	for _, p := range b.Plans.List() {
+		if !p.Purchasable() || (tier != "" && !p.AllowsTier(tier)) {
+			continue
+		}
+		label := "plan_buy_btn"
+		if p.ID == current.ID {
+			label = "plan_renew_btn"
+		}
+		buttons = append(buttons, map[string]string{
+			"text":          b.I18n.Get(lang, label, p.Name, p.Stars, p.DurationDays),
+			"callback_data": "plan_" + p.ID,
+		})
+	}
+	return buttons
+}
+
+// ShowPlans menampilkan plan aktif user dan semua plan yang tersedia (/plans)
+func (b *BotApp) ShowPlans(chatID int64, user *User) {
+	current := b.UserPlan(user)
+	text := b.I18n.Get(user.LanguageCode, "plans_header", current.Name, b.formatPlanExpiry(user.LanguageCode, user))
+
+	for _, p := range b.Plans.List() {
+		tiers := b.I18n.Get(user.LanguageCode, "tiers_all")
+		if len(p.Tiers) > 0 {
+			tiers = strings.Join(p.Tiers, ", ")
+		}
+		text += b.I18n.Get(user.LanguageCode, "plan_line", p.Name, p.Allowance, b.I18n.Get(user.LanguageCode, "period_"+p.ResetPeriod), tiers, p.Concurrency())
+		if p.Purchasable() {
+			text += b.I18n.Get(user.LanguageCode, "plan_price", p.Stars, p.DurationDays)
+		}
+	}
+
+	b.TG.SendMessage(chatID, text, b.planButtons(user.LanguageCode, current, ""))
+}
+
+// ShowModelLocked menampilkan upsell untuk model yang tier-nya tidak termasuk plan user
+func (b *BotApp) ShowModelLocked(chatID int64, msgID int, user *User, modelConf ModelConfig) {
+	current := b.UserPlan(user)
+	text := b.I18n.Get(user.LanguageCode, "model_locked", modelConf.Name, modelConf.Tier, current.Name)
+
+	buttons := b.planButtons(user.LanguageCode, current, modelConf.Tier)
+	if len(buttons) == 0 {
+		text += "\n\n" + b.I18n.Get(user.LanguageCode, "plans_unavailable")
+	}
+
+	if msgID == 0 {
+		b.TG.SendMessage(chatID, text, buttons)
+		return
+	}
+	buttons = append(buttons, map[string]string{"text": b.I18n.Get(user.LanguageCode, "back_to_prov"), "callback_data": "nav_providers"})
+	b.TG.EditMessageText(chatID, msgID, text, buttons)
+}
+
+// SendPlanInvoice mengirim invoice XTR untuk langganan plan
+func (b *BotApp) SendPlanInvoice(chatID int64, user *User, planID string) {
+	plan, ok := b.planFromPayload(planPayloadPrefix + planID)
+	if !ok {
+		b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "error_generic"), nil)
+		return
+	}
+	desc := b.I18n.Get(user.LanguageCode, "plan_invoice_desc", plan.Name, plan.DurationDays)
+	if err := b.TG.SendInvoice(chatID, plan.Name, desc, planPayloadPrefix+plan.ID, plan.Stars); err != nil {
+		fmt.Printf("[ERROR] sendInvoice plan for %d: %v\n", user.ID, err)
+		b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "error_generic"), nil)
+	}
+}
+
+// planExpiryAfterPurchase menghitung masa aktif baru. Membeli plan yang sama
+// memperpanjang dari sisa masa aktif, plan lain dihitung dari sekarang.
+func planExpiryAfterPurchase(user *User, plan Plan, now time.Time) string {
+	base := now
+	if user.Plan == plan.ID {
+		exp, ok := planExpiry(user)
+		if !ok {
+			return "" // plan permanen dari admin tetap permanen
+		}
+		if exp.After(now) {
+			base = exp
+		}
+	}
+	return base.Add(time.Duration(plan.DurationDays) * 24 * time.Hour).UTC().Format(time.RFC3339)
+}
+
+// planAfterRefund menentukan plan user setelah pembayaran plan p di-refund. Plan hanya
+// diubah jika masa aktif user persis berasal dari p (belum diperpanjang pembayaran lain
+// atau /grant); masa aktif dikembalikan ke pembayaran plan sebelumnya yang masih berlaku
+// (otherExpiries), atau plan dicabut. changed = false berarti plan user dibiarkan.
+func planAfterRefund(user *User, p *Payment, otherExpiries []string, now time.Time) (plan, expiresAt string, changed bool) {
+	if p.PlanID == "" || user.Plan != p.PlanID {
+		return user.Plan, user.PlanExpiresAt, false
+	}
+	paid, err := time.Parse(time.RFC3339Nano, p.PlanExpiresAt)
+	current, ok := planExpiry(user)
+	if err != nil || !ok || !current.Equal(paid) {
+		return user.Plan, user.PlanExpiresAt, false
+	}
+
+	var prev time.Time
+	for _, value := range otherExpiries {
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err == nil && t.After(now) && t.Before(paid) && t.After(prev) {
+			prev = t
+		}
+	}
+	if prev.IsZero() {
+		return "", "", true
+	}
+	return p.PlanID, prev.UTC().Format(time.RFC3339), true
+}
+
+// completePlanPurchase mencatat pembayaran langganan dan mengaktifkan plan secara atomik
+func (b *BotApp) completePlanPurchase(chatID int64, user *User, plan Plan, sp *SuccessfulPayment) {
+	payment := Payment{
+		ChargeID:      sp.TelegramPaymentChargeID,
+		UserID:        user.ID,
+		PackID:        planPayloadPrefix + plan.ID,
+		Stars:         sp.TotalAmount,
+		PlanID:        plan.ID,
+		PlanExpiresAt: planExpiryAfterPurchase(user, plan, time.Now()),
+	}
+	credited, err := b.DB.CreditPurchase(payment)
+	if err != nil {
+		fmt.Printf("[ERROR] Payment %s: activate plan %s for %d: %v\n", payment.ChargeID, plan.ID, user.ID, err)
+		b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "payment_failed"), nil)
+		return
+	}
+	if !credited {
+		fmt.Printf("[INFO] Payment %s already credited\n", payment.ChargeID)
+		return
+	}
+
+	fmt.Printf("[INFO] Payment %s | User: %d | Plan: %s until %s\n", payment.ChargeID, user.ID, plan.ID, payment.PlanExpiresAt)
+	user.Plan, user.PlanExpiresAt = plan.ID, payment.PlanExpiresAt
+	b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "plan_activated", plan.Name, b.formatPlanExpiry(user.LanguageCode, user)), nil)
+}
+
+// handleSetPlanCommand: /setplan USER_ID PLAN_ID [DAYS] (khusus admin). Tanpa DAYS plan tidak kedaluwarsa.
+func (b *BotApp) handleSetPlanCommand(chatID int64, admin *User, args string) {
+	fields := strings.Fields(args)
+	if len(fields) < 2 || len(fields) > 3 {
+		b.TG.SendMessage(chatID, b.I18n.Get(admin.LanguageCode, "setplan_usage"), nil)
+		return
+	}
+	targetID, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || !b.Plans.Has(fields[1]) {
+		b.TG.SendMessage(chatID, b.I18n.Get(admin.LanguageCode, "setplan_usage"), nil)
+		return
+	}
+	plan := b.Plans.Get(fields[1])
+
+	expiresAt := ""
+	if len(fields) == 3 {
+		days, err := strconv.Atoi(fields[2])
+		if err != nil || days <= 0 {
+			b.TG.SendMessage(chatID, b.I18n.Get(admin.LanguageCode, "setplan_usage"), nil)
+			return
+		}
+		expiresAt = time.Now().Add(time.Duration(days) * 24 * time.Hour).UTC().Format(time.RFC3339)
+	}
+
+	planID := plan.ID
+	if planID == b.Plans.DefaultPlan {
+		planID, expiresAt = "", ""
+	}
+	target, err := b.GetUser(targetID)
+	if err == nil {
+		err = b.DB.SetPlan(targetID, planID, expiresAt)
+	}
+	if err != nil {
+		fmt.Printf("[ERROR] Set plan %s for %d: %v\n", plan.ID, targetID, err)
+		b.TG.SendMessage(chatID, b.I18n.Get(admin.LanguageCode, "error_generic"), nil)
+		return
+	}
+
+	fmt.Printf("[INFO] Admin %d set plan %s for user %d (expires: %q)\n", admin.ID, plan.ID, targetID, expiresAt)
+	target.Plan, target.PlanExpiresAt = planID, expiresAt
+	b.TG.SendMessage(chatID, b.I18n.Get(admin.LanguageCode, "setplan_done", targetID, plan.Name, b.formatPlanExpiry(admin.LanguageCode, target)), nil)
+	b.TG.SendMessage(targetID, b.I18n.Get(target.LanguageCode, "plan_activated", plan.Name, b.formatPlanExpiry(target.LanguageCode, target)), nil)
+}
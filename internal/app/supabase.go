@@ -1,25 +1,25 @@
 package app
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/supabase-community/postgrest-go"
 	"github.com/supabase-community/supabase-go"
 )
 
-type User struct {
-	ID            int64                  `json:"id"`
-	LanguageCode  string                 `json:"language_code"`
-	Credits       int                    `json:"credits"`
-	LastResetDate string                 `json:"last_reset_date"`
-	CurrentState  string                 `json:"current_state"`
-	SelectedModel string                 `json:"selected_model"`
-	DraftConfig   map[string]interface{} `json:"draft_config"`
-}
-
+// Database adalah implementasi Store di atas Supabase (PostgREST + fungsi RPC di db/schema.sql)
 type Database struct {
 	client *supabase.Client
+	url    string
+	key    string
+	http   *http.Client
 }
 
 func NewDatabase(url, key string) (*Database, error) {
@@ -27,7 +27,43 @@ func NewDatabase(url, key string) (*Database, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Database{client: client}, nil
+	return &Database{
+		client: client,
+		url:    strings.TrimRight(url, "/"),
+		key:    key,
+		http:   &http.Client{Timeout: 15 * time.Second},
+	}, nil
+}
+
+// rpc memanggil fungsi Postgres lewat PostgREST (/rest/v1/rpc/<name>) dan
+// men-decode hasilnya ke out. Dipakai untuk operasi yang harus atomik di database.
+func (db *Database) rpc(name string, params map[string]interface{}, out interface{}) error {
+	jsonData, _ := json.Marshal(params)
+	req, _ := http.NewRequest("POST", fmt.Sprintf("%s/rest/v1/rpc/%s", db.url, name), bytes.NewBuffer(jsonData))
+	req.Header.Set("Authorization", "Bearer "+db.key)
+	req.Header.Set("apikey", db.key)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := db.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("rpc %s error %d: %s", name, resp.StatusCode, string(body))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(body, out)
+}
+
+// isUniqueViolation mengenali unique_violation (SQLSTATE 23505). postgrest-go tidak
+// mengembalikan error bertipe; kode PostgREST selalu ditulis sebagai "(<code>) <message>".
+func isUniqueViolation(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "(23505)")
 }
 
 func (db *Database) GetOrCreateUser(telegramID int64) (*User, error) {
@@ -40,13 +76,12 @@ func (db *Database) GetOrCreateUser(telegramID int64) (*User, error) {
 	json.Unmarshal(data, &users)
 
 	if len(users) == 0 {
+		// Jatah awal diberikan oleh ResetAllowance pada periode pertama
 		newUser := User{
-			ID:            telegramID,
-			LanguageCode:  "en",
-			Credits:       5,
-			LastResetDate: time.Now().UTC().Format("2006-01-02"),
-			CurrentState:  "",
-			DraftConfig:   make(map[string]interface{}),
+			ID:           telegramID,
+			LanguageCode: "en",
+			CurrentState: "",
+			DraftConfig:  make(map[string]interface{}),
 		}
 		_, _, err := db.client.From("users").Insert(newUser, false, "", "", "").Execute()
 		if err != nil {
@@ -59,17 +94,6 @@ func (db *Database) GetOrCreateUser(telegramID int64) (*User, error) {
 	if user.DraftConfig == nil {
 		user.DraftConfig = make(map[string]interface{})
 	}
-	
-	today := time.Now().UTC().Format("2006-01-02")
-	if user.LastResetDate != today {
-		updates := map[string]interface{}{
-			"credits":         5,
-			"last_reset_date": today,
-		}
-		db.client.From("users").Update(updates, "", "").Eq("id", fmt.Sprintf("%d", telegramID)).Execute()
-		user.Credits = 5
-	}
-
 	return user, nil
 }
 
@@ -118,29 +142,423 @@ func (db *Database) ClearState(telegramID int64) error {
 	return err
 }
 
-func (db *Database) DeductCredit(telegramID int64, amount int) error {
-	user, err := db.GetOrCreateUser(telegramID)
-	if err != nil {
+// DeductCredit memotong kredit secara atomik di database (decrement-if-sufficient),
+// sehingga dua generasi bersamaan tidak bisa sama-sama lolos pengecekan saldo.
+// Transaksi debit dicatat di credit_ledger dalam transaksi yang sama.
+func (db *Database) DeductCredit(telegramID int64, amount int, meta CreditMeta) (int, error) {
+	var result *struct {
+		Balance  int `json:"balance"`
+		PaidUsed int `json:"paid_used"`
+	}
+	params := creditParams(telegramID, amount, meta)
+	if err := db.rpc("deduct_credits", params, &result); err != nil {
+		return 0, err
+	}
+	if result == nil {
+		return 0, ErrInsufficientCredits
+	}
+	return result.PaidUsed, nil
+}
+
+// AddCredit menambah kredit secara atomik (credits = credits + amount) dan mencatatnya
+// di credit_ledger dengan jenis kind (refund, grant, ...). meta.Paid masuk ke paid_credits.
+func (db *Database) AddCredit(telegramID int64, amount int, kind string, meta CreditMeta) error {
+	var balance *int
+	params := creditParams(telegramID, amount, meta)
+	params["p_kind"] = kind
+	params["p_paid"] = meta.Paid
+	if err := db.rpc("add_credits", params, &balance); err != nil {
 		return err
 	}
-	if user.Credits < amount {
-		return fmt.Errorf("insufficient_credits")
+	if balance == nil {
+		return fmt.Errorf("user_not_found")
 	}
-	newCredits := user.Credits - amount
-	_, _, err = db.client.From("users").Update(map[string]interface{}{"credits": newCredits}, "", "").Eq("id", fmt.Sprintf("%d", telegramID)).Execute()
-	return err
+	return nil
 }
 
-func (db *Database) AddCredit(telegramID int64, amount int) error {
-	user, err := db.GetOrCreateUser(telegramID)
-	if err != nil {
+// DeductDiamonds memotong diamonds secara atomik lewat fungsi deduct_diamonds
+func (db *Database) DeductDiamonds(telegramID int64, amount int, meta CreditMeta) error {
+	var balance *int
+	if err := db.rpc("deduct_diamonds", creditParams(telegramID, amount, meta), &balance); err != nil {
 		return err
 	}
-	_, _, err = db.client.From("users").Update(map[string]interface{}{"credits": user.Credits + amount}, "", "").Eq("id", fmt.Sprintf("%d", telegramID)).Execute()
-	return err
+	if balance == nil {
+		return ErrInsufficientDiamonds
+	}
+	return nil
+}
+
+// AddDiamonds menambah diamonds secara atomik lewat fungsi add_diamonds
+func (db *Database) AddDiamonds(telegramID int64, amount int, kind string, meta CreditMeta) error {
+	var balance *int
+	params := creditParams(telegramID, amount, meta)
+	params["p_kind"] = kind
+	if err := db.rpc("add_diamonds", params, &balance); err != nil {
+		return err
+	}
+	if balance == nil {
+		return fmt.Errorf("user_not_found")
+	}
+	return nil
+}
+
+// ResetAllowance mengisi ulang jatah gratis jika last_reset_date masih lastPeriod.
+// Pengecekan dan penulisan ledger terjadi dalam satu transaksi (reset_allowance),
+// jadi jika dua request reset bersamaan hanya satu yang menang.
+func (db *Database) ResetAllowance(telegramID int64, lastPeriod, period string, allowance int, topUp bool) (int, bool, error) {
+	var credits *int
+	params := map[string]interface{}{
+		"p_user_id":     telegramID,
+		"p_allowance":   allowance,
+		"p_top_up":      topUp,
+		"p_period":      period,
+		"p_last_period": lastPeriod,
+	}
+	if err := db.rpc("reset_allowance", params, &credits); err != nil {
+		return 0, false, err
+	}
+	if credits == nil {
+		return 0, false, nil
+	}
+	return *credits, true, nil
+}
+
+// GetCreditHistory mengembalikan transaksi terbaru user (paling baru dulu)
+func (db *Database) GetCreditHistory(telegramID int64, limit int) ([]CreditTransaction, error) {
+	data, _, err := db.client.From("credit_ledger").Select("*", "", false).
+		Eq("user_id", fmt.Sprintf("%d", telegramID)).
+		Order("id", &postgrest.OrderOpts{Ascending: false}).
+		Limit(limit, "").Execute()
+	if err != nil {
+		return nil, err
+	}
+	var txs []CreditTransaction
+	err = json.Unmarshal(data, &txs)
+	return txs, err
+}
+
+func creditParams(telegramID int64, amount int, meta CreditMeta) map[string]interface{} {
+	return map[string]interface{}{
+		"p_user_id":       telegramID,
+		"p_amount":        amount,
+		"p_reason":        meta.Reason,
+		"p_model_id":      meta.ModelID,
+		"p_generation_id": meta.GenerationID,
+	}
 }
 
 func (db *Database) SetLanguage(telegramID int64, lang string) error {
 	_, _, err := db.client.From("users").Update(map[string]interface{}{"language_code": lang}, "", "").Eq("id", fmt.Sprintf("%d", telegramID)).Execute()
 	return err
-}
\ No newline at end of file
+}
+
+// SetPlan mengganti plan user; expiresAt kosong = tidak kedaluwarsa
+func (db *Database) SetPlan(telegramID int64, planID, expiresAt string) error {
+	var expires interface{}
+	if expiresAt != "" {
+		expires = expiresAt
+	}
+	_, _, err := db.client.From("users").Update(map[string]interface{}{"plan": planID, "plan_expires_at": expires}, "", "").Eq("id", fmt.Sprintf("%d", telegramID)).Execute()
+	return err
+}
+
+// GetUpdateOffset membaca offset getUpdates yang tersimpan (0 jika belum ada)
+func (db *Database) GetUpdateOffset() (int, error) {
+	data, _, err := db.client.From("bot_state").Select("value", "", false).Eq("key", "update_offset").Execute()
+	if err != nil {
+		return 0, err
+	}
+	var rows []struct {
+		Value string `json:"value"`
+	}
+	json.Unmarshal(data, &rows)
+	if len(rows) == 0 {
+		return 0, nil
+	}
+	return strconv.Atoi(rows[0].Value)
+}
+
+func (db *Database) SaveUpdateOffset(offset int) error {
+	row := map[string]interface{}{"key": "update_offset", "value": strconv.Itoa(offset)}
+	_, _, err := db.client.From("bot_state").Upsert(row, "key", "", "").Execute()
+	return err
+}
+
+// ClaimUpdate mencatat update sebelum diproses. Mengembalikan false jika
+// update_id atau callback_query_id sudah pernah diklaim (redelivery).
+func (db *Database) ClaimUpdate(updateID int, callbackID string) (bool, error) {
+	row := map[string]interface{}{"update_id": updateID}
+	if callbackID != "" {
+		row["callback_query_id"] = callbackID
+	}
+	_, _, err := db.client.From("processed_updates").Insert(row, false, "", "minimal", "").Execute()
+	if isUniqueViolation(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// PruneProcessedUpdates menghapus catatan idempotensi yang lebih tua dari maxAge.
+// Telegram hanya menyimpan update selama 24 jam, jadi catatan lama tidak dibutuhkan.
+func (db *Database) PruneProcessedUpdates(maxAge time.Duration) error {
+	cutoff := time.Now().UTC().Add(-maxAge).Format(time.RFC3339)
+	_, _, err := db.client.From("processed_updates").Delete("minimal", "").Lt("created_at", cutoff).Execute()
+	return err
+}
+
+// CreditPurchase mencatat pembayaran dan menambah paid_credits/diamonds (atau mengaktifkan plan) lewat fungsi credit_purchase
+func (db *Database) CreditPurchase(p Payment) (bool, error) {
+	var balance *int
+	params := map[string]interface{}{
+		"p_charge_id": p.ChargeID,
+		"p_user_id":   p.UserID,
+		"p_pack_id":   p.PackID,
+		"p_stars":     p.Stars,
+		"p_credits":   p.Credits,
+		"p_diamonds":  p.Diamonds,
+	}
+	if p.PlanID != "" {
+		params["p_plan_id"] = p.PlanID
+		params["p_plan_expires_at"] = p.PlanExpiresAt
+	}
+	if err := db.rpc("credit_purchase", params, &balance); err != nil {
+		return false, err
+	}
+	return balance != nil, nil
+}
+
+func (db *Database) GetPayment(chargeID string) (*Payment, error) {
+	data, _, err := db.client.From("payments").Select("*", "", false).Eq("charge_id", chargeID).Execute()
+	if err != nil {
+		return nil, err
+	}
+	var payments []Payment
+	json.Unmarshal(data, &payments)
+	if len(payments) == 0 {
+		return nil, nil
+	}
+	return &payments[0], nil
+}
+
+// RefundPurchase menandai pembayaran refunded dan menarik isi paket lewat fungsi refund_purchase
+func (db *Database) RefundPurchase(chargeID string) (int, int, error) {
+	var revoked *struct {
+		Credits  int `json:"credits"`
+		Diamonds int `json:"diamonds"`
+	}
+	if err := db.rpc("refund_purchase", map[string]interface{}{"p_charge_id": chargeID}, &revoked); err != nil {
+		return 0, 0, err
+	}
+	if revoked == nil {
+		return 0, 0, fmt.Errorf("payment_not_found_or_refunded")
+	}
+	return revoked.Credits, revoked.Diamonds, nil
+}
+
+func (db *Database) CreatePromo(p PromoCode) error {
+	row := map[string]interface{}{
+		"code":           strings.ToUpper(p.Code),
+		"amount":         p.Amount,
+		"currency":       p.Currency,
+		"max_uses":       p.MaxUses,
+		"per_user_limit": p.PerUserLimit,
+		"allowed_plans":  p.AllowedPlans,
+		"created_by":     p.CreatedBy,
+	}
+	if p.ExpiresAt != "" {
+		row["expires_at"] = p.ExpiresAt
+	}
+	_, _, err := db.client.From("promo_codes").Insert(row, false, "", "minimal", "").Execute()
+	if isUniqueViolation(err) {
+		return fmt.Errorf("promo_exists")
+	}
+	return err
+}
+
+func (db *Database) ListPromos() ([]PromoCode, error) {
+	data, _, err := db.client.From("promo_codes").Select("*", "", false).
+		Order("created_at", &postgrest.OrderOpts{Ascending: false}).Execute()
+	if err != nil {
+		return nil, err
+	}
+	var list []PromoCode
+	err = json.Unmarshal(data, &list)
+	return list, err
+}
+
+func (db *Database) DisablePromo(code string) (bool, error) {
+	data, _, err := db.client.From("promo_codes").Update(map[string]interface{}{"disabled": true}, "representation", "").
+		Eq("code", strings.ToUpper(code)).Execute()
+	if err != nil {
+		return false, err
+	}
+	var rows []PromoCode
+	json.Unmarshal(data, &rows)
+	return len(rows) > 0, nil
+}
+
+// RedeemPromo memvalidasi dan menukar kode promo secara atomik lewat fungsi redeem_promo
+func (db *Database) RedeemPromo(code string, telegramID int64, planID string) (*PromoCode, error) {
+	var result struct {
+		Error string     `json:"error"`
+		Promo *PromoCode `json:"promo"`
+	}
+	params := map[string]interface{}{
+		"p_code":    strings.ToUpper(code),
+		"p_user_id": telegramID,
+		"p_plan":    planID,
+	}
+	if err := db.rpc("redeem_promo", params, &result); err != nil {
+		return nil, err
+	}
+	for _, e := range []error{ErrPromoNotFound, ErrPromoExpired, ErrPromoExhausted, ErrPromoAlreadyUsed, ErrPromoNotAllowed} {
+		if result.Error == e.Error() {
+			return nil, e
+		}
+	}
+	if result.Promo == nil {
+		return nil, fmt.Errorf("redeem_promo: unexpected response %q", result.Error)
+	}
+	return result.Promo, nil
+}
+
+// CreateReferral mencatat undangan lewat fungsi create_referral (lihat ReferralStore)
+func (db *Database) CreateReferral(referrerID, refereeID int64) (bool, error) {
+	var created bool
+	params := map[string]interface{}{"p_referrer_id": referrerID, "p_referee_id": refereeID}
+	err := db.rpc("create_referral", params, &created)
+	return created, err
+}
+
+// CompleteReferral memberi bonus referral secara atomik lewat fungsi complete_referral
+func (db *Database) CompleteReferral(refereeID int64, policy ReferralPolicy) (*Referral, error) {
+	var r *Referral
+	params := map[string]interface{}{
+		"p_referee_id":     refereeID,
+		"p_currency":       policy.Currency,
+		"p_referrer_bonus": policy.ReferrerBonus,
+		"p_referee_bonus":  policy.RefereeBonus,
+		"p_max_per_day":    policy.MaxPerDay,
+		"p_max_total":      policy.MaxTotal,
+	}
+	if err := db.rpc("complete_referral", params, &r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (db *Database) ReferralStats(referrerID int64) (int, int, error) {
+	data, _, err := db.client.From("referrals").Select("status", "", false).
+		Eq("referrer_id", fmt.Sprintf("%d", referrerID)).Execute()
+	if err != nil {
+		return 0, 0, err
+	}
+	var rows []Referral
+	json.Unmarshal(data, &rows)
+	rewarded := 0
+	for _, r := range rows {
+		if r.Status == ReferralRewarded {
+			rewarded++
+		}
+	}
+	return len(rows), rewarded, nil
+}
+
+func (db *Database) CreateGeneration(g Generation) error {
+	row := map[string]interface{}{
+		"id":        g.ID,
+		"user_id":   g.UserID,
+		"chat_id":   g.ChatID,
+		"model_id":  g.ModelID,
+		"prompt":    g.Prompt,
+		"settings":  g.Settings,
+		"cost":      g.Cost,
+		"currency":  g.Currency,
+		"paid_cost": g.PaidCost,
+		"status":    GenerationRunning,
+	}
+	_, _, err := db.client.From("generations").Insert(row, false, "", "minimal", "").Execute()
+	return err
+}
+
+func (db *Database) SetGenerationPrediction(id, predictionID string) error {
+	row := map[string]interface{}{"prediction_id": predictionID}
+	_, _, err := db.client.From("generations").Update(row, "", "").Eq("id", id).Execute()
+	return err
+}
+
+func (db *Database) FinishGeneration(g Generation) (bool, error) {
+	outputs := g.Outputs
+	if outputs == nil {
+		outputs = []string{}
+	}
+	// Kolom input not null; generasi yang gagal/dibatalkan sebelum input dibuat tidak punya input
+	input := g.Input
+	if input == nil {
+		input = map[string]interface{}{}
+	}
+	row := map[string]interface{}{
+		"status":        g.Status,
+		"input":         input,
+		"outputs":       outputs,
+		"prediction_id": g.PredictionID,
+		"duration_ms":   g.DurationMs,
+		"error":         g.Error,
+		"completed_at":  time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	// Hanya generasi yang masih running; baris yang dikembalikan menandakan update berhasil
+	data, _, err := db.client.From("generations").Update(row, "representation", "").
+		Eq("id", g.ID).Eq("status", GenerationRunning).Execute()
+	if err != nil {
+		return false, err
+	}
+	var rows []Generation
+	if err := json.Unmarshal(data, &rows); err != nil {
+		return false, err
+	}
+	return len(rows) > 0, nil
+}
+
+func (db *Database) GetGeneration(id string) (*Generation, error) {
+	data, _, err := db.client.From("generations").Select("*", "", false).Eq("id", id).Execute()
+	if err != nil {
+		return nil, err
+	}
+	var rows []Generation
+	json.Unmarshal(data, &rows)
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	return &rows[0], nil
+}
+
+func (db *Database) SetGenerationOutputs(id string, outputs []string) error {
+	row := map[string]interface{}{"outputs": outputs}
+	_, _, err := db.client.From("generations").Update(row, "", "").Eq("id", id).Execute()
+	return err
+}
+
+func (db *Database) ListRunningGenerations() ([]Generation, error) {
+	data, _, err := db.client.From("generations").Select("*", "", false).
+		Eq("status", GenerationRunning).
+		Order("created_at", &postgrest.OrderOpts{Ascending: true}).Execute()
+	if err != nil {
+		return nil, err
+	}
+	var rows []Generation
+	json.Unmarshal(data, &rows)
+	return rows, nil
+}
+
+func (db *Database) ListGenerations(telegramID int64, offset, limit int) ([]Generation, error) {
+	data, _, err := db.client.From("generations").Select("*", "", false).
+		Eq("user_id", fmt.Sprintf("%d", telegramID)).
+		Order("created_at", &postgrest.OrderOpts{Ascending: false}).
+		Range(offset, offset+limit-1, "").Execute()
+	if err != nil {
+		return nil, err
+	}
+	var rows []Generation
+	json.Unmarshal(data, &rows)
+	return rows, nil
+}
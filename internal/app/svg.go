@@ -0,0 +1,353 @@
+package app
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+)
+
+// Batas ukuran SVG yang diunduh dan sisi terpanjang preview PNG. Render preview
+// dibatasi jumlah elemen, waktu, dan jumlah render yang berjalan bersamaan.
+const (
+	maxSVGBytes      = 10 << 20
+	svgPreviewSize   = 1024
+	maxSVGElements   = 20000
+	svgRenderTimeout = 10 * time.Second
+)
+
+var svgRenderSlots = make(chan struct{}, 2)
+
+const (
+	svgNamespace   = "http://www.w3.org/2000/svg"
+	xlinkNamespace = "http://www.w3.org/1999/xlink"
+)
+
+// Elemen yang boleh tetap ada setelah sanitasi (huruf kecil). Elemen lain dibuang
+// beserta isinya, termasuk script, foreignObject, a, dan animasi (set, animate*)
+// yang bisa mengubah atribut lain menjadi javascript: lewat to/from/values.
+var safeSVGElements = map[string]bool{
+	"svg": true, "g": true, "defs": true, "symbol": true, "use": true, "title": true, "desc": true,
+	"path": true, "rect": true, "circle": true, "ellipse": true, "line": true, "polyline": true, "polygon": true,
+	"text": true, "tspan": true, "textpath": true, "image": true, "style": true, "switch": true,
+	"lineargradient": true, "radialgradient": true, "stop": true, "pattern": true,
+	"clippath": true, "mask": true, "marker": true, "filter": true,
+	"feblend": true, "fecolormatrix": true, "fecomponenttransfer": true, "fecomposite": true,
+	"feconvolvematrix": true, "fediffuselighting": true, "fedisplacementmap": true, "fedistantlight": true,
+	"fedropshadow": true, "feflood": true, "fefunca": true, "fefuncb": true, "fefuncg": true, "fefuncr": true,
+	"fegaussianblur": true, "femerge": true, "femergenode": true, "femorphology": true, "feoffset": true,
+	"fepointlight": true, "fespecularlighting": true, "fespotlight": true, "fetile": true, "feturbulence": true,
+}
+
+var (
+	// url(...) yang tidak menunjuk ke elemen di dokumen yang sama (#id)
+	cssExternalURL = regexp.MustCompile(`(?i)url\(\s*['"]?\s*[^#'"\s)][^)]*\)`)
+	cssImport      = regexp.MustCompile(`(?i)@import[^;]*;?`)
+	// Gambar inline yang aman disematkan; data:image/svg+xml bisa berisi script lagi
+	safeDataImage = regexp.MustCompile(`(?i)^data:image/(png|jpe?g|gif|webp);`)
+)
+
+// isSVGURL mengecek apakah URL menunjuk ke file .svg (atau data URI SVG)
+func isSVGURL(fileURL string) bool {
+	if strings.HasPrefix(fileURL, "data:") {
+		return strings.HasPrefix(fileURL, "data:image/svg+xml")
+	}
+	p := fileURL
+	if u, err := url.Parse(fileURL); err == nil {
+		p = u.Path
+	}
+	return strings.EqualFold(path.Ext(p), ".svg")
+}
+
+// downloadSVG mengunduh SVG hasil generasi dengan batas ukuran
+func downloadSVG(fileURL string) ([]byte, error) {
+	if strings.HasPrefix(fileURL, "data:") {
+		_, data, err := decodeDataURI(fileURL)
+		return data, err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(fileURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("download svg status %d", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSVGBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSVGBytes {
+		return nil, fmt.Errorf("svg too large")
+	}
+	return data, nil
+}
+
+// sanitizeSVG hanya menyisakan elemen di safeSVGElements, lalu membuang event handler (on*),
+// referensi eksternal (href, url() dan @import di CSS), DOCTYPE/entity dan komentar dari SVG.
+func sanitizeSVG(data []byte) ([]byte, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	var out bytes.Buffer
+	skip := 0 // kedalaman elemen yang sedang dibuang
+	inStyle := false
+
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			// Prefix selain svg bisa menunjuk ke namespace lain (mis. XHTML), jadi ikut dibuang
+			if skip > 0 || (t.Name.Space != "" && t.Name.Space != "svg") || !safeSVGElements[strings.ToLower(t.Name.Local)] {
+				skip++
+				continue
+			}
+			inStyle = strings.EqualFold(t.Name.Local, "style")
+			out.WriteString("<" + xmlName(t.Name))
+			for _, attr := range t.Attr {
+				value, ok := sanitizeSVGAttr(attr)
+				if !ok {
+					continue
+				}
+				out.WriteString(" " + xmlName(attr.Name) + `="`)
+				xml.EscapeText(&out, []byte(value))
+				out.WriteString(`"`)
+			}
+			out.WriteString(">")
+		case xml.EndElement:
+			if skip > 0 {
+				skip--
+				continue
+			}
+			inStyle = false
+			out.WriteString("</" + xmlName(t.Name) + ">")
+		case xml.CharData:
+			if skip == 0 {
+				text := string(t)
+				if inStyle {
+					text = sanitizeCSS(text)
+				}
+				xml.EscapeText(&out, []byte(text))
+			}
+		case xml.ProcInst:
+			if skip == 0 && t.Target == "xml" {
+				out.WriteString("<?xml " + string(t.Inst) + "?>")
+			}
+		}
+		// xml.Comment dan xml.Directive (DOCTYPE, ENTITY) selalu dibuang
+	}
+	if !bytes.Contains(out.Bytes(), []byte("<svg")) {
+		return nil, fmt.Errorf("not an svg document")
+	}
+	return out.Bytes(), nil
+}
+
+// sanitizeSVGAttr mengembalikan nilai atribut yang sudah aman, false jika atribut harus dibuang
+func sanitizeSVGAttr(attr xml.Attr) (string, bool) {
+	name := strings.ToLower(attr.Name.Local)
+	value := strings.TrimSpace(attr.Value)
+
+	// Deklarasi namespace hanya boleh untuk SVG dan XLink, supaya prefix yang lolos
+	// (svg:, xlink:) tidak bisa diarahkan ke namespace lain
+	switch {
+	case attr.Name.Space == "" && name == "xmlns":
+		return value, value == svgNamespace
+	case attr.Name.Space == "xmlns":
+		return value, (name == "svg" && value == svgNamespace) || (name == "xlink" && value == xlinkNamespace)
+	case attr.Name.Space != "" && attr.Name.Space != "xlink" && attr.Name.Space != "xml":
+		return "", false
+	}
+
+	if strings.HasPrefix(name, "on") {
+		return "", false
+	}
+	// Browser mengabaikan spasi dan karakter kontrol di dalam skema URL ("java\tscript:")
+	compact := strings.Map(func(r rune) rune {
+		if r <= ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(value))
+	if strings.Contains(compact, "javascript:") || strings.Contains(compact, "vbscript:") {
+		return "", false
+	}
+	if name == "href" || name == "src" {
+		return value, strings.HasPrefix(value, "#") || safeDataImage.MatchString(value)
+	}
+	return sanitizeCSS(attr.Value), true
+}
+
+// sanitizeCSS mengganti url() eksternal dengan none dan membuang @import. Escape CSS
+// dibuang dulu agar "\75rl(" atau "@\69mport" tidak lolos dari pencocokan.
+func sanitizeCSS(css string) string {
+	css = strings.ReplaceAll(css, `\`, "")
+	css = cssImport.ReplaceAllString(css, "")
+	return cssExternalURL.ReplaceAllString(css, "none")
+}
+
+// xmlName menulis nama elemen/atribut dengan prefix aslinya (RawToken tidak me-resolve namespace)
+func xmlName(n xml.Name) string {
+	if n.Space != "" {
+		return n.Space + ":" + n.Local
+	}
+	return n.Local
+}
+
+// rasterizeSVG merender preview PNG dengan batas jumlah elemen dan waktu. Render yang
+// melewati batas waktu tetap memegang slotnya sampai selesai, sehingga SVG yang berat
+// tidak bisa menumpuk goroutine render tanpa batas.
+func rasterizeSVG(data []byte) ([]byte, error) {
+	n, err := countSVGElements(data)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxSVGElements {
+		return nil, fmt.Errorf("svg has too many elements (%d)", n)
+	}
+
+	select {
+	case svgRenderSlots <- struct{}{}:
+	default:
+		return nil, fmt.Errorf("svg renderer busy")
+	}
+	type result struct {
+		png []byte
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- result{err: fmt.Errorf("svg render panic: %v", r)}
+			}
+			<-svgRenderSlots
+		}()
+		png, err := renderSVG(data)
+		done <- result{png, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.png, r.err
+	case <-time.After(svgRenderTimeout):
+		return nil, fmt.Errorf("svg render timed out")
+	}
+}
+
+// countSVGElements menghitung elemen di dokumen tanpa membangun tree
+func countSVGElements(data []byte) (int, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	n := 0
+	for {
+		tok, err := dec.RawToken()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if _, ok := tok.(xml.StartElement); ok {
+			n++
+			if n > maxSVGElements {
+				return n, nil
+			}
+		}
+	}
+}
+
+// renderSVG merender SVG menjadi PNG berlatar putih dengan sisi terpanjang svgPreviewSize
+func renderSVG(data []byte) ([]byte, error) {
+	icon, err := oksvg.ReadIconStream(bytes.NewReader(data), oksvg.IgnoreErrorMode)
+	if err != nil {
+		return nil, err
+	}
+	vw, vh := icon.ViewBox.W, icon.ViewBox.H
+	if vw <= 0 || vh <= 0 {
+		return nil, fmt.Errorf("svg has no viewBox")
+	}
+	scale := svgPreviewSize / vw
+	if vh > vw {
+		scale = svgPreviewSize / vh
+	}
+	w, h := int(vw*scale), int(vh*scale)
+	if w < 1 || h < 1 {
+		return nil, fmt.Errorf("svg too small")
+	}
+	icon.SetTarget(0, 0, float64(w), float64(h))
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	scanner := rasterx.NewScannerGV(w, h, img, img.Bounds())
+	icon.Draw(rasterx.NewDasher(w, h, scanner), 1)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// rehostSVG menyimpan salinan SVG yang sudah disanitasi di Supabase Storage
+// dan mengembalikan URL publiknya
+func (b *BotApp) rehostSVG(userID int64, index int, fileURL string) (string, error) {
+	data, err := downloadSVG(fileURL)
+	if err != nil {
+		return "", err
+	}
+	if data, err = sanitizeSVG(data); err != nil {
+		return "", err
+	}
+	filename := fmt.Sprintf("%d_%d_%d.svg", userID, time.Now().UnixNano(), index)
+	return b.UploadToStorage(filename, "image/svg+xml", data)
+}
+
+// sendSVG mengirim preview PNG (jika SVG bisa dirender) lalu file SVG-nya sebagai dokumen.
+// Tombol aksi dipasang di dokumen.
+func (b *BotApp) sendSVG(chatID int64, modelConf ModelConfig, fileURL, caption string, buttons []map[string]string) error {
+	data, err := downloadSVG(fileURL)
+	if err != nil {
+		// Biarkan Telegram mengambil sendiri dari URL-nya
+		fmt.Printf("[ERROR] Download svg %s: %v\n", fileURL, err)
+		return b.TG.SendDocument(chatID, fileURL, caption, buttons)
+	}
+	if modelConf.SanitizeSVG {
+		if data, err = sanitizeSVG(data); err != nil {
+			return fmt.Errorf("sanitize svg: %v", err)
+		}
+	}
+
+	if preview, err := rasterizeSVG(data); err == nil {
+		if err := b.TG.SendPhotoFile(chatID, "preview.png", preview, caption, nil); err == nil {
+			caption = ""
+		} else {
+			fmt.Printf("[ERROR] Send svg preview: %v\n", err)
+		}
+	} else {
+		fmt.Printf("[ERROR] Render svg preview: %v\n", err)
+	}
+
+	filename := "output.svg"
+	if u, err := url.Parse(fileURL); err == nil && !strings.HasPrefix(fileURL, "data:") {
+		filename = path.Base(u.Path)
+	}
+	return b.TG.SendDocumentFile(chatID, filename, data, caption, buttons)
+}
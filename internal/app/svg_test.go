@@ -0,0 +1,120 @@
+package app
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSanitizeSVG(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []string // harus ada di hasil
+		notWant []string // tidak boleh ada di hasil (huruf kecil)
+	}{
+		{
+			name:    "script",
+			in:      `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script><rect width="1"/></svg>`,
+			want:    []string{"<rect"},
+			notWant: []string{"script", "alert"},
+		},
+		{
+			name:    "foreignObject",
+			in:      `<svg xmlns="http://www.w3.org/2000/svg"><foreignObject><body xmlns="http://www.w3.org/1999/xhtml"><iframe src="http://evil/"/></body></foreignObject></svg>`,
+			notWant: []string{"foreignobject", "iframe", "evil"},
+		},
+		{
+			name:    "event handler",
+			in:      `<svg xmlns="http://www.w3.org/2000/svg" onload="alert(1)"><rect onclick="alert(2)"/></svg>`,
+			want:    []string{"<rect"},
+			notWant: []string{"onload", "onclick", "alert"},
+		},
+		{
+			name:    "external href",
+			in:      `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink"><image href="http://evil/x.png"/><use xlink:href="https://evil/y.svg#a"/><use href="#local"/></svg>`,
+			want:    []string{`href="#local"`},
+			notWant: []string{"evil"},
+		},
+		{
+			name:    "javascript href with whitespace",
+			in:      "<svg xmlns=\"http://www.w3.org/2000/svg\"><use href=\"java\tscript:alert(1)\"/></svg>",
+			notWant: []string{"script", "alert"},
+		},
+		{
+			name:    "data svg image",
+			in:      `<svg xmlns="http://www.w3.org/2000/svg"><image href="data:image/svg+xml;base64,PHN2Zz4="/><image href="data:image/png;base64,AAAA"/></svg>`,
+			want:    []string{"data:image/png"},
+			notWant: []string{"svg+xml"},
+		},
+		{
+			name:    "mixed-case url in style attribute",
+			in:      `<svg xmlns="http://www.w3.org/2000/svg"><rect style="fill:URL(http://evil/x)"/><rect style="fill:Url( 'http://evil/y' )"/></svg>`,
+			want:    []string{"fill:none"},
+			notWant: []string{"evil"},
+		},
+		{
+			name:    "escaped url and import in style element",
+			in:      `<svg xmlns="http://www.w3.org/2000/svg"><style>@IMPORT "http://evil/a.css"; rect { fill: u\rl(http://evil/b) }</style></svg>`,
+			notWant: []string{"evil", "@import"},
+		},
+		{
+			name: "local url reference kept",
+			in:   `<svg xmlns="http://www.w3.org/2000/svg"><rect fill="url(#grad)"/></svg>`,
+			want: []string{`fill="url(#grad)"`},
+		},
+		{
+			name:    "foreign namespace prefix",
+			in:      `<svg xmlns="http://www.w3.org/2000/svg" xmlns:h="http://www.w3.org/1999/xhtml"><h:script>alert(1)</h:script></svg>`,
+			notWant: []string{"xhtml", "script", "alert"},
+		},
+		{
+			name:    "animation",
+			in:      `<svg xmlns="http://www.w3.org/2000/svg"><a><set attributeName="href" to="javascript:alert(1)"/></a></svg>`,
+			notWant: []string{"<a", "<set", "alert"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := sanitizeSVG([]byte(tt.in))
+			if err != nil {
+				t.Fatalf("sanitizeSVG: %v", err)
+			}
+			got := string(out)
+			for _, s := range tt.want {
+				if !strings.Contains(got, s) {
+					t.Errorf("output missing %q: %s", s, got)
+				}
+			}
+			for _, s := range tt.notWant {
+				if strings.Contains(strings.ToLower(got), s) {
+					t.Errorf("output contains %q: %s", s, got)
+				}
+			}
+		})
+	}
+}
+
+func TestSanitizeSVGRejectsNonSVG(t *testing.T) {
+	if _, err := sanitizeSVG([]byte(`<html><script>alert(1)</script></html>`)); err == nil {
+		t.Error("expected error for a document without <svg>")
+	}
+}
+
+func TestSanitizeCSS(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"fill:red", "fill:red"},
+		{"fill:url(#a)", "fill:url(#a)"},
+		{"fill:url(http://evil/x)", "fill:none"},
+		{"fill:URL(http://evil/x)", "fill:none"},
+		{"fill:Url('//evil/x')", "fill:none"},
+		{`@import url("http://evil/a.css");fill:red`, "fill:red"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeCSS(tt.in); got != tt.want {
+			t.Errorf("sanitizeCSS(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -20,8 +20,11 @@ type ModelConfig struct {
 	Type        string           `json:"type"`
 	ReplicateID string           `json:"replicate_id"`
 	Cost        int              `json:"cost"`
+	DiamondCost int              `json:"diamond_cost"` // > 0: model dibayar dengan diamonds, bukan kredit
+	Tier        string           `json:"tier"`
 	Enabled     bool             `json:"enabled"`
 	Parameters  []ModelParameter `json:"parameters"`
+	Pricing     []PricingRule    `json:"pricing"` // kosong = harga dasar dikali num_outputs
 	Description string           `json:"description"`
 
 	// --- FIELD BARU (PENTING) ---
@@ -29,4 +32,19 @@ type ModelConfig struct {
 	AcceptsImageInput     bool   `json:"accepts_image_input"`
 	AcceptsMultipleImages bool   `json:"accepts_multiple_images"`
 	ImageParamName        string `json:"image_parameter_name"` 
-}
\ No newline at end of file
+	TimeoutSeconds        int    `json:"timeout_seconds"` // 0 = default sesuai type (lihat media.go)
+	SanitizeSVG           bool   `json:"sanitize_svg"`    // output SVG disanitasi sebelum dikirim/di-host ulang (svg.go)
+	Backend               string `json:"backend"`         // replicate (default), openai, comfyui, a1111 (backend.go)
+	BackendModel          string `json:"backend_model"`   // nama model di backend selain replicate (model OpenAI, checkpoint A1111, workflow ComfyUI)
+}
+
+// PricingRule menambah biaya berdasarkan nilai satu parameter (lihat pricing.go).
+// Satu rule boleh memakai beberapa bentuk sekaligus.
+type PricingRule struct {
+	Param    string             `json:"param"`
+	Add      map[string]int     `json:"add"`      // biaya tambahan per nilai opsi, mis. {"1080p": 5}
+	PerUnit  float64            `json:"per_unit"` // biaya per unit nilai numerik, mis. per detik video
+	Included float64            `json:"included"` // unit yang sudah termasuk harga dasar
+	Multiply map[string]float64 `json:"multiply"` // pengali per nilai opsi, mis. {"high": 1.5}
+	Scale    bool               `json:"scale"`    // total dikali nilai parameter (mis. num_outputs)
+}
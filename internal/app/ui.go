@@ -2,7 +2,9 @@ package app
 
 import (
 	"fmt"
+	"html"
 	"strings"
+	"time"
 )
 
 func (b *BotApp) ShowProviderList(chatID int64, user *User, isEdit bool, msgID int) {
@@ -10,11 +12,14 @@ func (b *BotApp) ShowProviderList(chatID int64, user *User, isEdit bool, msgID i
 	for _, p := range b.Providers {
 		buttons = append(buttons, map[string]string{"text": p.Name, "callback_data": "prov_" + p.ID})
 	}
+	if len(b.Pipelines) > 0 {
+		buttons = append(buttons, map[string]string{"text": b.I18n.Get(user.LanguageCode, "pipelines_btn"), "callback_data": "nav_pipelines"})
+	}
 	text := b.I18n.Get(user.LanguageCode, "select_provider")
 	if isEdit {
-		EditMessageText(b.BotToken, chatID, msgID, text, buttons)
+		b.TG.EditMessageText(chatID, msgID, text, buttons)
 	} else {
-		SendMessage(b.BotToken, chatID, text, buttons)
+		b.TG.SendMessage(chatID, text, buttons)
 	}
 }
 
@@ -42,8 +47,12 @@ func (b *BotApp) ShowModelPanel(chatID int64, msgID int, user *User, modelConf M
 		settingText += fmt.Sprintf("\n• <b>%s:</b> %v", cleanKey, v)
 	}
 	
-	totalCost := b.CalculateTotalCost(modelConf.Cost, user.DraftConfig)
-	settingText += fmt.Sprintf("\n\n💰 <b>Cost:</b> %d Credits", totalCost)
+	quote := b.CalculateTotalCost(modelConf, user.DraftConfig)
+	settingText += "\n\n" + b.I18n.Get(user.LanguageCode, "panel_cost", b.FormatAmount(user.LanguageCode, quote.Total, quote.Currency))
+	if len(quote.Lines) > 0 {
+		settingText += "\n<i>" + b.FormatBreakdown(user.LanguageCode, quote) + "</i>"
+	}
+	settingText += "\n" + b.I18n.Get(user.LanguageCode, "panel_balance", user.Balance(), user.Diamonds)
 
 	panelText := fmt.Sprintf("🤖 <b>%s</b>\n\nCurrent Settings:%s\n\n👇 <i>Tap buttons to configure, OR type prompt to start:</i>", modelConf.Name, settingText)
 
@@ -77,7 +86,7 @@ func (b *BotApp) ShowModelPanel(chatID int64, msgID int, user *User, modelConf M
 		"callback_data": "nav_cancel",
 	})
 
-	return EditMessageText(b.BotToken, chatID, msgID, panelText, buttons)
+	return b.TG.EditMessageText(chatID, msgID, panelText, buttons)
 }
 
 func (b *BotApp) ShowUploadPanel(chatID int64, msgID int, user *User, modelConf ModelConfig) {
@@ -105,7 +114,7 @@ func (b *BotApp) ShowUploadPanel(chatID int64, msgID int, user *User, modelConf
 		"callback_data": "upload_done",
 	})
 
-	EditMessageText(b.BotToken, chatID, msgID, text, buttons)
+	b.TG.EditMessageText(chatID, msgID, text, buttons)
 }
 
 func (b *BotApp) ShowSettingOptions(chatID int64, msgID int, user *User, paramName string, modelConf ModelConfig) {
@@ -129,5 +138,42 @@ func (b *BotApp) ShowSettingOptions(chatID int64, msgID int, user *User, paramNa
 		"text": b.I18n.Get(user.LanguageCode, "back_btn"),
 		"callback_data": "back_to_panel",
 	})
-	EditMessageText(b.BotToken, chatID, msgID, text, buttons)
+	b.TG.EditMessageText(chatID, msgID, text, buttons)
+}
+
+// ShowCreditHistory menampilkan saldo dan transaksi kredit terbaru user (/credits)
+func (b *BotApp) ShowCreditHistory(chatID int64, user *User) {
+	text := b.I18n.Get(user.LanguageCode, "credits_header", user.Balance(), user.Credits, user.PaidCredits, user.Diamonds)
+
+	txs, err := b.DB.GetCreditHistory(user.ID, 10)
+	if err != nil {
+		fmt.Printf("[ERROR] Credit history for %d: %v\n", user.ID, err)
+		b.TG.SendMessage(chatID, b.I18n.Get(user.LanguageCode, "error_generic"), nil)
+		return
+	}
+	if len(txs) == 0 {
+		text += "\n" + b.I18n.Get(user.LanguageCode, "credits_empty")
+	}
+
+	for _, tx := range txs {
+		date := tx.CreatedAt
+		if t, err := time.Parse(time.RFC3339Nano, tx.CreatedAt); err == nil {
+			date = t.UTC().Format("01-02 15:04")
+		}
+		amount := fmt.Sprintf("%+d", tx.Amount)
+		if tx.Currency == CurrencyDiamonds {
+			amount += " 💎"
+		}
+		line := fmt.Sprintf("\n<code>%s</code> <b>%s</b> %s", date, amount, b.I18n.Get(user.LanguageCode, "tx_"+tx.Kind))
+		if tx.ModelID != "" {
+			line += " · " + html.EscapeString(tx.ModelID)
+		}
+		if tx.Reason != "" && tx.Kind != TxDebit {
+			line += " (" + html.EscapeString(tx.Reason) + ")"
+		}
+		line += fmt.Sprintf(" → %d", tx.BalanceAfter)
+		text += line
+	}
+
+	b.TG.SendMessage(chatID, text, nil)
 }
\ No newline at end of file
@@ -0,0 +1,37 @@
+package app
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// WebhookHandler menerima update dari Telegram via HTTP POST.
+// Header X-Telegram-Bot-Api-Secret-Token wajib cocok dengan secret; secret kosong menolak semua request.
+func (b *BotApp) WebhookHandler(secret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		got := r.Header.Get("X-Telegram-Bot-Api-Secret-Token")
+		if secret == "" || subtle.ConstantTimeCompare([]byte(got), []byte(secret)) != 1 {
+			fmt.Println("[WARN] Webhook: invalid secret token from", r.RemoteAddr)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var update TelegramUpdate
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			fmt.Println("[ERROR] Webhook decode:", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// Balas 200 secepatnya, update diproses oleh dispatcher agar Telegram tidak retry
+		w.WriteHeader(http.StatusOK)
+		b.Dispatcher.Dispatch(update)
+	})
+}